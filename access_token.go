@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/simonhege/nestor/account"
+)
+
+// accessTokenJWTType is the typ header of JWT access tokens (RFC 9068 Section 2.1).
+const accessTokenJWTType = "at+jwt"
+
+// Account attributes that resource owners may add to the access tokens of their resource.
+var supportedAccessTokenAttributes = []string{"email", "name", "picture", "roles"}
+
+// initResourceAttributes reads the account attributes each resource wants in its access tokens,
+// a JSON object mapping resource indicators to attribute names, e.g. {"https://api.example.com": ["email", "roles"]}.
+func (a *app) initResourceAttributes() error {
+	a.resourceAttributes = make(map[string][]string)
+	value := os.Getenv("NESTOR_RESOURCE_ATTRIBUTES")
+	if value == "" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(value), &a.resourceAttributes); err != nil {
+		return fmt.Errorf("invalid NESTOR_RESOURCE_ATTRIBUTES: %w", err)
+	}
+	for resource, attributes := range a.resourceAttributes {
+		for _, attribute := range attributes {
+			if !slices.Contains(supportedAccessTokenAttributes, attribute) {
+				return fmt.Errorf("resource %q asks for the unsupported account attribute %q", resource, attribute)
+			}
+		}
+	}
+	return nil
+}
+
+// createAccessToken signs a JWT access token (RFC 9068) from claims, which hold at least sub, aud, client_id and scope.
+// The issuer, the issuance time and a unique jti are added, and the expiration time unless claims already has one.
+func (a *app) createAccessToken(ctx context.Context, claims jwt.MapClaims) (string, error) {
+	tNow := time.Now()
+	claims["iss"] = a.oidcConfig.Issuer
+	claims["iat"] = tNow.Unix()
+	claims["nbf"] = tNow.Unix()
+	claims["jti"] = rand.Text()
+	if _, ok := claims["exp"]; !ok {
+		claims["exp"] = tNow.Add(accessTokenTTL).Unix()
+	}
+	return a.signToken(ctx, accessTokenJWTType, claims)
+}
+
+// accountAttributeClaims returns the claims of the account attributes for an access token to audience.
+// A token is readable by all its audiences, so an attribute is only added when each of them asked for it.
+func (a *app) accountAttributeClaims(audience jwt.ClaimStrings, acc *account.Account) jwt.MapClaims {
+	claims := jwt.MapClaims{}
+	for _, attribute := range supportedAccessTokenAttributes {
+		released := len(audience) > 0
+		for _, resource := range audience {
+			released = released && slices.Contains(a.resourceAttributes[resource], attribute)
+		}
+		if !released {
+			continue
+		}
+		switch attribute {
+		case "email":
+			claims["email"] = acc.Email
+			claims["email_verified"] = true
+		case "name":
+			claims["name"] = acc.Name
+		case "picture":
+			claims["picture"] = acc.Picture
+		case "roles":
+			claims["roles"] = acc.Roles
+		}
+	}
+	return claims
+}
+
+// isAccessToken reports whether token is a JWT access token, and not e.g. an ID token signed with the same keys.
+func isAccessToken(token *jwt.Token) bool {
+	typ, _ := token.Header["typ"].(string)
+	return strings.EqualFold(typ, accessTokenJWTType) || strings.EqualFold(typ, "application/"+accessTokenJWTType)
+}
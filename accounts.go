@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"log/slog"
 	"net/http"
+	"strings"
 
 	"github.com/MicahParks/keyfunc/v3"
 	"github.com/golang-jwt/jwt/v5"
@@ -12,32 +14,63 @@ func (a *app) getTokenFromRequest(req *http.Request) (*jwt.Token, error) {
 	// Extract the JWT token from the Authorization header
 	authHeader := req.Header.Get("Authorization")
 	if authHeader == "" {
-		return nil, errUnauthorized
+		return nil, newOAuthError("invalid_request", "Missing access token")
 	}
 
-	// The token is expected to be in the format "Bearer <token>"
-	if len(authHeader) < 7 || authHeader[:7] != "Bearer " {
-		return nil, errUnauthorized
+	// The token is expected to be in the format "Bearer <token>", or "DPoP <token>" with a DPoP proof
+	scheme, rawToken, _ := strings.Cut(authHeader, " ")
+	if scheme != "Bearer" && scheme != "DPoP" {
+		return nil, newOAuthError("invalid_request", "Unsupported authorization scheme")
 	}
 
-	token := authHeader[7:]
+	token, err := a.parseToken(req.Context(), rawToken)
+	if err != nil {
+		return nil, err
+	}
+	if !isAccessToken(token) {
+		return nil, newOAuthError("invalid_token", "The token is not an access token")
+	}
+
+	// RFC 9449 Section 7: a bound token cannot be downgraded to a bearer token
+	jkt := dpopKeyThumbprint(token)
+	if scheme == "Bearer" {
+		if jkt != "" {
+			return nil, newOAuthError("invalid_token", "The access token is bound to a DPoP key")
+		}
+		return token, nil
+	}
+	if jkt == "" {
+		return nil, newOAuthError("invalid_token", "The access token is not bound to a DPoP key")
+	}
+	proofJKT, err := a.verifyDPoPProof(req, rawToken)
+	if err != nil {
+		return nil, err
+	}
+	if proofJKT != jkt {
+		return nil, newOAuthError("invalid_dpop_proof", "The DPoP proof was signed by another key")
+	}
+	return token, nil
+}
+
+// parseToken verifies that token was signed by one of our keys and is still valid.
+func (a *app) parseToken(ctx context.Context, token string, options ...jwt.ParserOption) (*jwt.Token, error) {
 	kf, err := keyfunc.New(keyfunc.Options{
-		Ctx:     req.Context(),
+		Ctx:     ctx,
 		Storage: a.jwks,
 	})
 	if err != nil {
-		slog.ErrorContext(req.Context(), "Failed to create keyfunc", "error", err)
-		return nil, errUnauthorized
+		slog.ErrorContext(ctx, "Failed to create keyfunc", "error", err)
+		return nil, err
 	}
 	// No audience validation, signature by us is enough to trust the token
-	jwtToken, err := jwt.Parse(token, kf.Keyfunc)
+	jwtToken, err := jwt.Parse(token, kf.Keyfunc, options...)
 	if err != nil {
-		slog.ErrorContext(req.Context(), "Failed to parse JWT token", "error", err)
-		return nil, errUnauthorized
+		slog.ErrorContext(ctx, "Failed to parse JWT token", "error", err)
+		return nil, wrapOAuthError("invalid_token", "The token is invalid", err)
 	}
 	if !jwtToken.Valid {
-		slog.ErrorContext(req.Context(), "Invalid JWT token", "error", err)
-		return nil, errUnauthorized
+		slog.ErrorContext(ctx, "Invalid JWT token", "error", err)
+		return nil, newOAuthError("invalid_token", "The token is invalid")
 	}
 
 	return jwtToken, nil
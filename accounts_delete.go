@@ -23,12 +23,24 @@ func (a *app) handleDeleteMyAccount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := a.accountStore.Delete(ctx, sub); err != nil {
+	accountID, err := a.accountIDForSubject(ctx, sub)
+	if err != nil {
 		http.Error(w, "Failed to delete account", http.StatusInternalServerError)
 		return
 	}
 
-	slog.InfoContext(ctx, "Account deleted successfully", "account_id", sub)
+	if err := a.accountStore.Delete(ctx, accountID); err != nil {
+		http.Error(w, "Failed to delete account", http.StatusInternalServerError)
+		return
+	}
+	if err := a.subjectStore.DeleteByAccount(ctx, accountID); err != nil {
+		slog.ErrorContext(ctx, "Failed to delete pairwise subjects", "account_id", accountID, "error", err)
+	}
+	if err := a.consentStore.DeleteByAccount(ctx, accountID); err != nil {
+		slog.ErrorContext(ctx, "Failed to delete consents", "account_id", accountID, "error", err)
+	}
+
+	slog.InfoContext(ctx, "Account deleted successfully", "account_id", accountID)
 
 	// Account deleted successfully
 	w.WriteHeader(http.StatusNoContent)
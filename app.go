@@ -2,46 +2,186 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"slices"
+	"time"
 
 	"github.com/MicahParks/jwkset"
 	"github.com/simonhege/nestor/account"
 	"github.com/simonhege/nestor/auth"
+	"github.com/simonhege/nestor/clients"
 	"github.com/simonhege/nestor/connector"
+	"github.com/simonhege/nestor/consent"
+	"github.com/simonhege/nestor/device"
+	"github.com/simonhege/nestor/par"
 	"github.com/simonhege/nestor/privatekeys"
 	"github.com/simonhege/nestor/refresh"
+	"github.com/simonhege/nestor/replay"
+	"github.com/simonhege/nestor/session"
+	"github.com/simonhege/nestor/subject"
 )
 
 type app struct {
 	baseURL         string
 	jwks            jwkset.Storage
 	oidcConfig      *openIDConfiguration
-	clients         map[string]client
+	clientStore     clients.Store
 	connectors      []connector.C
 	accountStore    account.Store
 	authStore       auth.Store
 	refreshStore    refresh.Store
+	sessionStore    session.Store
+	deviceStore     device.Store
+	parStore        par.Store
+	replayStore     replay.Store
+	subjectStore    subject.Store
+	consentStore    consent.Store
 	privateKeyStore privatekeys.Store
+	clientKeySets   clientKeySets
+
+	configuredClients  map[string]client   // Clients of the environment, they are not persisted so that removing one revokes it
+	resourceAttributes map[string][]string // Account attributes added to the access tokens of each resource
+	pairwiseSecret     []byte              // Key of the HMAC deriving pairwise subject identifiers
+	initialAccessToken string              // Required to register clients at /register, registration is disabled without it
 }
 
+// getClient returns the client configured in the environment or dynamically registered with clientID, nil if there is none.
 func (a *app) getClient(ctx context.Context, clientID string) (*client, error) {
-	client, exists := a.clients[clientID]
-	if !exists {
+	if configured, ok := a.configuredClients[clientID]; ok {
+		return &configured, nil
+	}
+	data, err := a.clientStore.Get(ctx, clientID)
+	if err != nil {
+		return nil, err
+	}
+	// Only dynamically registered clients are stored, clients of the environment stored by earlier versions are ignored
+	if data == nil || data.RegistrationTokenHash == "" {
 		return nil, nil // Client not found
 	}
+	client := clientFromData(*data)
 	return &client, nil
 }
 
+// putClient stores a dynamically registered client in the client store.
+func (a *app) putClient(ctx context.Context, client client) error {
+	return a.clientStore.Put(ctx, client.data())
+}
+
 type client struct {
-	ClientID                 string    `json:"client_id"`
-	RedirectURIs             []string  `json:"redirect_uris"`
-	DefaultResourceIndicator string    `json:"default_resource_indicator"`
-	LoginPage                loginPage `json:"login_page"`
+	ClientID                    string          `json:"client_id"`
+	Type                        clientType      `json:"client_type"`
+	Name                        string          `json:"client_name,omitempty"`
+	SecretHash                  []byte          `json:"client_secret_hash,omitempty"` // bcrypt hash, only for confidential clients
+	JWKS                        json.RawMessage `json:"jwks,omitempty"`               // Public keys verifying private_key_jwt client assertions
+	JWKSURI                     string          `json:"jwks_uri,omitempty"`           // URL of the public keys, when they are not inline
+	TokenEndpointAuthMethod     string          `json:"token_endpoint_auth_method,omitempty"`
+	GrantTypes                  []string        `json:"grant_types,omitempty"` // Grant types the client may use, all when empty
+	RedirectURIs                []string        `json:"redirect_uris"`
+	PostLogoutRedirectURIs      []string        `json:"post_logout_redirect_uris"`
+	RevokeRefreshTokensOnLogout bool            `json:"revoke_refresh_tokens_on_logout"`
+	DefaultResourceIndicator    string          `json:"default_resource_indicator"`
+	Resources                   []string        `json:"resources,omitempty"`                   // Other resources the client may request tokens for (RFC 8707)
+	ClientCredentialsScopes     []string        `json:"client_credentials_scopes,omitempty"`   // Scopes the client may request for itself
+	TokenExchangeAudiences      []string        `json:"token_exchange_audiences,omitempty"`    // Audiences the client may exchange tokens for
+	RequirePAR                  bool            `json:"require_pushed_authorization_requests"` // Only accept authorization requests pushed to /par
+	FirstParty                  bool            `json:"first_party"`                           // Trusted client of the operator, the end-user is not asked for consent
+	SubjectType                 subjectType     `json:"subject_type"`
+	SectorIdentifier            string          `json:"sector_identifier,omitempty"` // Pairwise subjects are derived from it, defaults to the redirect URIs host
+	LoginPage                   loginPage       `json:"login_page"`
+	RegistrationTokenHash       string          `json:"-"` // Hash of the registration access token of a dynamically registered client
+	IssuedAt                    time.Time       `json:"client_id_issued_at"`
 }
 
+// allowsGrantType reports whether the client may use grantType at the token endpoint.
+func (c *client) allowsGrantType(grantType string) bool {
+	return len(c.GrantTypes) == 0 || slices.Contains(c.GrantTypes, grantType)
+}
+
+func clientFromData(data clients.Data) client {
+	return client{
+		ClientID:                    data.ClientID,
+		Type:                        clientType(data.Type),
+		Name:                        data.Name,
+		SecretHash:                  data.SecretHash,
+		JWKS:                        data.JWKS,
+		JWKSURI:                     data.JWKSURI,
+		TokenEndpointAuthMethod:     data.TokenEndpointAuthMethod,
+		GrantTypes:                  data.GrantTypes,
+		RedirectURIs:                data.RedirectURIs,
+		PostLogoutRedirectURIs:      data.PostLogoutRedirectURIs,
+		RevokeRefreshTokensOnLogout: data.RevokeRefreshTokensOnLogout,
+		DefaultResourceIndicator:    data.DefaultResourceIndicator,
+		Resources:                   data.Resources,
+		ClientCredentialsScopes:     data.ClientCredentialsScopes,
+		TokenExchangeAudiences:      data.TokenExchangeAudiences,
+		RequirePAR:                  data.RequirePAR,
+		FirstParty:                  data.FirstParty,
+		SubjectType:                 subjectType(data.SubjectType),
+		SectorIdentifier:            data.SectorIdentifier,
+		LoginPage:                   loginPage(data.LoginPage),
+		RegistrationTokenHash:       data.RegistrationTokenHash,
+		IssuedAt:                    data.IssuedAt,
+	}
+}
+
+func (c *client) data() clients.Data {
+	return clients.Data{
+		ClientID:                    c.ClientID,
+		Type:                        string(c.Type),
+		Name:                        c.Name,
+		SecretHash:                  c.SecretHash,
+		JWKS:                        c.JWKS,
+		JWKSURI:                     c.JWKSURI,
+		TokenEndpointAuthMethod:     c.TokenEndpointAuthMethod,
+		GrantTypes:                  c.GrantTypes,
+		RedirectURIs:                c.RedirectURIs,
+		PostLogoutRedirectURIs:      c.PostLogoutRedirectURIs,
+		RevokeRefreshTokensOnLogout: c.RevokeRefreshTokensOnLogout,
+		DefaultResourceIndicator:    c.DefaultResourceIndicator,
+		Resources:                   c.Resources,
+		ClientCredentialsScopes:     c.ClientCredentialsScopes,
+		TokenExchangeAudiences:      c.TokenExchangeAudiences,
+		RequirePAR:                  c.RequirePAR,
+		FirstParty:                  c.FirstParty,
+		SubjectType:                 string(c.SubjectType),
+		SectorIdentifier:            c.SectorIdentifier,
+		LoginPage:                   clients.LoginPage(c.LoginPage),
+		RegistrationTokenHash:       c.RegistrationTokenHash,
+		IssuedAt:                    c.IssuedAt,
+	}
+}
+
+// isConfidential reports whether the client authenticates with a secret or a private key at the token endpoint.
+func (c *client) isConfidential() bool {
+	return c.Type == clientTypeConfidential
+}
+
+// clientType is the OAuth 2.0 client type (RFC 6749 Section 2.1).
+type clientType string
+
+const (
+	clientTypePublic       clientType = "public"       // Cannot keep a secret, e.g. single page or native applications
+	clientTypeConfidential clientType = "confidential" // Authenticates with a client secret or a private key
+)
+
 type loginPage struct {
 	Title       string `json:"title"`
 	Email       string `json:"email"`
 	Password    string `json:"password"`
 	Submit      string `json:"submit"`
 	ConnectWith string `json:"connect_with"`
+	LoggedOut   string `json:"logged_out"`
+}
+
+// defaultLoginPage returns the labels of the pages shown to the end-users of the client named name,
+// when they are not configured.
+func defaultLoginPage(name string) loginPage {
+	return loginPage{
+		Title:       "Se connecter à " + name,
+		Email:       "Email",
+		Password:    "Mot de passe",
+		Submit:      "Se connecter",
+		ConnectWith: "Se connecter avec",
+		LoggedOut:   "Vous êtes déconnecté",
+	}
 }
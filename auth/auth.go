@@ -1,6 +1,9 @@
 package auth
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 // AuthData represents the data associated with an authentication request.
 type AuthData struct {
@@ -8,8 +11,17 @@ type AuthData struct {
 	Code                string
 	CodeChallenge       string
 	CodeChallengeMethod string
+	Nonce               string
+	RedirectURI         string // redirect_uri of the authorization request, the token request must repeat it
 	GrantedScopes       []string
+	Resources           []string // Resource indicators (RFC 8707) requested at the authorization endpoint
+	UserInfoClaims      []string // Claims requested for the UserInfo endpoint with the claims parameter
+	IDTokenClaims       []string // Claims requested for the ID token with the claims parameter
 	AccountID           string
+	AuthTime            time.Time // Time of the end-user authentication
+	ExpiresAt           time.Time
+	Consumed            bool   // Set when the code is redeemed, redeeming it again revokes the tokens issued from it
+	FamilyID            string // Family of the refresh tokens issued from the code
 }
 
 // Store defines the interface for storing and retrieving authentication data.
@@ -17,4 +29,7 @@ type Store interface {
 	Put(ctx context.Context, authData AuthData) error
 	Get(ctx context.Context, code string) (*AuthData, error)
 	Delete(ctx context.Context, code string) error
+	// Consume atomically marks the code as consumed and records familyID, the family of the refresh tokens issued from it.
+	// It returns the data as it was before, already consumed when the code is reused, or nil for an unknown code.
+	Consume(ctx context.Context, code, familyID string) (*AuthData, error)
 }
@@ -7,11 +7,14 @@ import (
 	"net/http"
 	"net/url"
 	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/simonhege/nestor/account"
 	"github.com/simonhege/nestor/auth"
 	"github.com/simonhege/nestor/csrf"
+	"github.com/simonhege/nestor/session"
 	"github.com/simonhege/nestor/signed"
 )
 
@@ -19,29 +22,71 @@ type oAuthParams struct {
 	ClientID            string
 	RedirectURI         string
 	ResponseType        string
+	ResponseMode        string
 	Scope               string
 	State               string
 	CodeChallenge       string
 	CodeChallengeMethod string
+	Nonce               string
+	Prompt              string
+	MaxAge              int // Maximum authentication age in seconds, -1 when not requested
+	LoginHint           string
+	UILocales           string
+	Resources           []string // Resource indicators (RFC 8707)
+	UserInfoClaims      []string // Claims requested with the claims parameter (OIDC Core Section 5.5)
+	IDTokenClaims       []string
+}
+
+// forceLogin reports whether the end-user must authenticate again despite an authentication at authTime.
+func (p oAuthParams) forceLogin(authTime time.Time) bool {
+	if slices.Contains(strings.Fields(p.Prompt), "login") {
+		return true
+	}
+	return p.MaxAge >= 0 && time.Since(authTime) > time.Duration(p.MaxAge)*time.Second
 }
 
 func (a *app) handleAuthorize(w http.ResponseWriter, req *http.Request) {
 	ctx := req.Context()
 
-	oauthParams := oAuthParams{
-		ClientID:            req.URL.Query().Get("client_id"),
-		RedirectURI:         req.URL.Query().Get("redirect_uri"),
-		ResponseType:        req.URL.Query().Get("response_type"),
-		Scope:               req.URL.Query().Get("scope"),
-		State:               req.URL.Query().Get("state"),
-		CodeChallenge:       req.URL.Query().Get("code_challenge"),
-		CodeChallengeMethod: req.URL.Query().Get("code_challenge_method"),
+	// RFC 9126 Section 4: a pushed authorization request replaces the query parameters
+	query := req.URL.Query()
+	pushed := query.Has("request_uri")
+	if pushed {
+		var err error
+		query, err = a.pushedParameters(ctx, query.Get("client_id"), query.Get("request_uri"))
+		if err != nil {
+			slog.WarnContext(ctx, "Invalid request_uri", "client_id", req.URL.Query().Get("client_id"), "error", err)
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+	}
+	// RFC 9101: the parameters of a signed request object replace the query parameters too.
+	// The redirect URI is only trusted once the request object is verified, so errors are not redirected.
+	if query.Has("request") {
+		var err error
+		query, err = a.requestObjectParameters(ctx, query)
+		if err != nil {
+			slog.WarnContext(ctx, "Invalid request object", "client_id", req.URL.Query().Get("client_id"), "error", err)
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
 	}
 
-	if oauthParams.ResponseType != "code" {
-		slog.WarnContext(ctx, "Unsupported response_type", "client_id", oauthParams.ClientID, "response_type", oauthParams.ResponseType)
-		http.Error(w, "Bad request", http.StatusBadRequest)
-		return
+	oauthParams := oAuthParams{
+		ClientID:            query.Get("client_id"),
+		RedirectURI:         query.Get("redirect_uri"),
+		ResponseType:        query.Get("response_type"),
+		ResponseMode:        query.Get("response_mode"),
+		Scope:               query.Get("scope"),
+		State:               query.Get("state"),
+		CodeChallenge:       query.Get("code_challenge"),
+		CodeChallengeMethod: query.Get("code_challenge_method"),
+		Nonce:               query.Get("nonce"),
+		Prompt:              query.Get("prompt"),
+		MaxAge:              -1,
+		LoginHint:           query.Get("login_hint"),
+		UILocales:           query.Get("ui_locales"),
+		Resources:           query["resource"],
 	}
 
 	// Verify client exists and redirect URI is accepted
@@ -62,6 +107,81 @@ func (a *app) handleAuthorize(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// From now on errors are sent back to the validated redirect URI
+	if client.RequirePAR && !pushed {
+		slog.WarnContext(ctx, "Pushed authorization request required", "client_id", oauthParams.ClientID)
+		redirectError(ctx, w, req, oauthParams, "invalid_request", "The client must use a pushed authorization request")
+		return
+	}
+	if oauthParams.ResponseMode != "" && !slices.Contains(supportedResponseModes, oauthParams.ResponseMode) {
+		slog.WarnContext(ctx, "Unsupported response_mode", "client_id", oauthParams.ClientID, "response_mode", oauthParams.ResponseMode)
+		oauthParams.ResponseMode = "" // Answer with the default response mode
+		redirectError(ctx, w, req, oauthParams, "invalid_request", "Unsupported response_mode")
+		return
+	}
+	if !slices.Contains(supportedResponseTypes, oauthParams.ResponseType) {
+		slog.WarnContext(ctx, "Unsupported response_type", "client_id", oauthParams.ClientID, "response_type", oauthParams.ResponseType)
+		redirectError(ctx, w, req, oauthParams, "unsupported_response_type", "Unsupported response_type")
+		return
+	}
+	// PKCE is mandatory for public clients only
+	if oauthParams.CodeChallenge == "" && !client.isConfidential() {
+		slog.WarnContext(ctx, "Missing code_challenge", "client_id", oauthParams.ClientID)
+		redirectError(ctx, w, req, oauthParams, "invalid_request", "code_challenge is required")
+		return
+	}
+	if oauthParams.CodeChallenge != "" && !slices.Contains(supportedCodeChallengeMethods, oauthParams.CodeChallengeMethod) {
+		slog.WarnContext(ctx, "Unsupported code_challenge_method", "client_id", oauthParams.ClientID, "code_challenge_method", oauthParams.CodeChallengeMethod)
+		redirectError(ctx, w, req, oauthParams, "invalid_request", "Unsupported code_challenge_method")
+		return
+	}
+	oauthParams.UserInfoClaims, oauthParams.IDTokenClaims, err = parseClaimsRequest(query.Get("claims"))
+	if err != nil {
+		slog.WarnContext(ctx, "Invalid claims parameter", "client_id", oauthParams.ClientID, "error", err)
+		redirectError(ctx, w, req, oauthParams, "invalid_request", "The claims parameter must be a JSON object")
+		return
+	}
+	if err := validateResources(client, oauthParams.Resources); err != nil {
+		slog.WarnContext(ctx, "Invalid resource", "client_id", oauthParams.ClientID, "resource", oauthParams.Resources)
+		redirectError(ctx, w, req, oauthParams, err.Code, err.Description)
+		return
+	}
+
+	if maxAge := query.Get("max_age"); maxAge != "" {
+		oauthParams.MaxAge, err = strconv.Atoi(maxAge)
+		if err != nil || oauthParams.MaxAge < 0 {
+			slog.WarnContext(ctx, "Invalid max_age", "client_id", oauthParams.ClientID, "max_age", maxAge)
+			redirectError(ctx, w, req, oauthParams, "invalid_request", "max_age must be a non-negative integer")
+			return
+		}
+	}
+
+	prompt := strings.Fields(oauthParams.Prompt)
+	if slices.Contains(prompt, "none") && len(prompt) > 1 {
+		slog.WarnContext(ctx, "prompt=none combined with other values", "client_id", oauthParams.ClientID, "prompt", oauthParams.Prompt)
+		redirectError(ctx, w, req, oauthParams, "invalid_request", "prompt=none cannot be combined with other values")
+		return
+	}
+
+	// Single sign-on, the end-user already authenticated for this or another client
+	sess, acc, err := a.sessionAccount(ctx, req, oauthParams)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get session", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if sess != nil {
+		slog.InfoContext(ctx, "Reusing session", "client_id", oauthParams.ClientID, "account_id", acc.ID)
+		a.handleRedirect(ctx, w, req, oauthParams, acc, sess.AuthTime)
+		return
+	}
+	if slices.Contains(prompt, "none") {
+		// There is no way to authenticate the end-user without displaying the login page
+		slog.InfoContext(ctx, "Login required but prompt=none", "client_id", oauthParams.ClientID)
+		redirectError(ctx, w, req, oauthParams, "login_required", "End-user authentication is required")
+		return
+	}
+
 	csrfToken := csrf.NewToken()
 
 	signed.SetCookie(ctx, w, "oauth_params", oauthParams)
@@ -71,6 +191,8 @@ func (a *app) handleAuthorize(w http.ResponseWriter, req *http.Request) {
 		"CSRFToken":  csrfToken,
 		"Client":     client,
 		"Connectors": a.connectors,
+		"LoginHint":  oauthParams.LoginHint,
+		"Lang":       uiLang(oauthParams.UILocales),
 	})
 	if err != nil {
 		slog.ErrorContext(ctx, "Failed to render authorize template", "error", err)
@@ -122,19 +244,88 @@ func (a *app) handlePostAuthorize(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	a.handleRedirect(ctx, w, req, oauthParams, acc)
+	a.startSessionAndRedirect(ctx, w, req, oauthParams, acc)
 }
 
-func (a *app) handleRedirect(ctx context.Context, w http.ResponseWriter, req *http.Request, oauthParams oAuthParams, acc *account.Account) {
+// sessionAccount returns the session of the request and its account, when they can be used to skip the login page.
+func (a *app) sessionAccount(ctx context.Context, req *http.Request, oauthParams oAuthParams) (*session.Data, *account.Account, error) {
+	sess, err := a.currentSession(ctx, req)
+	if err != nil || sess == nil {
+		return nil, nil, err
+	}
+	if oauthParams.forceLogin(sess.AuthTime) {
+		return nil, nil, nil
+	}
+
+	acc, err := a.accountStore.GetById(ctx, sess.AccountID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if acc == nil || acc.Status != account.StatusActive {
+		slog.InfoContext(ctx, "Session account is no longer active", "account_id", sess.AccountID)
+		return nil, nil, nil
+	}
+	return sess, acc, nil
+}
 
+// startSessionAndRedirect opens a session for the account that has just authenticated, then redirects to the client.
+func (a *app) startSessionAndRedirect(ctx context.Context, w http.ResponseWriter, req *http.Request, oauthParams oAuthParams, acc *account.Account) {
+	sess, err := a.startSession(ctx, w, acc.ID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to start session", "account_id", acc.ID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	a.handleRedirect(ctx, w, req, oauthParams, acc, sess.AuthTime)
+}
+
+// handleRedirect answers the authorization request of the authenticated account,
+// once the end-user approved the requested scopes and claims for the client.
+func (a *app) handleRedirect(ctx context.Context, w http.ResponseWriter, req *http.Request, oauthParams oAuthParams, acc *account.Account, authTime time.Time) {
+	client, err := a.getClient(ctx, oauthParams.ClientID)
+	if err != nil || client == nil {
+		slog.ErrorContext(ctx, "Failed to get client", "client_id", oauthParams.ClientID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	scopes, claims, err := a.unapprovedGrant(ctx, client, acc.ID, oauthParams)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get consent", "client_id", oauthParams.ClientID, "account_id", acc.ID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(scopes) > 0 || len(claims) > 0 {
+		if slices.Contains(strings.Fields(oauthParams.Prompt), "none") {
+			slog.InfoContext(ctx, "Consent required but prompt=none", "client_id", oauthParams.ClientID, "account_id", acc.ID)
+			redirectError(ctx, w, req, oauthParams, "consent_required", "End-user consent is required")
+			return
+		}
+		slog.InfoContext(ctx, "Asking for consent", "client_id", oauthParams.ClientID, "account_id", acc.ID, "scopes", scopes, "claims", claims)
+		a.showConsentPage(ctx, w, oauthParams, client, scopes, claims)
+		return
+	}
+
+	a.sendAuthorizationCode(ctx, w, req, oauthParams, acc, authTime)
+}
+
+// sendAuthorizationCode issues an authorization code for the requested scopes and sends it to the redirect URI.
+func (a *app) sendAuthorizationCode(ctx context.Context, w http.ResponseWriter, req *http.Request, oauthParams oAuthParams, acc *account.Account, authTime time.Time) {
 	authData := auth.AuthData{
 		ClientID:            oauthParams.ClientID,
 		Code:                rand.Text(),
 		CodeChallenge:       oauthParams.CodeChallenge,
 		CodeChallengeMethod: oauthParams.CodeChallengeMethod,
+		Nonce:               oauthParams.Nonce,
+		RedirectURI:         oauthParams.RedirectURI,
 
-		GrantedScopes: strings.Split(oauthParams.Scope, " "),
-		AccountID:     acc.ID,
+		GrantedScopes:  strings.Fields(oauthParams.Scope),
+		Resources:      oauthParams.Resources,
+		UserInfoClaims: oauthParams.UserInfoClaims,
+		IDTokenClaims:  oauthParams.IDTokenClaims,
+		AccountID:      acc.ID,
+		AuthTime:       authTime,
+		ExpiresAt:      time.Now().Add(authorizationCodeTTL),
 	}
 
 	// Save the authorization data for token exchange in a same site strict cookie
@@ -144,12 +335,33 @@ func (a *app) handleRedirect(ctx context.Context, w http.ResponseWriter, req *ht
 		return
 	}
 
-	// Generate the code and redirect to the redirect_uri
+	// Send the code back to the redirect_uri
 	params := url.Values{
 		"code":  []string{authData.Code},
 		"state": []string{oauthParams.State},
 	}
-	redirectURL := oauthParams.RedirectURI + "?" + params.Encode()
-	slog.InfoContext(ctx, "redirecting to", "url", redirectURL)
-	http.Redirect(w, req, redirectURL, http.StatusFound)
+	sendAuthorizationResponse(ctx, w, req, oauthParams, params)
+}
+
+// redirectError sends an authorization error response (RFC 6749 Section 4.1.2.1) to the redirect URI.
+// Errors that occur before this point are answered with a plain 400, as there is no trusted place to send them.
+// It must only be called once the client and the redirect URI have been validated.
+func redirectError(ctx context.Context, w http.ResponseWriter, req *http.Request, oauthParams oAuthParams, code, description string) {
+	params := url.Values{
+		"error":             []string{code},
+		"error_description": []string{description},
+	}
+	if oauthParams.State != "" {
+		params.Set("state", oauthParams.State)
+	}
+	sendAuthorizationResponse(ctx, w, req, oauthParams, params)
+}
+
+// uiLang returns the language of the login page from the preferred ui_locales, "en" by default.
+func uiLang(uiLocales string) string {
+	locales := strings.Fields(uiLocales)
+	if len(locales) == 0 {
+		return "en"
+	}
+	return locales[0]
 }
@@ -205,5 +205,5 @@ func (a *app) handleCallback(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	a.handleRedirect(ctx, w, req, oauthParams, acc)
+	a.startSessionAndRedirect(ctx, w, req, oauthParams, acc)
 }
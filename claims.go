@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/simonhege/nestor/account"
+)
+
+// userInfoClaimsClaim is the access token claim listing the claims requested for the UserInfo endpoint
+// with the claims parameter, the UserInfo endpoint only knows the grant from the access token.
+const userInfoClaimsClaim = "userinfo_claims"
+
+// Claims released for each scope (OIDC Core Section 5.4), roles is a scope of Nestor.
+var scopeClaims = map[string][]string{
+	"profile": {"name", "picture"},
+	"email":   {"email", "email_verified"},
+	"roles":   {"roles"},
+}
+
+// Account claims that may be requested individually with the claims parameter.
+var requestableClaims = []string{"email", "email_verified", "name", "picture", "roles"}
+
+// claimsRequest is the claims request parameter (OIDC Core Section 5.5).
+// The members of each object are claim names, their value or essential flag is not used.
+type claimsRequest struct {
+	UserInfo map[string]json.RawMessage `json:"userinfo"`
+	IDToken  map[string]json.RawMessage `json:"id_token"`
+}
+
+// requestedClaims are the names of the claims requested with the claims parameter.
+type requestedClaims struct {
+	UserInfo []string
+	IDToken  []string
+}
+
+// parseClaimsRequest returns the names of the claims requested for the UserInfo endpoint and for the ID token.
+// Claims that Nestor does not know are ignored, as OIDC Core Section 5.5 requires.
+func parseClaimsRequest(value string) (userInfo, idToken []string, err error) {
+	if value == "" {
+		return nil, nil, nil
+	}
+	var request claimsRequest
+	if err := json.Unmarshal([]byte(value), &request); err != nil {
+		return nil, nil, err
+	}
+	return requestedClaimNames(request.UserInfo), requestedClaimNames(request.IDToken), nil
+}
+
+func requestedClaimNames(members map[string]json.RawMessage) []string {
+	var names []string
+	for name := range members {
+		if slices.Contains(requestableClaims, name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// releasedClaims returns the claims of acc released for the granted scopes and the individually requested claims.
+func releasedClaims(acc *account.Account, scopes, requested []string) jwt.MapClaims {
+	names := slices.Clone(requested)
+	for _, scope := range scopes {
+		names = append(names, scopeClaims[scope]...)
+	}
+
+	claims := jwt.MapClaims{}
+	for _, name := range names {
+		switch name {
+		case "email":
+			claims["email"] = acc.Email
+		case "email_verified":
+			claims["email_verified"] = true
+		case "name":
+			claims["name"] = acc.Name
+		case "picture":
+			claims["picture"] = acc.Picture
+		case "roles":
+			claims["roles"] = acc.Roles
+		}
+	}
+	return claims
+}
+
+// tokenUserInfoClaims returns the claims requested for the UserInfo endpoint when token was issued.
+func tokenUserInfoClaims(token *jwt.Token) []string {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil
+	}
+	values, _ := claims[userInfoClaimsClaim].([]any)
+	var names []string
+	for _, value := range values {
+		if name, ok := value.(string); ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// clientAssertionTypeJWTBearer is the only client assertion type supported (RFC 7523 Section 2.2).
+const clientAssertionTypeJWTBearer = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// maxClientAssertionLifetime bounds the expiration time of the client assertions, and so the time their jti is remembered.
+const maxClientAssertionLifetime = time.Hour
+
+// Algorithms accepted for the JWTs signed by clients, symmetric algorithms would require a shared secret.
+var supportedClientSigningAlgs = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// maxClientKeySets bounds the number of jwks_uri whose JWK Set is refreshed in the background,
+// the least recently used one is stopped to make room for a new one.
+const maxClientKeySets = 100
+
+// clientKeySets caches the keyfuncs of the clients registered with a jwks_uri,
+// each of them refreshes its JWK Set in the background until it is stopped.
+type clientKeySets struct {
+	mu    sync.Mutex
+	byURI map[clientKeySetKey]*clientKeySet
+}
+
+// clientKeySetKey identifies a cached key set, the JWK Set of dynamically registered clients is fetched from public hosts only.
+type clientKeySetKey struct {
+	uri        string
+	publicOnly bool
+}
+
+// clientKeySet is the keyfunc of a jwks_uri and the cancellation of its background refresh.
+type clientKeySet struct {
+	keyfunc  keyfunc.Keyfunc
+	stop     context.CancelFunc
+	lastUsed time.Time
+}
+
+// get returns the keyfunc of uri, starting the refresh of its JWK Set when it is not cached yet.
+// With publicOnly, the JWK Set is fetched with publicHTTPClient.
+func (k *clientKeySets) get(uri string, publicOnly bool) (keyfunc.Keyfunc, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key := clientKeySetKey{uri: uri, publicOnly: publicOnly}
+	if set, exists := k.byURI[key]; exists {
+		set.lastUsed = time.Now()
+		return set.keyfunc, nil
+	}
+
+	// The JWK Set is refreshed beyond the current request, until the key set is evicted or forgotten
+	ctx, stop := context.WithCancel(context.Background())
+	var override keyfunc.Override
+	if publicOnly {
+		override.Client = publicHTTPClient
+	}
+	kf, err := keyfunc.NewDefaultOverrideCtx(ctx, []string{uri}, override)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	if k.byURI == nil {
+		k.byURI = make(map[clientKeySetKey]*clientKeySet)
+	}
+	if len(k.byURI) >= maxClientKeySets {
+		k.evictLeastRecentlyUsed()
+	}
+	k.byURI[key] = &clientKeySet{keyfunc: kf, stop: stop, lastUsed: time.Now()}
+	return kf, nil
+}
+
+// forget stops the refresh of the JWK Set of uri, it is fetched again when a client needs it.
+func (k *clientKeySets) forget(uri string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, publicOnly := range []bool{false, true} {
+		key := clientKeySetKey{uri: uri, publicOnly: publicOnly}
+		if set, exists := k.byURI[key]; exists {
+			set.stop()
+			delete(k.byURI, key)
+		}
+	}
+}
+
+// evictLeastRecentlyUsed stops the refresh of the key set used the longest time ago, k.mu must be held.
+func (k *clientKeySets) evictLeastRecentlyUsed() {
+	var oldestKey clientKeySetKey
+	var oldest *clientKeySet
+	for key, set := range k.byURI {
+		if oldest == nil || set.lastUsed.Before(oldest.lastUsed) {
+			oldestKey, oldest = key, set
+		}
+	}
+	if oldest != nil {
+		oldest.stop()
+		delete(k.byURI, oldestKey)
+	}
+}
+
+// authenticateClientAssertion authenticates a client with a JWT signed by one of its keys,
+// the private_key_jwt method of OpenID Connect Core 1.0 Section 9 (RFC 7523 Section 3).
+func (a *app) authenticateClientAssertion(req *http.Request) (*client, error) {
+	ctx := req.Context()
+
+	if req.FormValue("client_assertion_type") != clientAssertionTypeJWTBearer {
+		slog.WarnContext(ctx, "Unsupported client assertion type", "client_assertion_type", req.FormValue("client_assertion_type"))
+		return nil, newOAuthError("invalid_client", "Unsupported client assertion type")
+	}
+	assertion := req.FormValue("client_assertion")
+	if assertion == "" {
+		slog.WarnContext(ctx, "Missing client assertion")
+		return nil, newOAuthError("invalid_request", "client_assertion is required")
+	}
+	if _, _, ok := req.BasicAuth(); ok || req.FormValue("client_secret") != "" {
+		return nil, newOAuthError("invalid_request", "Only one client authentication method may be used")
+	}
+
+	// The issuer identifies the client, whose keys are needed to verify the signature
+	unverified, _, err := jwt.NewParser().ParseUnverified(assertion, jwt.MapClaims{})
+	if err != nil {
+		slog.WarnContext(ctx, "Malformed client assertion", "error", err)
+		return nil, wrapOAuthError("invalid_client", "Malformed client assertion", err)
+	}
+	clientID, _ := unverified.Claims.GetIssuer()
+	if formID := req.FormValue("client_id"); formID != "" && formID != clientID {
+		slog.WarnContext(ctx, "Client assertion issuer mismatch", "client_id", formID, "iss", clientID)
+		return nil, newOAuthError("invalid_request", "client_id does not match the authenticated client")
+	}
+
+	client, err := a.getClient(ctx, clientID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get client", "client_id", clientID, "error", err)
+		return nil, err
+	}
+	if client == nil {
+		slog.WarnContext(ctx, "Client not found", "client_id", clientID)
+		return nil, newOAuthError("invalid_client", "Unknown client")
+	}
+	if len(client.JWKS) == 0 && client.JWKSURI == "" {
+		slog.WarnContext(ctx, "Client has no registered keys", "client_id", clientID)
+		return nil, newOAuthError("invalid_client", "The client has no registered keys")
+	}
+
+	kf, err := a.clientKeyfunc(client)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to load client keys", "client_id", clientID, "error", err)
+		return nil, err
+	}
+
+	// RFC 7523 Section 3: the token endpoint must be an audience, the issuer identifier is accepted as well
+	audiences := []string{a.oidcConfig.TokenEndpoint}
+	if a.oidcConfig.Issuer != "" {
+		audiences = append(audiences, a.oidcConfig.Issuer)
+	}
+	token, err := jwt.Parse(assertion, kf.KeyfuncCtx(ctx),
+		jwt.WithValidMethods(supportedClientSigningAlgs),
+		jwt.WithIssuer(clientID),
+		jwt.WithSubject(clientID),
+		jwt.WithAudience(audiences...),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		slog.WarnContext(ctx, "Invalid client assertion", "client_id", clientID, "error", err)
+		return nil, wrapOAuthError("invalid_client", "Invalid client assertion", err)
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		slog.WarnContext(ctx, "Client assertion without jti", "client_id", clientID)
+		return nil, newOAuthError("invalid_client", "The client assertion must have a jti")
+	}
+	// The jti only has to be remembered until the assertion expires, it is rejected afterwards anyway
+	exp, _ := claims.GetExpirationTime()
+	if exp.After(time.Now().Add(maxClientAssertionLifetime)) {
+		slog.WarnContext(ctx, "Client assertion expires too late", "client_id", clientID, "exp", exp.Time)
+		return nil, newOAuthError("invalid_client", "The client assertion expires too late")
+	}
+	unused, err := a.replayStore.Use(ctx, "client_assertion:"+clientID+":"+jti, exp.Time)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to record client assertion", "client_id", clientID, "error", err)
+		return nil, err
+	}
+	if !unused {
+		slog.WarnContext(ctx, "Client assertion replayed", "client_id", clientID, "jti", jti)
+		return nil, newOAuthError("invalid_client", "The client assertion was already used")
+	}
+
+	return client, nil
+}
+
+// clientKeyfunc returns the keyfunc verifying the signatures of client,
+// built from its inline JWK Set or from its jwks_uri.
+func (a *app) clientKeyfunc(client *client) (keyfunc.Keyfunc, error) {
+	if len(client.JWKS) > 0 {
+		return keyfunc.NewJWKSetJSON(client.JWKS)
+	}
+
+	// The jwks_uri of a dynamically registered client is chosen by the client, not by the operator
+	return a.clientKeySets.get(client.JWKSURI, client.RegistrationTokenHash != "")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Client authentication methods supported at the token endpoint (RFC 7591 Section 2).
+var supportedTokenEndpointAuthMethods = []string{"none", "client_secret_basic", "client_secret_post", "private_key_jwt"}
+
+// authenticateClient identifies and authenticates the calling client (RFC 6749 Section 2.3).
+// Confidential clients use HTTP Basic authentication (client_secret_basic) or the client_id and
+// client_secret form parameters (client_secret_post) or a JWT signed with one of their keys
+// (private_key_jwt), public clients only send their client_id.
+// It returns an invalid_client error when the client cannot be authenticated.
+func (a *app) authenticateClient(req *http.Request) (*client, error) {
+	ctx := req.Context()
+
+	if req.FormValue("client_assertion_type") != "" || req.FormValue("client_assertion") != "" {
+		client, err := a.authenticateClientAssertion(req)
+		if err != nil {
+			return nil, err
+		}
+		if err := client.checkAuthMethod(ctx, "private_key_jwt"); err != nil {
+			return nil, err
+		}
+		return client, nil
+	}
+
+	clientID, clientSecret, err := clientCredentials(req)
+	if err != nil {
+		slog.WarnContext(ctx, "Invalid client credentials", "error", err)
+		return nil, err
+	}
+	if clientID == "" {
+		slog.WarnContext(ctx, "Missing client credentials")
+		return nil, newOAuthError("invalid_client", "Missing client credentials")
+	}
+
+	client, err := a.getClient(ctx, clientID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get client", "client_id", clientID, "error", err)
+		return nil, err
+	}
+	if client == nil {
+		slog.WarnContext(ctx, "Client not found", "client_id", clientID)
+		return nil, newOAuthError("invalid_client", "Unknown client")
+	}
+
+	method := "none"
+	if client.isConfidential() {
+		if clientSecret == "" {
+			slog.WarnContext(ctx, "Missing client secret", "client_id", clientID)
+			return nil, newOAuthError("invalid_client", "Client authentication is required")
+		}
+		if bcrypt.CompareHashAndPassword(client.SecretHash, []byte(clientSecret)) != nil {
+			slog.WarnContext(ctx, "Invalid client secret", "client_id", clientID)
+			return nil, newOAuthError("invalid_client", "Client authentication failed")
+		}
+		method = "client_secret_post"
+		if _, _, ok := req.BasicAuth(); ok {
+			method = "client_secret_basic"
+		}
+	}
+	if err := client.checkAuthMethod(ctx, method); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// checkAuthMethod rejects an authentication method other than the one the client registered, if any.
+func (c *client) checkAuthMethod(ctx context.Context, method string) error {
+	if c.TokenEndpointAuthMethod != "" && c.TokenEndpointAuthMethod != method {
+		slog.WarnContext(ctx, "Unexpected client authentication method", "client_id", c.ClientID, "method", method, "registered", c.TokenEndpointAuthMethod)
+		return newOAuthError("invalid_client", "The client must authenticate with "+c.TokenEndpointAuthMethod)
+	}
+	return nil
+}
+
+// clientCredentials extracts the client_id and client_secret of the request,
+// rejecting requests that use more than one authentication method.
+func clientCredentials(req *http.Request) (clientID, clientSecret string, err error) {
+	basicID, basicSecret, ok := req.BasicAuth()
+	if !ok {
+		return req.FormValue("client_id"), req.FormValue("client_secret"), nil
+	}
+	if req.FormValue("client_secret") != "" {
+		return "", "", newOAuthError("invalid_request", "Only one client authentication method may be used")
+	}
+
+	// RFC 6749 Section 2.3.1: the credentials are form-urlencoded before being used as Basic credentials
+	if clientID, err = url.QueryUnescape(basicID); err != nil {
+		return "", "", newOAuthError("invalid_client", "Malformed client credentials")
+	}
+	if clientSecret, err = url.QueryUnescape(basicSecret); err != nil {
+		return "", "", newOAuthError("invalid_client", "Malformed client credentials")
+	}
+	if formID := req.FormValue("client_id"); formID != "" && formID != clientID {
+		return "", "", newOAuthError("invalid_request", "client_id does not match the authenticated client")
+	}
+	return clientID, clientSecret, nil
+}
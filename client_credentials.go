@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// handleClientCredentialsGrant issues an access token to a confidential client acting on its own behalf (RFC 6749 Section 4.4).
+// The token subject is the client itself, no ID token nor refresh token is issued.
+func (a *app) handleClientCredentialsGrant(ctx context.Context, client *client, req *http.Request, jkt string) (tokenResponse, error) {
+	clientID := client.ClientID
+	if !client.isConfidential() {
+		slog.WarnContext(ctx, "Public client cannot use client_credentials", "client_id", clientID)
+		return tokenResponse{}, newOAuthError("unauthorized_client", "The client_credentials grant requires a confidential client")
+	}
+
+	// RFC 6749 Section 3.3: without a scope parameter, all the scopes allowed to the client are granted
+	scopes := client.ClientCredentialsScopes
+	if scope := req.FormValue("scope"); scope != "" {
+		scopes = strings.Fields(scope)
+		for _, s := range scopes {
+			if !slices.Contains(client.ClientCredentialsScopes, s) {
+				slog.WarnContext(ctx, "Scope not allowed for client_credentials", "client_id", clientID, "scope", s)
+				return tokenResponse{}, newOAuthError("invalid_scope", "The scope '"+s+"' is not allowed for this client")
+			}
+		}
+	}
+
+	audience := jwt.ClaimStrings{client.DefaultResourceIndicator}
+	if resources := req.Form["resource"]; len(resources) > 0 {
+		if err := validateResources(client, resources); err != nil {
+			slog.WarnContext(ctx, "Invalid resource", "client_id", clientID, "resource", resources)
+			return tokenResponse{}, err
+		}
+		audience = resources
+	}
+	if audience[0] == "" {
+		slog.WarnContext(ctx, "No audience for client_credentials", "client_id", clientID)
+		return tokenResponse{}, newOAuthError("invalid_target", "resource is required")
+	}
+
+	claims := jwt.MapClaims{
+		"aud":       audienceClaim(audience),
+		"sub":       clientID,
+		"client_id": clientID,
+		"scope":     strings.Join(scopes, " "),
+	}
+	tokenType := bindToDPoPKey(claims, jkt)
+	accessToken, err := a.createAccessToken(ctx, claims)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to create access token", "client_id", clientID, "error", err)
+		return tokenResponse{}, err
+	}
+
+	slog.InfoContext(ctx, "Client credentials access token issued", "client_id", clientID, "aud", audience, "scope", scopes)
+	return tokenResponse{
+		AccessToken: accessToken,
+		TokenType:   tokenType,
+		ExpiresIn:   int(accessTokenTTL.Seconds()),
+		Scope:       strings.Join(scopes, " "),
+	}, nil
+}
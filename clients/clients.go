@@ -0,0 +1,50 @@
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Data represents a registered OAuth client, configured from the environment or registered dynamically.
+type Data struct {
+	ClientID                    string
+	Type                        string
+	Name                        string
+	SecretHash                  []byte
+	JWKS                        json.RawMessage
+	JWKSURI                     string
+	TokenEndpointAuthMethod     string
+	GrantTypes                  []string
+	RedirectURIs                []string
+	PostLogoutRedirectURIs      []string
+	RevokeRefreshTokensOnLogout bool
+	DefaultResourceIndicator    string
+	Resources                   []string
+	ClientCredentialsScopes     []string
+	TokenExchangeAudiences      []string
+	RequirePAR                  bool
+	FirstParty                  bool
+	SubjectType                 string
+	SectorIdentifier            string
+	LoginPage                   LoginPage
+	RegistrationTokenHash       string    // Hash of the registration access token, only for dynamically registered clients
+	IssuedAt                    time.Time // Time of the dynamic registration
+}
+
+// LoginPage holds the labels of the login page shown to the users of the client.
+type LoginPage struct {
+	Title       string
+	Email       string
+	Password    string
+	Submit      string
+	ConnectWith string
+	LoggedOut   string
+}
+
+// Store defines client persistence operations.
+type Store interface {
+	Put(ctx context.Context, data Data) error
+	Get(ctx context.Context, clientID string) (*Data, error)
+	Delete(ctx context.Context, clientID string) error
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/simonhege/nestor/account"
+	"github.com/simonhege/nestor/consent"
+	"github.com/simonhege/nestor/csrf"
+	"github.com/simonhege/nestor/signed"
+)
+
+// Descriptions of the scopes shown on the consent page, other scopes are shown by name.
+var scopeDescriptions = map[string]string{
+	"openid":         "Vous identifier",
+	"profile":        "Voir votre nom et votre photo",
+	"email":          "Voir votre adresse email",
+	"roles":          "Voir vos rôles",
+	"offline_access": "Garder l'accès lorsque vous n'êtes pas connecté",
+}
+
+// Descriptions of the claims requested individually with the claims parameter.
+var claimDescriptions = map[string]string{
+	"email":          "Voir votre adresse email",
+	"email_verified": "Savoir si votre adresse email est vérifiée",
+	"name":           "Voir votre nom",
+	"picture":        "Voir votre photo",
+	"roles":          "Voir vos rôles",
+}
+
+// consentItem is a scope or a claim listed on the consent page.
+type consentItem struct {
+	Name        string
+	Description string
+}
+
+// requestedGrant returns the scopes and the claims requested by the authorization request.
+func (p oAuthParams) requestedGrant() (scopes, claims []string) {
+	claims = slices.Concat(p.UserInfoClaims, p.IDTokenClaims)
+	slices.Sort(claims)
+	return strings.Fields(p.Scope), slices.Compact(claims)
+}
+
+// unapprovedGrant returns the requested scopes and claims the account has not approved for the client yet.
+// First-party clients need no consent, unless the client explicitly asks for it with prompt=consent.
+func (a *app) unapprovedGrant(ctx context.Context, client *client, accountID string, oauthParams oAuthParams) (scopes, claims []string, err error) {
+	scopes, claims = oauthParams.requestedGrant()
+	if slices.Contains(strings.Fields(oauthParams.Prompt), "consent") {
+		return scopes, claims, nil
+	}
+	if client.FirstParty {
+		return nil, nil, nil
+	}
+
+	data, err := a.consentStore.Get(ctx, accountID, client.ClientID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if data == nil {
+		return scopes, claims, nil
+	}
+	return notIn(scopes, data.Scopes), notIn(claims, data.Claims), nil
+}
+
+// notIn returns the values that approved does not contain.
+func notIn(values, approved []string) []string {
+	var missing []string
+	for _, value := range values {
+		if !slices.Contains(approved, value) {
+			missing = append(missing, value)
+		}
+	}
+	return missing
+}
+
+// showConsentPage asks the end-user to approve the scopes and the claims the client requests.
+func (a *app) showConsentPage(ctx context.Context, w http.ResponseWriter, oauthParams oAuthParams, client *client, scopes, claims []string) {
+	csrfToken := csrf.NewToken()
+
+	signed.SetCookie(ctx, w, "oauth_params", oauthParams)
+	csrf.SetCookie(w, csrfToken)
+
+	toApprove := make([]consentItem, 0, len(scopes)+len(claims))
+	for _, scope := range scopes {
+		toApprove = append(toApprove, consentItem{Name: scope, Description: scopeDescriptions[scope]})
+	}
+	for _, claim := range claims {
+		toApprove = append(toApprove, consentItem{Name: claim, Description: claimDescriptions[claim]})
+	}
+	err := executeTemplate(w, "consent.tmpl", map[string]any{
+		"CSRFToken":  csrfToken,
+		"ClientName": cmp.Or(client.Name, client.ClientID),
+		"Items":      toApprove,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to render consent template", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (a *app) handlePostConsent(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	// Validate against CSRF attacks
+	if !csrf.ValidateToken(req) {
+		slog.WarnContext(ctx, "CSRF token validation failed")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Get OAuth parameters from the cookie
+	var oauthParams oAuthParams
+	if err := signed.ReadCookie(req, "oauth_params", &oauthParams); err != nil {
+		slog.WarnContext(ctx, "Failed to decode OAuth params", "error", err)
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	// The end-user authenticated before the consent page was shown
+	sess, acc, err := a.sessionAccount(ctx, req, oAuthParams{MaxAge: -1})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get session", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if sess == nil {
+		slog.WarnContext(ctx, "Consent without a session", "client_id", oauthParams.ClientID)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	csrf.DeleteCookie(w)
+
+	if req.FormValue("action") != "approve" {
+		slog.InfoContext(ctx, "Consent denied", "client_id", oauthParams.ClientID, "account_id", acc.ID)
+		redirectError(ctx, w, req, oauthParams, "access_denied", "The end-user denied the authorization request")
+		return
+	}
+
+	if err := a.approveGrant(ctx, acc, oauthParams); err != nil {
+		slog.ErrorContext(ctx, "Failed to save consent", "client_id", oauthParams.ClientID, "account_id", acc.ID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(ctx, "Consent granted", "client_id", oauthParams.ClientID, "account_id", acc.ID, "scope", oauthParams.Scope)
+
+	a.sendAuthorizationCode(ctx, w, req, oauthParams, acc, sess.AuthTime)
+}
+
+// approveGrant adds the requested scopes and claims to the ones the account already approved for the client.
+func (a *app) approveGrant(ctx context.Context, acc *account.Account, oauthParams oAuthParams) error {
+	data, err := a.consentStore.Get(ctx, acc.ID, oauthParams.ClientID)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		data = &consent.Data{AccountID: acc.ID, ClientID: oauthParams.ClientID}
+	}
+	scopes, claims := oauthParams.requestedGrant()
+	data.Scopes = append(data.Scopes, notIn(scopes, data.Scopes)...)
+	data.Claims = append(data.Claims, notIn(claims, data.Claims)...)
+	data.UpdatedAt = time.Now()
+	return a.consentStore.Put(ctx, *data)
+}
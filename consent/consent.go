@@ -0,0 +1,22 @@
+package consent
+
+import (
+	"context"
+	"time"
+)
+
+// Data records the scopes and the claims an account approved for a client.
+type Data struct {
+	AccountID string
+	ClientID  string
+	Scopes    []string
+	Claims    []string // Claims approved individually, when the client requested them with the claims parameter
+	UpdatedAt time.Time
+}
+
+// Store defines consent persistence operations.
+type Store interface {
+	Put(ctx context.Context, data Data) error
+	Get(ctx context.Context, accountID, clientID string) (*Data, error)
+	DeleteByAccount(ctx context.Context, accountID string) error
+}
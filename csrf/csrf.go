@@ -23,6 +23,19 @@ func SetCookie(w http.ResponseWriter, token string) {
 	http.SetCookie(w, cookie)
 }
 
+func DeleteCookie(w http.ResponseWriter) {
+	cookie := &http.Cookie{
+		Name:     "csrf_token",
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+		Expires:  time.Unix(0, 0), // Set expiration to the past
+		MaxAge:   -1,              // Also set MaxAge to -1 to delete
+	}
+	http.SetCookie(w, cookie)
+}
+
 func ValidateToken(r *http.Request) bool {
 	formToken := r.FormValue("csrf_token")
 	cookie, err := r.Cookie("csrf_token")
@@ -0,0 +1,44 @@
+package device
+
+import (
+	"context"
+	"time"
+)
+
+// Status is the state of a device authorization request.
+type Status string
+
+const (
+	StatusPending  Status = "pending"  // The end-user has not entered the user code yet
+	StatusApproved Status = "approved" // The end-user approved the request, tokens may be issued
+	StatusDenied   Status = "denied"   // The end-user denied the request
+)
+
+// Data represents a device authorization request (RFC 8628 Section 3.1).
+type Data struct {
+	DeviceCodeHash string
+	UserCode       string
+	ClientID       string
+	Scopes         []string
+	Status         Status
+	AccountID      string    // Account that approved the request
+	AuthTime       time.Time // Time of the end-user authentication that approved the request
+	Interval       int       // Minimum polling interval in seconds
+	LastPolledAt   time.Time
+	CreatedAt      time.Time
+	ExpiresAt      time.Time
+}
+
+// Store defines device authorization request persistence operations.
+type Store interface {
+	Put(ctx context.Context, data Data) error
+	Get(ctx context.Context, deviceCodeHash string) (*Data, error)
+	GetByUserCode(ctx context.Context, userCode string) (*Data, error)
+	Delete(ctx context.Context, deviceCodeHash string) error
+	// RecordPoll atomically sets the time of the last poll and the polling interval of a pending request,
+	// without overwriting a concurrent approval or denial. It returns false when the request is unknown or not pending anymore.
+	RecordPoll(ctx context.Context, deviceCodeHash string, polledAt time.Time, interval int) (bool, error)
+	// Consume atomically removes an approved request and returns it, so that its device code is redeemed only once.
+	// It returns nil when the request is unknown, not approved or already consumed.
+	Consume(ctx context.Context, deviceCodeHash string) (*Data, error)
+}
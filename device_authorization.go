@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/simonhege/nestor/account"
+	"github.com/simonhege/nestor/csrf"
+	"github.com/simonhege/nestor/device"
+	"github.com/simonhege/server"
+)
+
+const (
+	deviceCodeGrantType   = "urn:ietf:params:oauth:grant-type:device_code"
+	deviceCodeTTL         = 10 * time.Minute
+	devicePollingInterval = 5 // Seconds, also the increment of the interval on slow_down
+)
+
+// userCodeAlphabet has no vowels to avoid forming words, and no ambiguous characters (RFC 8628 Section 6.1).
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+type deviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// handleDeviceAuthorization implements the device authorization endpoint (RFC 8628 Section 3.1).
+func (a *app) handleDeviceAuthorization(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	client, err := a.authenticateClient(req)
+	if err != nil {
+		var oauthErr *oauthError
+		if errors.As(err, &oauthErr) {
+			writeOAuthError(w, req, oauthErr)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if !client.allowsGrantType(deviceCodeGrantType) {
+		slog.WarnContext(ctx, "Grant type not allowed for the client", "client_id", client.ClientID, "grant_type", deviceCodeGrantType)
+		writeOAuthError(w, req, newOAuthError("unauthorized_client", "The client is not allowed to use the device authorization grant"))
+		return
+	}
+	scopes := strings.Fields(req.FormValue("scope"))
+	for _, scope := range scopes {
+		if !slices.Contains(a.oidcConfig.ScopesSupported, scope) {
+			slog.WarnContext(ctx, "Unknown scope", "client_id", client.ClientID, "scope", scope)
+			writeOAuthError(w, req, newOAuthError("invalid_scope", "The scope '"+scope+"' is not supported"))
+			return
+		}
+	}
+
+	userCode, err := a.newUserCode(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to generate user code", "client_id", client.ClientID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	deviceCode := rand.Text()
+	tNow := time.Now()
+	data := device.Data{
+		DeviceCodeHash: hashToken(deviceCode),
+		UserCode:       userCode,
+		ClientID:       client.ClientID,
+		Scopes:         scopes,
+		Status:         device.StatusPending,
+		Interval:       devicePollingInterval,
+		CreatedAt:      tNow,
+		ExpiresAt:      tNow.Add(deviceCodeTTL),
+	}
+	if err := a.deviceStore.Put(ctx, data); err != nil {
+		slog.ErrorContext(ctx, "Failed to save device authorization", "client_id", client.ClientID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(ctx, "Device authorization started", "client_id", client.ClientID)
+	verificationURI := a.baseURL + "/device"
+	w.Header().Set("Cache-Control", "no-store")
+	server.RenderJSON(w, deviceAuthorizationResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                formatUserCode(userCode),
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?" + url.Values{"user_code": {formatUserCode(userCode)}}.Encode(),
+		ExpiresIn:               int(deviceCodeTTL.Seconds()),
+		Interval:                devicePollingInterval,
+	})
+}
+
+// newUserCode returns an unused user code of 8 characters of userCodeAlphabet.
+func (a *app) newUserCode(ctx context.Context) (string, error) {
+	for {
+		code := make([]byte, 0, 8)
+		var b [1]byte
+		for len(code) < cap(code) {
+			if _, err := rand.Read(b[:]); err != nil {
+				return "", err
+			}
+			// Bytes above the largest multiple of the alphabet size would bias the distribution
+			if int(b[0]) < 256-256%len(userCodeAlphabet) {
+				code = append(code, userCodeAlphabet[int(b[0])%len(userCodeAlphabet)])
+			}
+		}
+
+		existing, err := a.deviceStore.GetByUserCode(ctx, string(code))
+		if err != nil {
+			return "", err
+		}
+		if existing == nil {
+			return string(code), nil
+		}
+	}
+}
+
+// formatUserCode splits a user code in two groups to be easier to read and type, e.g. "WDJB-MJHT".
+func formatUserCode(userCode string) string {
+	return userCode[:4] + "-" + userCode[4:]
+}
+
+// normalizeUserCode reverts formatUserCode and the variations of what the end-user typed.
+func normalizeUserCode(input string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(input))
+}
+
+// handleDevice renders the verification page, where the end-user enters the user code displayed by the device.
+func (a *app) handleDevice(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	_, acc, err := a.sessionAccount(ctx, req, oAuthParams{MaxAge: -1})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get session", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	data := map[string]any{
+		"SignedIn": acc != nil,
+	}
+
+	if userCode := normalizeUserCode(req.URL.Query().Get("user_code")); userCode != "" {
+		deviceData, err := a.pendingDeviceAuthorization(ctx, userCode)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get device authorization", "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if deviceData == nil {
+			data["Error"] = "Code invalide ou expiré"
+		} else {
+			// The end-user confirms the client and the scopes before approving
+			csrfToken := csrf.NewToken()
+			csrf.SetCookie(w, csrfToken)
+			data["CSRFToken"] = csrfToken
+			data["UserCode"] = formatUserCode(userCode)
+			data["ClientID"] = deviceData.ClientID
+			data["Scopes"] = deviceData.Scopes
+		}
+	}
+
+	if err := executeTemplate(w, "device.tmpl", data); err != nil {
+		slog.ErrorContext(ctx, "Failed to render device template", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+// handlePostDevice approves or denies a device authorization request on behalf of the signed-in end-user,
+// who may sign in with email and password on the same form.
+func (a *app) handlePostDevice(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if !csrf.ValidateToken(req) {
+		slog.WarnContext(ctx, "CSRF token validation failed")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	userCode := normalizeUserCode(req.FormValue("user_code"))
+	deviceData, err := a.pendingDeviceAuthorization(ctx, userCode)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get device authorization", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if deviceData == nil {
+		slog.WarnContext(ctx, "Unknown or expired user code")
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	// Denying does not require to sign in, the device simply gets no tokens
+	message := "La demande a été refusée"
+	deviceData.Status = device.StatusDenied
+	var accountID string
+	if req.FormValue("action") == "approve" {
+		acc, authTime, ok := a.deviceApprover(ctx, w, req)
+		if !ok {
+			return
+		}
+		message = "L'appareil est connecté, vous pouvez fermer cette page"
+		deviceData.Status = device.StatusApproved
+		deviceData.AccountID = acc.ID
+		deviceData.AuthTime = authTime
+		accountID = acc.ID
+	}
+	if err := a.deviceStore.Put(ctx, *deviceData); err != nil {
+		slog.ErrorContext(ctx, "Failed to save device authorization", "client_id", deviceData.ClientID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	csrf.DeleteCookie(w)
+	slog.InfoContext(ctx, "Device authorization answered", "client_id", deviceData.ClientID, "account_id", accountID, "status", deviceData.Status)
+
+	if err := executeTemplate(w, "device.tmpl", map[string]any{"Message": message}); err != nil {
+		slog.ErrorContext(ctx, "Failed to render device template", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+// deviceApprover returns the account approving a device authorization request and the time it authenticated,
+// from the session or from the email and password of the form. It answers the request itself when ok is false.
+func (a *app) deviceApprover(ctx context.Context, w http.ResponseWriter, req *http.Request) (acc *account.Account, authTime time.Time, ok bool) {
+	sess, acc, err := a.sessionAccount(ctx, req, oAuthParams{MaxAge: -1})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get session", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, time.Time{}, false
+	}
+	if sess != nil {
+		return acc, sess.AuthTime, true
+	}
+
+	email := req.FormValue("email")
+	acc, err = a.accountStore.GetByEmail(ctx, email)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get account", "email", email, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, time.Time{}, false
+	}
+	if acc == nil || !acc.CheckPassword(req.FormValue("password")) || acc.Status != account.StatusActive {
+		slog.WarnContext(ctx, "Unauthorized device approval", "email", email)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, time.Time{}, false
+	}
+	newSession, err := a.startSession(ctx, w, acc.ID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to start session", "account_id", acc.ID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, time.Time{}, false
+	}
+	return acc, newSession.AuthTime, true
+}
+
+// pendingDeviceAuthorization returns the device authorization request of userCode, or nil if it was already answered or expired.
+func (a *app) pendingDeviceAuthorization(ctx context.Context, userCode string) (*device.Data, error) {
+	if userCode == "" {
+		return nil, nil
+	}
+	data, err := a.deviceStore.GetByUserCode(ctx, userCode)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	if data.Status != device.StatusPending || time.Now().After(data.ExpiresAt) {
+		return nil, nil
+	}
+	return data, nil
+}
+
+// handleDeviceCodeGrant exchanges an approved device code for tokens (RFC 8628 Section 3.4).
+func (a *app) handleDeviceCodeGrant(ctx context.Context, client *client, req *http.Request, jkt string) (tokenResponse, error) {
+	clientID := client.ClientID
+	deviceCode := req.FormValue("device_code")
+	if deviceCode == "" {
+		slog.WarnContext(ctx, "Missing device_code", "client_id", clientID)
+		return tokenResponse{}, newOAuthError("invalid_request", "device_code is required")
+	}
+
+	deviceCodeHash := hashToken(deviceCode)
+	data, err := a.deviceStore.Get(ctx, deviceCodeHash)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to retrieve device authorization", "client_id", clientID, "error", err)
+		return tokenResponse{}, err
+	}
+	if data == nil {
+		slog.WarnContext(ctx, "Unknown device code", "client_id", clientID)
+		return tokenResponse{}, newOAuthError("invalid_grant", "Unknown device_code")
+	}
+	if data.ClientID != clientID {
+		slog.WarnContext(ctx, "Device code client mismatch", "client_id", clientID, "stored_client_id", data.ClientID)
+		return tokenResponse{}, newOAuthError("invalid_grant", "The device_code was issued to another client")
+	}
+
+	tNow := time.Now()
+	if tNow.After(data.ExpiresAt) {
+		slog.InfoContext(ctx, "Device code expired", "client_id", clientID)
+		return tokenResponse{}, newOAuthError("expired_token", "The device_code expired")
+	}
+
+	switch data.Status {
+	case device.StatusDenied:
+		if err := a.deviceStore.Delete(ctx, deviceCodeHash); err != nil {
+			slog.ErrorContext(ctx, "Failed to delete device authorization", "client_id", clientID, "error", err)
+			return tokenResponse{}, err
+		}
+		return tokenResponse{}, newOAuthError("access_denied", "The end-user denied the authorization request")
+	case device.StatusPending:
+		// RFC 8628 Section 3.5: a client polling too fast must wait 5 more seconds for this and all subsequent requests
+		oauthErr := newOAuthError("authorization_pending", "The end-user has not approved the request yet")
+		interval := data.Interval
+		if tNow.Sub(data.LastPolledAt) < time.Duration(interval)*time.Second {
+			interval += devicePollingInterval
+			oauthErr = newOAuthError("slow_down", "Polling too frequently")
+		}
+		// Only the polling state is written, an approval made since the request was read is kept for the next poll
+		if _, err := a.deviceStore.RecordPoll(ctx, deviceCodeHash, tNow, interval); err != nil {
+			slog.ErrorContext(ctx, "Failed to save device authorization", "client_id", clientID, "error", err)
+			return tokenResponse{}, err
+		}
+		return tokenResponse{}, oauthErr
+	}
+
+	// The device code is consumed before the tokens are issued, so that concurrent requests cannot both redeem it
+	approved, err := a.deviceStore.Consume(ctx, deviceCodeHash)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to consume device authorization", "client_id", clientID, "error", err)
+		return tokenResponse{}, err
+	}
+	if approved == nil {
+		slog.WarnContext(ctx, "Device code already used", "client_id", clientID)
+		return tokenResponse{}, newOAuthError("invalid_grant", "The device_code was already used")
+	}
+
+	return a.issueTokens(ctx, grant{
+		ClientID:      clientID,
+		AccountID:     approved.AccountID,
+		GrantedScopes: approved.Scopes,
+		AuthTime:      approved.AuthTime,
+		JKT:           jkt,
+	})
+}
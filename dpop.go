@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/MicahParks/jwkset"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	dpopProofType = "dpop+jwt"
+	// dpopProofWindow bounds the difference between the iat of a proof and the current time
+	dpopProofWindow = time.Minute
+)
+
+// verifyDPoPProof verifies the DPoP proof of req (RFC 9449 Section 4.3), and returns the JWK thumbprint of its key.
+// accessToken is the token presented with the proof to a protected endpoint, empty at the token endpoint.
+func (a *app) verifyDPoPProof(req *http.Request, accessToken string) (string, error) {
+	ctx := req.Context()
+
+	proofs := req.Header.Values("DPoP")
+	if len(proofs) != 1 {
+		return "", newOAuthError("invalid_dpop_proof", "Exactly one DPoP proof is required")
+	}
+
+	// The proof is signed by the key it carries in its header, the thumbprint of that key is what tokens are bound to
+	var jkt string
+	token, err := jwt.Parse(proofs[0], func(token *jwt.Token) (any, error) {
+		if typ, _ := token.Header["typ"].(string); typ != dpopProofType {
+			return nil, errors.New("the proof type must be " + dpopProofType)
+		}
+		raw, err := json.Marshal(token.Header["jwk"])
+		if err != nil {
+			return nil, err
+		}
+		var marshal jwkset.JWKMarshal
+		if err := json.Unmarshal(raw, &marshal); err != nil {
+			return nil, err
+		}
+		if marshal.D != "" || marshal.K != "" {
+			return nil, errors.New("the proof key must be a public key")
+		}
+		jwk, err := jwkset.NewJWKFromMarshal(marshal, jwkset.JWKMarshalOptions{}, jwkset.JWKValidateOptions{})
+		if err != nil {
+			return nil, err
+		}
+		jkt, err = jwkThumbprint(marshal)
+		if err != nil {
+			return nil, err
+		}
+		return jwk.Key(), nil
+	}, jwt.WithValidMethods(supportedClientSigningAlgs))
+	if err != nil {
+		slog.WarnContext(ctx, "Invalid DPoP proof", "error", err)
+		return "", wrapOAuthError("invalid_dpop_proof", "Invalid DPoP proof", err)
+	}
+	claims := token.Claims.(jwt.MapClaims)
+
+	if htm, _ := claims["htm"].(string); htm != req.Method {
+		slog.WarnContext(ctx, "DPoP proof method mismatch", "htm", htm, "method", req.Method)
+		return "", newOAuthError("invalid_dpop_proof", "The DPoP proof was created for another method")
+	}
+	// RFC 9449 Section 4.3: the query and fragment of the URI are ignored
+	htu, _ := claims["htu"].(string)
+	if u, err := url.Parse(htu); err != nil || htu == "" || u.Scheme+"://"+u.Host+u.Path != a.baseURL+req.URL.Path {
+		slog.WarnContext(ctx, "DPoP proof URI mismatch", "htu", htu, "path", req.URL.Path)
+		return "", newOAuthError("invalid_dpop_proof", "The DPoP proof was created for another URI")
+	}
+	iat, err := claims.GetIssuedAt()
+	if err != nil || iat == nil || time.Since(iat.Time).Abs() > dpopProofWindow {
+		slog.WarnContext(ctx, "DPoP proof not fresh", "iat", iat)
+		return "", newOAuthError("invalid_dpop_proof", "The DPoP proof is not fresh")
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		if ath, _ := claims["ath"].(string); ath != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			slog.WarnContext(ctx, "DPoP proof access token hash mismatch")
+			return "", newOAuthError("invalid_dpop_proof", "The DPoP proof was created for another access token")
+		}
+	}
+
+	// Each proof is used once, it is remembered for as long as it would be fresh
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return "", newOAuthError("invalid_dpop_proof", "The DPoP proof has no jti")
+	}
+	unused, err := a.replayStore.Use(ctx, "dpop:"+jkt+":"+jti, iat.Add(dpopProofWindow))
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to record DPoP proof", "error", err)
+		return "", err
+	}
+	if !unused {
+		slog.WarnContext(ctx, "DPoP proof replayed", "jkt", jkt, "jti", jti)
+		return "", newOAuthError("invalid_dpop_proof", "The DPoP proof was already used")
+	}
+
+	return jkt, nil
+}
+
+// jwkThumbprint returns the SHA-256 thumbprint of a public key (RFC 7638), computed over its required members.
+func jwkThumbprint(marshal jwkset.JWKMarshal) (string, error) {
+	var members map[string]string
+	switch marshal.KTY {
+	case jwkset.KtyEC:
+		members = map[string]string{"crv": string(marshal.CRV), "kty": string(marshal.KTY), "x": marshal.X, "y": marshal.Y}
+	case jwkset.KtyOKP:
+		members = map[string]string{"crv": string(marshal.CRV), "kty": string(marshal.KTY), "x": marshal.X}
+	case jwkset.KtyRSA:
+		members = map[string]string{"e": marshal.E, "kty": string(marshal.KTY), "n": marshal.N}
+	default:
+		return "", errors.New("unsupported key type " + string(marshal.KTY))
+	}
+	// Maps are marshaled with sorted keys and no whitespace, as RFC 7638 Section 3 requires
+	raw, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// writeDPoPError writes the RFC 9449 Section 7.1 response to a request with an invalid DPoP proof.
+func writeDPoPError(w http.ResponseWriter, description string) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`DPoP algs=%q, error="invalid_dpop_proof", error_description=%q`, strings.Join(supportedClientSigningAlgs, " "), description))
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+// bindToDPoPKey adds the confirmation claim of RFC 9449 Section 6.1 to the claims of an access token,
+// and returns the matching token_type.
+func bindToDPoPKey(claims jwt.MapClaims, jkt string) string {
+	if jkt == "" {
+		return "Bearer"
+	}
+	claims["cnf"] = map[string]string{"jkt": jkt}
+	return "DPoP"
+}
+
+// dpopKeyThumbprint returns the thumbprint of the DPoP key an access token is bound to, if any.
+func dpopKeyThumbprint(token *jwt.Token) string {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return ""
+	}
+	return boundDPoPKey(claims)
+}
+
+// boundDPoPKey returns the thumbprint of the DPoP key in the confirmation claim of an access token, if any.
+func boundDPoPKey(claims jwt.MapClaims) string {
+	confirmation, _ := claims["cnf"].(map[string]any)
+	jkt, _ := confirmation["jkt"].(string)
+	return jkt
+}
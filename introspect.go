@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/simonhege/nestor/account"
+	"github.com/simonhege/server"
+)
+
+// introspectionResponse is the RFC 7662 Section 2.2 response.
+type introspectionResponse struct {
+	Active    bool     `json:"active"`
+	Scope     string   `json:"scope,omitempty"`
+	ClientID  string   `json:"client_id,omitempty"`
+	Sub       string   `json:"sub,omitempty"`
+	Exp       int64    `json:"exp,omitempty"`
+	Aud       []string `json:"aud,omitempty"`
+	TokenType string   `json:"token_type,omitempty"`
+	Cnf       *cnf     `json:"cnf,omitempty"` // DPoP key of a bound access token (RFC 9449 Section 6.2)
+}
+
+// cnf is the confirmation claim of a token bound to a key.
+type cnf struct {
+	JKT string `json:"jkt"`
+}
+
+// handleIntrospect implements OAuth 2.0 Token Introspection (RFC 7662).
+func (a *app) handleIntrospect(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	caller, err := a.authenticateClient(req)
+	if err != nil {
+		var oauthErr *oauthError
+		if errors.As(err, &oauthErr) {
+			writeOAuthError(w, req, oauthErr)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !caller.isConfidential() {
+		slog.WarnContext(ctx, "Public client cannot introspect tokens", "client_id", caller.ClientID)
+		writeOAuthError(w, req, newOAuthError("invalid_client", "Token introspection requires client authentication"))
+		return
+	}
+
+	token := req.FormValue("token")
+	if token == "" {
+		slog.WarnContext(ctx, "Missing token in introspection request", "client_id", caller.ClientID)
+		writeOAuthError(w, req, newOAuthError("invalid_request", "token is required"))
+		return
+	}
+
+	// Access tokens are JWTs and refresh tokens are opaque, so the token_type_hint is not needed
+	resp, err := a.introspectAccessToken(ctx, token)
+	if err == nil && !resp.Active {
+		resp, err = a.introspectRefreshToken(ctx, token)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Token introspection failed", "client_id", caller.ClientID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	server.RenderJSON(w, resp)
+}
+
+func (a *app) introspectAccessToken(ctx context.Context, token string) (introspectionResponse, error) {
+	jwtToken, err := a.parseToken(ctx, token)
+	if err != nil {
+		return introspectionResponse{}, nil
+	}
+	claims, ok := jwtToken.Claims.(jwt.MapClaims)
+	if !ok || !isAccessToken(jwtToken) {
+		return introspectionResponse{}, nil
+	}
+
+	sub, _ := claims.GetSubject()
+	clientID, _ := claims["client_id"].(string)
+	active, err := a.isSubjectActive(ctx, sub)
+	if err != nil || !active {
+		return introspectionResponse{}, err
+	}
+
+	resp := introspectionResponse{
+		Active:    true,
+		Sub:       sub,
+		ClientID:  clientID,
+		TokenType: "Bearer",
+	}
+	if jkt := dpopKeyThumbprint(jwtToken); jkt != "" {
+		resp.TokenType = "DPoP"
+		resp.Cnf = &cnf{JKT: jkt}
+	}
+	resp.Scope, _ = claims["scope"].(string)
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		resp.Exp = exp.Unix()
+	}
+	if aud, err := claims.GetAudience(); err == nil {
+		resp.Aud = aud
+	}
+	return resp, nil
+}
+
+func (a *app) introspectRefreshToken(ctx context.Context, token string) (introspectionResponse, error) {
+	data, err := a.refreshStore.Get(ctx, hashToken(token))
+	if err != nil {
+		return introspectionResponse{}, err
+	}
+	if data == nil || data.Consumed || time.Now().After(data.ExpiresAt) {
+		return introspectionResponse{}, nil
+	}
+
+	active, err := a.isAccountActive(ctx, data.AccountID)
+	if err != nil || !active {
+		return introspectionResponse{}, err
+	}
+
+	client, err := a.getClient(ctx, data.ClientID)
+	if err != nil {
+		return introspectionResponse{}, err
+	}
+	sub, err := a.subjectFor(ctx, client, data.AccountID)
+	if err != nil {
+		return introspectionResponse{}, err
+	}
+
+	return introspectionResponse{
+		Active:    true,
+		Scope:     strings.Join(data.GrantedScopes, " "),
+		ClientID:  data.ClientID,
+		Sub:       sub,
+		Exp:       data.ExpiresAt.Unix(),
+		TokenType: "refresh_token",
+	}, nil
+}
+
+// isSubjectActive reports whether the subject of an access token is still active,
+// the subject is a client for the tokens it got for itself with the client_credentials grant,
+// and an account otherwise, possibly identified by a pairwise subject.
+func (a *app) isSubjectActive(ctx context.Context, sub string) (bool, error) {
+	if sub == "" {
+		return false, nil
+	}
+	client, err := a.getClient(ctx, sub)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to retrieve client", "client_id", sub, "error", err)
+		return false, err
+	}
+	if client != nil {
+		return true, nil
+	}
+	accountID, err := a.accountIDForSubject(ctx, sub)
+	if err != nil {
+		return false, err
+	}
+	return a.isAccountActive(ctx, accountID)
+}
+
+// isAccountActive reports whether the account exists and has the active status.
+func (a *app) isAccountActive(ctx context.Context, accountID string) (bool, error) {
+	if accountID == "" {
+		return false, nil
+	}
+	acc, err := a.accountStore.GetById(ctx, accountID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to retrieve account", "account_id", accountID, "error", err)
+		return false, err
+	}
+	return acc != nil && acc.Status == account.StatusActive, nil
+}
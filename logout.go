@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/simonhege/nestor/csrf"
+	"github.com/simonhege/nestor/signed"
+)
+
+// handleLogout implements OpenID Connect RP-Initiated Logout 1.0.
+func (a *app) handleLogout(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	idTokenHint := req.FormValue("id_token_hint")
+	clientID := req.FormValue("client_id")
+	postLogoutRedirectURI := req.FormValue("post_logout_redirect_uri")
+	state := req.FormValue("state")
+
+	// The ID token may have expired already, only its signature is verified
+	var hintAccountID string
+	if idTokenHint != "" {
+		token, err := a.parseToken(ctx, idTokenHint, jwt.WithoutClaimsValidation())
+		if err != nil {
+			slog.WarnContext(ctx, "Invalid id_token_hint", "client_id", clientID, "error", err)
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		// An access token is signed with the same key, but it was not issued to the client
+		if isAccessToken(token) {
+			slog.WarnContext(ctx, "id_token_hint is an access token", "client_id", clientID)
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		aud, _ := token.Claims.GetAudience()
+		if clientID == "" && len(aud) == 1 {
+			clientID = aud[0]
+		}
+		if !slices.Contains(aud, clientID) {
+			slog.WarnContext(ctx, "id_token_hint audience mismatch", "client_id", clientID, "aud", aud)
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		sub, _ := token.Claims.GetSubject()
+		hintAccountID, err = a.accountIDForSubject(ctx, sub)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	client, err := a.getClient(ctx, clientID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get client", "client_id", clientID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	// The audience of an ID token is a client
+	if idTokenHint != "" && client == nil {
+		slog.WarnContext(ctx, "id_token_hint issued to an unknown client", "client_id", clientID)
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	if postLogoutRedirectURI != "" {
+		if client == nil {
+			slog.WarnContext(ctx, "post_logout_redirect_uri requires a known client", "client_id", clientID)
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if !slices.Contains(client.PostLogoutRedirectURIs, postLogoutRedirectURI) {
+			slog.WarnContext(ctx, "Invalid post logout redirect URI", "client_id", clientID, "post_logout_redirect_uri", postLogoutRedirectURI)
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	sess, err := a.currentSession(ctx, req)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get session", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Any site can send the end-user here, the logout is only done straight away for an id_token_hint of the
+	// account of the session. Otherwise the end-user confirms it with a form protected against CSRF.
+	hinted := hintAccountID != "" && (sess == nil || sess.AccountID == hintAccountID)
+	confirmed := req.Method == http.MethodPost && req.FormValue("csrf_token") != "" && csrf.ValidateToken(req)
+	if !hinted && !confirmed {
+		a.showLogoutConfirmation(ctx, w, client, clientID, postLogoutRedirectURI, state)
+		return
+	}
+
+	accountID := hintAccountID
+	if accountID == "" && sess != nil {
+		accountID = sess.AccountID
+	}
+
+	if err := a.endSession(ctx, w, req); err != nil {
+		slog.ErrorContext(ctx, "Failed to end session", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	signed.DeleteCrossSiteCookie(w, "oauth_params")
+	signed.DeleteCrossSiteCookie(w, "connector_state")
+	csrf.DeleteCookie(w)
+
+	if client != nil && client.RevokeRefreshTokensOnLogout && accountID != "" {
+		if err := a.refreshStore.DeleteByClientAndAccount(ctx, client.ClientID, accountID); err != nil {
+			slog.ErrorContext(ctx, "Failed to revoke refresh tokens on logout", "client_id", client.ClientID, "account_id", accountID, "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	slog.InfoContext(ctx, "Logged out", "client_id", clientID, "account_id", accountID)
+
+	if postLogoutRedirectURI != "" {
+		redirectURL, err := url.Parse(postLogoutRedirectURI)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to parse post logout redirect URI", "post_logout_redirect_uri", postLogoutRedirectURI, "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if state != "" {
+			query := redirectURL.Query()
+			query.Set("state", state)
+			redirectURL.RawQuery = query.Encode()
+		}
+		http.Redirect(w, req, redirectURL.String(), http.StatusFound)
+		return
+	}
+
+	label := defaultLoginPage("").LoggedOut
+	if client != nil && client.LoginPage.LoggedOut != "" {
+		label = client.LoginPage.LoggedOut
+	}
+	err = executeTemplate(w, "logout.tmpl", map[string]any{
+		"LoggedOut": label,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to render logout template", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+// showLogoutConfirmation asks the end-user to confirm a logout request that may come from another site.
+func (a *app) showLogoutConfirmation(ctx context.Context, w http.ResponseWriter, client *client, clientID, postLogoutRedirectURI, state string) {
+	csrfToken := csrf.NewToken()
+	csrf.SetCookie(w, csrfToken)
+
+	label := defaultLoginPage("").LoggedOut
+	if client != nil && client.LoginPage.LoggedOut != "" {
+		label = client.LoginPage.LoggedOut
+	}
+	err := executeTemplate(w, "logout.tmpl", map[string]any{
+		"LoggedOut":             label,
+		"Confirm":               true,
+		"CSRFToken":             csrfToken,
+		"ClientID":              clientID,
+		"PostLogoutRedirectURI": postLogoutRedirectURI,
+		"State":                 state,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to render logout template", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
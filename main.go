@@ -3,20 +3,30 @@ package main
 import (
 	"cmp"
 	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/MicahParks/jwkset"
+	"github.com/MicahParks/keyfunc/v3"
 	"github.com/joho/godotenv"
 	"github.com/simonhege/nestor/account"
 	"github.com/simonhege/nestor/auth"
+	"github.com/simonhege/nestor/clients"
 	"github.com/simonhege/nestor/connector"
+	"github.com/simonhege/nestor/consent"
+	"github.com/simonhege/nestor/device"
+	"github.com/simonhege/nestor/par"
 	"github.com/simonhege/nestor/privatekeys"
 	"github.com/simonhege/nestor/refresh"
+	"github.com/simonhege/nestor/replay"
+	"github.com/simonhege/nestor/session"
 	"github.com/simonhege/nestor/stores/couchbase"
 	"github.com/simonhege/nestor/stores/memory"
+	"github.com/simonhege/nestor/subject"
 	"github.com/simonhege/server"
 )
 
@@ -33,8 +43,15 @@ func main() {
 	}
 
 	var accountStore account.Store
+	var clientStore clients.Store
 	var authStore auth.Store
 	var refreshStore refresh.Store
+	var sessionStore session.Store
+	var deviceStore device.Store
+	var parStore par.Store
+	var replayStore replay.Store
+	var subjectStore subject.Store
+	var consentStore consent.Store
 	var privateKeyStore privatekeys.Store
 	if os.Getenv("COUCHBASE_CONNECTION_STRING") != "" {
 		scope, closeFunc, err := couchbase.Connect()
@@ -53,6 +70,11 @@ func main() {
 			slog.ErrorContext(ctx, "failed to create Couchbase account store", "error", err)
 			return
 		}
+		clientStore, err = couchbase.NewClientStore(scope)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to create Couchbase client store", "error", err)
+			return
+		}
 		authStore, err = couchbase.NewAuthStore(scope)
 		if err != nil {
 			slog.ErrorContext(ctx, "failed to create Couchbase auth store", "error", err)
@@ -65,6 +87,42 @@ func main() {
 			return
 		}
 
+		sessionStore, err = couchbase.NewSessionStore(scope)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to create Couchbase session store", "error", err)
+			return
+		}
+
+		deviceStore, err = couchbase.NewDeviceStore(scope)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to create Couchbase device store", "error", err)
+			return
+		}
+
+		parStore, err = couchbase.NewPARStore(scope)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to create Couchbase pushed authorization request store", "error", err)
+			return
+		}
+
+		replayStore, err = couchbase.NewReplayStore(scope)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to create Couchbase replay store", "error", err)
+			return
+		}
+
+		subjectStore, err = couchbase.NewSubjectStore(scope)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to create Couchbase subject store", "error", err)
+			return
+		}
+
+		consentStore, err = couchbase.NewConsentStore(scope)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to create Couchbase consent store", "error", err)
+			return
+		}
+
 		privateKeyStore, err = couchbase.NewPrivateKeyStore(scope)
 		if err != nil {
 			slog.ErrorContext(ctx, "failed to create Couchbase private key store", "error", err)
@@ -76,12 +134,33 @@ func main() {
 		accountStore = &memory.AccountStore{
 			Data: make(map[string]account.Account),
 		}
+		clientStore = &memory.ClientStore{
+			Data: make(map[string]clients.Data),
+		}
 		authStore = &memory.AuthStore{
 			Data: make(map[string]auth.AuthData),
 		}
 		refreshStore = &memory.RefreshStore{
 			Data: make(map[string]refresh.Data),
 		}
+		sessionStore = &memory.SessionStore{
+			Data: make(map[string]session.Data),
+		}
+		deviceStore = &memory.DeviceStore{
+			Data: make(map[string]device.Data),
+		}
+		parStore = &memory.PARStore{
+			Data: make(map[string]par.Data),
+		}
+		replayStore = &memory.ReplayStore{
+			Data: make(map[string]time.Time),
+		}
+		subjectStore = &memory.SubjectStore{
+			Data: make(map[string]subject.Data),
+		}
+		consentStore = &memory.ConsentStore{
+			Data: make(map[string]consent.Data),
+		}
 		privateKeyStore = &memory.PrivateKeyStore{}
 	}
 
@@ -90,14 +169,29 @@ func main() {
 		baseURL:         baseURL,
 		jwks:            jwkset.NewMemoryStorage(),
 		oidcConfig:      newOpenIDConfiguration(os.Getenv("ISSUER"), baseURL),
-		clients:         make(map[string]client),
+		clientStore:     clientStore,
 		accountStore:    accountStore,
 		authStore:       authStore,
 		refreshStore:    refreshStore,
+		sessionStore:    sessionStore,
+		deviceStore:     deviceStore,
+		parStore:        parStore,
+		replayStore:     replayStore,
+		subjectStore:    subjectStore,
+		consentStore:    consentStore,
 		privateKeyStore: privateKeyStore,
+		pairwiseSecret:  []byte(os.Getenv("NESTOR_PAIRWISE_SECRET")),
 	}
+	a.initialAccessToken = os.Getenv("NESTOR_INITIAL_ACCESS_TOKEN")
 	a.initConnectors()
-	a.initClients(ctx)
+	if err := a.initClients(ctx); err != nil {
+		slog.ErrorContext(ctx, "failed to initialize clients", "error", err)
+		return
+	}
+	if err := a.initResourceAttributes(); err != nil {
+		slog.ErrorContext(ctx, "failed to initialize resource attributes", "error", err)
+		return
+	}
 	if err := a.initKeys(ctx); err != nil {
 		slog.ErrorContext(ctx, "failed to initialize keys", "error", err)
 		return
@@ -109,7 +203,22 @@ func main() {
 	s.HandleFunc("GET /.well-known/jwks.json", a.handleKeys)
 	s.HandleFunc("GET /authorize", a.handleAuthorize)
 	s.HandleFunc("POST /authorize", a.handlePostAuthorize)
+	s.HandleFunc("POST /consent", a.handlePostConsent)
+	s.HandleFunc("POST /par", a.handlePushedAuthorizationRequest)
 	s.HandleFunc("POST /token", a.handleToken)
+	s.HandleFunc("GET /userinfo", a.handleUserInfo)
+	s.HandleFunc("POST /userinfo", a.handleUserInfo)
+	s.HandleFunc("POST /revoke", a.handleRevoke)
+	s.HandleFunc("POST /introspect", a.handleIntrospect)
+	s.HandleFunc("GET /logout", a.handleLogout)
+	s.HandleFunc("POST /logout", a.handleLogout)
+	s.HandleFunc("POST /device_authorization", a.handleDeviceAuthorization)
+	s.HandleFunc("GET /device", a.handleDevice)
+	s.HandleFunc("POST /device", a.handlePostDevice)
+	s.HandleFunc("POST /register", a.handleRegister)
+	s.HandleFunc("GET /register/{client_id}", a.handleGetRegistration)
+	s.HandleFunc("PUT /register/{client_id}", a.handleUpdateRegistration)
+	s.HandleFunc("DELETE /register/{client_id}", a.handleDeleteRegistration)
 
 	// Accounts management endpoints
 	s.HandleFunc("DELETE /accounts/me", a.handleDeleteMyAccount)
@@ -147,21 +256,40 @@ func (a *app) getConnector(connectorID string) *connector.C {
 	return nil
 }
 
-func (a *app) initClients(ctx context.Context) {
+// initClients reads the clients configured in the environment. They are kept in memory only,
+// the client store holds the dynamically registered clients.
+func (a *app) initClients(ctx context.Context) error {
+	a.configuredClients = make(map[string]client)
 	// Legacy configuration for a single client, kept for backward compatibility
+	configured := make(map[string]client)
 	clientID := os.Getenv("NESTOR_CLIENT_ID")
 	if len(clientID) > 0 {
-		a.clients = map[string]client{
+		labels := defaultLoginPage(clientID)
+		configured = map[string]client{
 			clientID: {
-				ClientID:                 clientID,
-				RedirectURIs:             strings.Split(os.Getenv("NESTOR_REDIRECT_URIS"), ","),
-				DefaultResourceIndicator: os.Getenv("NESTOR_DEFAULT_RESOURCE_INDICATOR"),
+				ClientID:                    clientID,
+				Type:                        clientType(getenvOrDefault("NESTOR_CLIENT_TYPE", string(clientTypePublic))),
+				SecretHash:                  []byte(os.Getenv("NESTOR_CLIENT_SECRET_HASH")),
+				JWKS:                        json.RawMessage(os.Getenv("NESTOR_CLIENT_JWKS")),
+				JWKSURI:                     os.Getenv("NESTOR_CLIENT_JWKS_URI"),
+				RedirectURIs:                strings.Split(os.Getenv("NESTOR_REDIRECT_URIS"), ","),
+				PostLogoutRedirectURIs:      strings.Split(os.Getenv("NESTOR_POST_LOGOUT_REDIRECT_URIS"), ","),
+				RevokeRefreshTokensOnLogout: os.Getenv("NESTOR_REVOKE_REFRESH_TOKENS_ON_LOGOUT") == "Y",
+				DefaultResourceIndicator:    os.Getenv("NESTOR_DEFAULT_RESOURCE_INDICATOR"),
+				Resources:                   strings.Fields(os.Getenv("NESTOR_CLIENT_RESOURCES")),
+				ClientCredentialsScopes:     strings.Fields(os.Getenv("NESTOR_CLIENT_CREDENTIALS_SCOPES")),
+				TokenExchangeAudiences:      strings.Fields(os.Getenv("NESTOR_TOKEN_EXCHANGE_AUDIENCES")),
+				RequirePAR:                  os.Getenv("NESTOR_REQUIRE_PAR") == "Y",
+				FirstParty:                  os.Getenv("NESTOR_CLIENT_FIRST_PARTY") == "Y",
+				SubjectType:                 subjectType(getenvOrDefault("NESTOR_CLIENT_SUBJECT_TYPE", string(subjectTypePublic))),
+				SectorIdentifier:            os.Getenv("NESTOR_CLIENT_SECTOR_IDENTIFIER"),
 				LoginPage: loginPage{
-					Title:       getenvOrDefault("NESTOR_LABELS_LOGIN_TITLE", "Se connecter à "+clientID),
-					Email:       getenvOrDefault("NESTOR_LABELS_LOGIN_EMAIL", "Email"),
-					Password:    getenvOrDefault("NESTOR_LABELS_LOGIN_PASSWORD", "Mot de passe"),
-					Submit:      getenvOrDefault("NESTOR_LABELS_LOGIN_SUBMIT", "Se connecter"),
-					ConnectWith: getenvOrDefault("NESTOR_LABELS_LOGIN_CONNECT_WITH", "Se connecter avec"),
+					Title:       getenvOrDefault("NESTOR_LABELS_LOGIN_TITLE", labels.Title),
+					Email:       getenvOrDefault("NESTOR_LABELS_LOGIN_EMAIL", labels.Email),
+					Password:    getenvOrDefault("NESTOR_LABELS_LOGIN_PASSWORD", labels.Password),
+					Submit:      getenvOrDefault("NESTOR_LABELS_LOGIN_SUBMIT", labels.Submit),
+					ConnectWith: getenvOrDefault("NESTOR_LABELS_LOGIN_CONNECT_WITH", labels.ConnectWith),
+					LoggedOut:   getenvOrDefault("NESTOR_LABELS_LOGGED_OUT", labels.LoggedOut),
 				},
 			},
 		}
@@ -170,25 +298,87 @@ func (a *app) initClients(ctx context.Context) {
 	clientIDs := strings.Split(os.Getenv("NESTOR_CLIENT_IDS"), ",")
 	for i, clientID := range clientIDs {
 		suffix := fmt.Sprintf("_%d", i)
-		a.clients[clientID] = client{
-			ClientID:                 clientID,
-			RedirectURIs:             strings.Split(getEnv("NESTOR_REDIRECT_URIS", suffix, ""), ","),
-			DefaultResourceIndicator: getEnv("NESTOR_DEFAULT_RESOURCE_INDICATOR", suffix, ""),
+		labels := defaultLoginPage(clientID)
+		configured[clientID] = client{
+			ClientID:                    clientID,
+			Type:                        clientType(getClientEnv("NESTOR_CLIENT_TYPE", suffix, string(clientTypePublic))),
+			SecretHash:                  []byte(getClientEnv("NESTOR_CLIENT_SECRET_HASH", suffix, "")),
+			JWKS:                        json.RawMessage(getClientEnv("NESTOR_CLIENT_JWKS", suffix, "")),
+			JWKSURI:                     getClientEnv("NESTOR_CLIENT_JWKS_URI", suffix, ""),
+			RedirectURIs:                strings.Split(getEnv("NESTOR_REDIRECT_URIS", suffix, ""), ","),
+			PostLogoutRedirectURIs:      strings.Split(getEnv("NESTOR_POST_LOGOUT_REDIRECT_URIS", suffix, ""), ","),
+			RevokeRefreshTokensOnLogout: getClientEnv("NESTOR_REVOKE_REFRESH_TOKENS_ON_LOGOUT", suffix, "") == "Y",
+			DefaultResourceIndicator:    getEnv("NESTOR_DEFAULT_RESOURCE_INDICATOR", suffix, ""),
+			Resources:                   strings.Fields(getClientEnv("NESTOR_CLIENT_RESOURCES", suffix, "")),
+			ClientCredentialsScopes:     strings.Fields(getClientEnv("NESTOR_CLIENT_CREDENTIALS_SCOPES", suffix, "")),
+			TokenExchangeAudiences:      strings.Fields(getClientEnv("NESTOR_TOKEN_EXCHANGE_AUDIENCES", suffix, "")),
+			RequirePAR:                  getClientEnv("NESTOR_REQUIRE_PAR", suffix, "") == "Y",
+			FirstParty:                  getClientEnv("NESTOR_CLIENT_FIRST_PARTY", suffix, "") == "Y",
+			SubjectType:                 subjectType(getClientEnv("NESTOR_CLIENT_SUBJECT_TYPE", suffix, string(subjectTypePublic))),
+			SectorIdentifier:            getClientEnv("NESTOR_CLIENT_SECTOR_IDENTIFIER", suffix, ""),
 			LoginPage: loginPage{
-				Title:       getEnv("NESTOR_LABELS_LOGIN_TITLE", suffix, "Se connecter à "+clientID),
-				Email:       getEnv("NESTOR_LABELS_LOGIN_EMAIL", suffix, "Email"),
-				Password:    getEnv("NESTOR_LABELS_LOGIN_PASSWORD", suffix, "Mot de passe"),
-				Submit:      getEnv("NESTOR_LABELS_LOGIN_SUBMIT", suffix, "Se connecter"),
-				ConnectWith: getEnv("NESTOR_LABELS_LOGIN_CONNECT_WITH", suffix, "Se connecter avec"),
+				Title:       getEnv("NESTOR_LABELS_LOGIN_TITLE", suffix, labels.Title),
+				Email:       getEnv("NESTOR_LABELS_LOGIN_EMAIL", suffix, labels.Email),
+				Password:    getEnv("NESTOR_LABELS_LOGIN_PASSWORD", suffix, labels.Password),
+				Submit:      getEnv("NESTOR_LABELS_LOGIN_SUBMIT", suffix, labels.Submit),
+				ConnectWith: getEnv("NESTOR_LABELS_LOGIN_CONNECT_WITH", suffix, labels.ConnectWith),
+				LoggedOut:   getEnv("NESTOR_LABELS_LOGGED_OUT", suffix, labels.LoggedOut),
 			},
 		}
 	}
 
-	for clientID, client := range a.clients {
-		slog.InfoContext(ctx, "Client registered", "clientId", clientID, "redirectURIs", client.RedirectURIs, "defaultResourceIndicator", client.DefaultResourceIndicator)
+	for clientID, client := range configured {
+		if clientID == "" {
+			continue
+		}
+		if err := a.validateClient(&client); err != nil {
+			return err
+		}
+		a.configuredClients[clientID] = client
+		slog.InfoContext(ctx, "Client registered", "clientId", clientID, "type", client.Type, "redirectURIs", client.RedirectURIs, "postLogoutRedirectURIs", client.PostLogoutRedirectURIs, "defaultResourceIndicator", client.DefaultResourceIndicator, "resources", client.Resources, "subjectType", client.SubjectType, "firstParty", client.FirstParty)
+	}
+	return nil
+}
+
+// validateClient checks the consistency of the configuration or the registration metadata of client.
+func (a *app) validateClient(client *client) error {
+	clientID := client.ClientID
+	switch client.Type {
+	case clientTypePublic:
+	case clientTypeConfidential:
+		if len(client.SecretHash) == 0 && len(client.JWKS) == 0 && client.JWKSURI == "" {
+			return fmt.Errorf("confidential client %q has neither a secret hash nor keys", clientID)
+		}
+	default:
+		return fmt.Errorf("client %q has an unknown type %q", clientID, client.Type)
 	}
+	switch client.SubjectType {
+	case subjectTypePublic:
+	case subjectTypePairwise:
+		if len(a.pairwiseSecret) == 0 {
+			return fmt.Errorf("client %q has pairwise subjects but NESTOR_PAIRWISE_SECRET is not set", clientID)
+		}
+		if _, err := client.sectorIdentifier(); err != nil {
+			return fmt.Errorf("client %q has no sector identifier: %w", clientID, err)
+		}
+	default:
+		return fmt.Errorf("client %q has an unknown subject type %q", clientID, client.SubjectType)
+	}
+	// Tokens issued to a client on its own behalf have no end-user
+	for _, scope := range client.ClientCredentialsScopes {
+		if scope == "openid" || scope == "offline_access" {
+			return fmt.Errorf("client %q cannot be allowed the %q scope for client_credentials", clientID, scope)
+		}
+	}
+	if len(client.JWKS) > 0 {
+		if _, err := keyfunc.NewJWKSetJSON(client.JWKS); err != nil {
+			return fmt.Errorf("client %q has an invalid JWK Set: %w", clientID, err)
+		}
+	}
+	return nil
 }
 
+// getEnv returns the variable of a client with the given suffix, or the unsuffixed variable shared by all clients.
 func getEnv(key, suffix, defaultValue string) string {
 	value := os.Getenv(key + suffix)
 	if value == "" {
@@ -199,3 +389,13 @@ func getEnv(key, suffix, defaultValue string) string {
 	}
 	return value
 }
+
+// getClientEnv returns the variable of a client with the given suffix only. Credentials and permissions
+// are not shared, so that a client does not inherit them from the legacy client configuration.
+func getClientEnv(key, suffix, defaultValue string) string {
+	value := os.Getenv(key + suffix)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// oauthError is an OAuth 2.0 error, rendered as described in RFC 6749 Section 5.2
+// by the token endpoint, or sent to the redirect URI by the authorization endpoint.
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+
+	cause error
+}
+
+// newOAuthError returns an error with the given RFC 6749 or RFC 6750 error code.
+func newOAuthError(code, description string) *oauthError {
+	return &oauthError{Code: code, Description: description}
+}
+
+// wrapOAuthError returns an error with the given error code that keeps cause in its chain.
+func wrapOAuthError(code, description string, cause error) *oauthError {
+	return &oauthError{Code: code, Description: description, cause: cause}
+}
+
+func (e *oauthError) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+func (e *oauthError) Unwrap() error {
+	return e.cause
+}
+
+// status returns the HTTP status code of the error response.
+func (e *oauthError) status() int {
+	switch e.Code {
+	case "invalid_client", "invalid_token":
+		return http.StatusUnauthorized
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// writeOAuthError renders err as a JSON error response (RFC 6749 Section 5.2).
+func writeOAuthError(w http.ResponseWriter, req *http.Request, err *oauthError) {
+	if err.Code == "invalid_client" && req.Header.Get("Authorization") != "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="nestor"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(err.status())
+	_ = json.NewEncoder(w).Encode(err)
+}
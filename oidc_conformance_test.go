@@ -1,18 +1,26 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"html"
 	"io"
+	"maps"
 	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -20,14 +28,25 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/simonhege/nestor/account"
 	"github.com/simonhege/nestor/auth"
+	"github.com/simonhege/nestor/clients"
+	"github.com/simonhege/nestor/consent"
+	"github.com/simonhege/nestor/device"
+	"github.com/simonhege/nestor/par"
 	"github.com/simonhege/nestor/refresh"
+	"github.com/simonhege/nestor/session"
 	"github.com/simonhege/nestor/stores/memory"
+	"github.com/simonhege/nestor/subject"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const (
-	testClientID          = "test-client"
-	testRedirectURI       = "http://localhost:3000/callback"
-	testResourceIndicator = "https://api.example.com"
+	testClientID              = "test-client"
+	testConfidentialClientID  = "test-confidential-client"
+	testClientSecret          = "test-client-secret"
+	testRedirectURI           = "http://localhost:3000/callback"
+	testPostLogoutRedirectURI = "http://localhost:3000/logged-out"
+	testResourceIndicator     = "https://api.example.com"
+	testOtherResource         = "https://other-api.example.com"
 )
 
 // newTestServer creates an app wired with in-memory stores, a freshly generated RSA key,
@@ -55,37 +74,102 @@ func newTestServer(t *testing.T) (*app, *httptest.Server) {
 		t.Fatalf("create JWK: %v", err)
 	}
 
+	secretHash, err := bcrypt.GenerateFromPassword([]byte(testClientSecret), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("hash client secret: %v", err)
+	}
+
 	storage := jwkset.NewMemoryStorage()
 	if err := storage.KeyWrite(ctx, jwk); err != nil {
 		t.Fatalf("write JWK to storage: %v", err)
 	}
 
 	a := &app{
-		baseURL:    ts.URL,
-		jwks:       storage,
-		oidcConfig: newOpenIDConfiguration(ts.URL, ts.URL),
-		clients: map[string]client{
-			testClientID: {
-				ClientID:                 testClientID,
-				RedirectURIs:             []string{testRedirectURI},
-				DefaultResourceIndicator: testResourceIndicator,
-			},
-		},
+		baseURL:         ts.URL,
+		jwks:            storage,
+		oidcConfig:      newOpenIDConfiguration(ts.URL, ts.URL),
+		clientStore:     &memory.ClientStore{Data: make(map[string]clients.Data)},
 		accountStore:    &memory.AccountStore{Data: make(map[string]account.Account)},
 		authStore:       &memory.AuthStore{Data: make(map[string]auth.AuthData)},
 		refreshStore:    &memory.RefreshStore{Data: make(map[string]refresh.Data)},
+		sessionStore:    &memory.SessionStore{Data: make(map[string]session.Data)},
+		deviceStore:     &memory.DeviceStore{Data: make(map[string]device.Data)},
+		parStore:        &memory.PARStore{Data: make(map[string]par.Data)},
+		replayStore:     &memory.ReplayStore{Data: make(map[string]time.Time)},
+		subjectStore:    &memory.SubjectStore{Data: make(map[string]subject.Data)},
+		consentStore:    &memory.ConsentStore{Data: make(map[string]consent.Data)},
 		privateKeyStore: &memory.PrivateKeyStore{},
+		pairwiseSecret:  []byte("test-pairwise-secret"),
+	}
+	a.configuredClients = make(map[string]client)
+
+	for _, c := range []client{
+		{
+			ClientID:                    testClientID,
+			Type:                        clientTypePublic,
+			RedirectURIs:                []string{testRedirectURI},
+			PostLogoutRedirectURIs:      []string{testPostLogoutRedirectURI},
+			RevokeRefreshTokensOnLogout: true,
+			DefaultResourceIndicator:    testResourceIndicator,
+			Resources:                   []string{testOtherResource},
+			FirstParty:                  true,
+		},
+		{
+			ClientID:                 testConfidentialClientID,
+			Type:                     clientTypeConfidential,
+			SecretHash:               secretHash,
+			RedirectURIs:             []string{testRedirectURI},
+			DefaultResourceIndicator: testResourceIndicator,
+			Resources:                []string{testOtherResource},
+			ClientCredentialsScopes:  []string{"read", "write"},
+			TokenExchangeAudiences:   []string{testDownstreamResource},
+			FirstParty:               true,
+		},
+	} {
+		putTestClient(t, a, c)
 	}
 
 	mux.HandleFunc("GET /.well-known/openid-configuration", a.handleOpenIDConfiguration)
 	mux.HandleFunc("GET /.well-known/jwks.json", a.handleKeys)
 	mux.HandleFunc("GET /authorize", a.handleAuthorize)
 	mux.HandleFunc("POST /authorize", a.handlePostAuthorize)
+	mux.HandleFunc("POST /consent", a.handlePostConsent)
+	mux.HandleFunc("POST /par", a.handlePushedAuthorizationRequest)
 	mux.HandleFunc("POST /token", a.handleToken)
+	mux.HandleFunc("GET /userinfo", a.handleUserInfo)
+	mux.HandleFunc("POST /userinfo", a.handleUserInfo)
+	mux.HandleFunc("POST /revoke", a.handleRevoke)
+	mux.HandleFunc("POST /introspect", a.handleIntrospect)
+	mux.HandleFunc("GET /logout", a.handleLogout)
+	mux.HandleFunc("POST /logout", a.handleLogout)
+	mux.HandleFunc("POST /device_authorization", a.handleDeviceAuthorization)
+	mux.HandleFunc("GET /device", a.handleDevice)
+	mux.HandleFunc("POST /device", a.handlePostDevice)
+	mux.HandleFunc("POST /register", a.handleRegister)
+	mux.HandleFunc("GET /register/{client_id}", a.handleGetRegistration)
+	mux.HandleFunc("PUT /register/{client_id}", a.handleUpdateRegistration)
+	mux.HandleFunc("DELETE /register/{client_id}", a.handleDeleteRegistration)
 
 	return a, ts
 }
 
+// putTestClient configures c as if it came from the environment.
+func putTestClient(t *testing.T, a *app, c client) {
+	t.Helper()
+	a.configuredClients[c.ClientID] = c
+}
+
+// updateTestClient applies update to the registered client clientID.
+func updateTestClient(t *testing.T, a *app, clientID string, update func(c *client)) {
+	t.Helper()
+	c, err := a.getClient(context.Background(), clientID)
+	if err != nil || c == nil {
+		t.Fatalf("get client %s: %v", clientID, err)
+	}
+	update(c)
+	putTestClient(t, a, *c)
+}
+
 // insertTestAccount creates an active account in the store and returns it.
 func insertTestAccount(t *testing.T, a *app) *account.Account {
 	t.Helper()
@@ -112,14 +196,37 @@ func insertAuthCode(t *testing.T, a *app, code, clientID, accountID, codeChallen
 		Code:                code,
 		CodeChallenge:       codeChallenge,
 		CodeChallengeMethod: "S256",
+		RedirectURI:         testRedirectURI,
 		GrantedScopes:       scopes,
 		AccountID:           accountID,
+		AuthTime:            time.Now(),
+		ExpiresAt:           time.Now().Add(authorizationCodeTTL),
 	}
 	if err := a.authStore.Put(context.Background(), data); err != nil {
 		t.Fatalf("insert auth code: %v", err)
 	}
 }
 
+// assertOAuthError checks that resp is an RFC 6749 Section 5.2 error response with the given status and error code.
+func assertOAuthError(t *testing.T, resp *http.Response, status int, code string) {
+	t.Helper()
+	if resp.StatusCode != status {
+		t.Errorf("expected %d, got %d", status, resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type: got %q, want application/json", ct)
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode error response: %v", err)
+	}
+	if body.Error != code {
+		t.Errorf("error: got %q, want %q", body.Error, code)
+	}
+}
+
 // generatePKCE produces a random S256 PKCE verifier / challenge pair.
 func generatePKCE(t *testing.T) (verifier, challenge string) {
 	t.Helper()
@@ -141,6 +248,7 @@ func doTokenExchange(t *testing.T, baseURL, clientID, code, codeVerifier string)
 		"client_id":     {clientID},
 		"code":          {code},
 		"code_verifier": {codeVerifier},
+		"redirect_uri":  {testRedirectURI},
 	})
 	if err != nil {
 		t.Fatalf("POST /token: %v", err)
@@ -220,6 +328,38 @@ func TestDiscovery(t *testing.T) {
 	}
 }
 
+func TestDiscovery_RegistrationEndpoint(t *testing.T) {
+	a, ts := newTestServer(t)
+
+	registrationEndpoint := func() string {
+		t.Helper()
+		resp, err := http.Get(ts.URL + "/.well-known/openid-configuration")
+		if err != nil {
+			t.Fatalf("GET openid-configuration: %v", err)
+		}
+		defer func() {
+			if err := resp.Body.Close(); err != nil {
+				t.Fatalf("close response body: %v", err)
+			}
+		}()
+		var cfg struct {
+			RegistrationEndpoint string `json:"registration_endpoint"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&cfg); err != nil {
+			t.Fatalf("decode discovery document: %v", err)
+		}
+		return cfg.RegistrationEndpoint
+	}
+
+	if got := registrationEndpoint(); got != "" {
+		t.Errorf("registration_endpoint is advertised without an initial access token: %q", got)
+	}
+	a.initialAccessToken = testInitialAccessToken
+	if got := registrationEndpoint(); got != ts.URL+"/register" {
+		t.Errorf("registration_endpoint: got %q, want %q", got, ts.URL+"/register")
+	}
+}
+
 // ---------------------------------------------------------------------------
 // JWKS
 // ---------------------------------------------------------------------------
@@ -279,7 +419,8 @@ func TestJWKS(t *testing.T) {
 func TestAuthorize_InvalidResponseType(t *testing.T) {
 	_, ts := newTestServer(t)
 
-	resp, err := http.Get(ts.URL + "/authorize?response_type=token&client_id=" + testClientID + "&redirect_uri=" + url.QueryEscape(testRedirectURI))
+	// The client and redirect URI are valid, so the error is sent back to the client
+	resp, err := noRedirectClient.Get(ts.URL + "/authorize?response_type=token&state=xyz&client_id=" + testClientID + "&redirect_uri=" + url.QueryEscape(testRedirectURI))
 	if err != nil {
 		t.Fatalf("GET /authorize: %v", err)
 	}
@@ -289,8 +430,12 @@ func TestAuthorize_InvalidResponseType(t *testing.T) {
 		}
 	}()
 
-	if resp.StatusCode != http.StatusBadRequest {
-		t.Errorf("expected 400, got %d", resp.StatusCode)
+	params := redirectParams(t, resp)
+	if got := params.Get("error"); got != "unsupported_response_type" {
+		t.Errorf("error: got %q, want unsupported_response_type", got)
+	}
+	if got := params.Get("state"); got != "xyz" {
+		t.Errorf("state: got %q, want xyz", got)
 	}
 }
 
@@ -350,9 +495,7 @@ func TestToken_UnsupportedGrantType(t *testing.T) {
 		}
 	}()
 
-	if resp.StatusCode != http.StatusBadRequest {
-		t.Errorf("expected 400, got %d", resp.StatusCode)
-	}
+	assertOAuthError(t, resp, http.StatusBadRequest, "unsupported_grant_type")
 }
 
 // ---------------------------------------------------------------------------
@@ -408,6 +551,7 @@ func TestToken_AuthCode_WrongVerifier(t *testing.T) {
 
 	resp, err := http.PostForm(ts.URL+"/token", url.Values{
 		"grant_type":    {"authorization_code"},
+		"redirect_uri":  {testRedirectURI},
 		"client_id":     {testClientID},
 		"code":          {code},
 		"code_verifier": {"this-is-the-wrong-verifier"},
@@ -431,6 +575,7 @@ func TestToken_AuthCode_UnknownCode(t *testing.T) {
 
 	resp, err := http.PostForm(ts.URL+"/token", url.Values{
 		"grant_type":    {"authorization_code"},
+		"redirect_uri":  {testRedirectURI},
 		"client_id":     {testClientID},
 		"code":          {"code-that-does-not-exist"},
 		"code_verifier": {"some-verifier"},
@@ -451,6 +596,10 @@ func TestToken_AuthCode_UnknownCode(t *testing.T) {
 
 func TestToken_AuthCode_ClientMismatch(t *testing.T) {
 	a, ts := newTestServer(t)
+	putTestClient(t, a, client{
+		ClientID: "a-completely-different-client",
+		Type:     clientTypePublic,
+	})
 	acc := insertTestAccount(t, a)
 	verifier, challenge := generatePKCE(t)
 	code := "authcode-client-mismatch"
@@ -458,6 +607,7 @@ func TestToken_AuthCode_ClientMismatch(t *testing.T) {
 
 	resp, err := http.PostForm(ts.URL+"/token", url.Values{
 		"grant_type":    {"authorization_code"},
+		"redirect_uri":  {testRedirectURI},
 		"client_id":     {"a-completely-different-client"},
 		"code":          {code},
 		"code_verifier": {verifier},
@@ -476,6 +626,118 @@ func TestToken_AuthCode_ClientMismatch(t *testing.T) {
 	}
 }
 
+// redeemCode redeems code as the public test client.
+func redeemCode(t *testing.T, baseURL, code, verifier string) *http.Response {
+	t.Helper()
+	return postForm(t, baseURL, "/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"redirect_uri":  {testRedirectURI},
+		"client_id":     {testClientID},
+		"code":          {code},
+		"code_verifier": {verifier},
+	})
+}
+
+func TestToken_AuthCode_ReuseRevokesTokens(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	verifier, challenge := generatePKCE(t)
+	code := "authcode-reuse"
+	insertAuthCode(t, a, code, testClientID, acc.ID, challenge, []string{"openid", "offline_access"})
+
+	tr := doTokenExchange(t, ts.URL, testClientID, code, verifier)
+	if tr.RefreshToken == "" {
+		t.Fatal("expected a refresh token")
+	}
+
+	assertOAuthError(t, redeemCode(t, ts.URL, code, verifier), http.StatusBadRequest, "invalid_grant")
+	if stored, _ := a.refreshStore.Get(context.Background(), hashToken(tr.RefreshToken)); stored != nil {
+		t.Error("the refresh token issued from a reused code must be revoked")
+	}
+}
+
+func TestToken_AuthCode_ConcurrentRedemption(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	verifier, challenge := generatePKCE(t)
+	code := "authcode-concurrent"
+	insertAuthCode(t, a, code, testClientID, acc.ID, challenge, []string{"openid"})
+
+	const redemptions = 5
+	statuses := make(chan int, redemptions)
+	var wg sync.WaitGroup
+	for range redemptions {
+		wg.Go(func() {
+			resp, err := http.PostForm(ts.URL+"/token", url.Values{
+				"grant_type":    {"authorization_code"},
+				"redirect_uri":  {testRedirectURI},
+				"client_id":     {testClientID},
+				"code":          {code},
+				"code_verifier": {verifier},
+			})
+			if err != nil {
+				t.Errorf("POST /token: %v", err)
+				return
+			}
+			_ = resp.Body.Close()
+			statuses <- resp.StatusCode
+		})
+	}
+	wg.Wait()
+	close(statuses)
+
+	succeeded := 0
+	for status := range statuses {
+		if status == http.StatusOK {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("expected exactly one successful redemption, got %d", succeeded)
+	}
+}
+
+func TestToken_AuthCode_Expired(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	verifier, challenge := generatePKCE(t)
+	code := "authcode-expired"
+	if err := a.authStore.Put(context.Background(), auth.AuthData{
+		ClientID:            testClientID,
+		Code:                code,
+		CodeChallenge:       challenge,
+		CodeChallengeMethod: "S256",
+		RedirectURI:         testRedirectURI,
+		GrantedScopes:       []string{"openid"},
+		AccountID:           acc.ID,
+		AuthTime:            time.Now().Add(-time.Hour),
+		ExpiresAt:           time.Now().Add(-time.Minute),
+	}); err != nil {
+		t.Fatalf("insert auth code: %v", err)
+	}
+
+	assertOAuthError(t, redeemCode(t, ts.URL, code, verifier), http.StatusBadRequest, "invalid_grant")
+}
+
+func TestToken_AuthCode_RedirectURIMismatch(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	verifier, challenge := generatePKCE(t)
+
+	for i, redirectURI := range []string{"", "http://localhost:3000/other"} {
+		code := fmt.Sprintf("authcode-redirect-mismatch-%d", i)
+		insertAuthCode(t, a, code, testClientID, acc.ID, challenge, []string{"openid"})
+		resp := postForm(t, ts.URL, "/token", url.Values{
+			"grant_type":    {"authorization_code"},
+			"redirect_uri":  {redirectURI},
+			"client_id":     {testClientID},
+			"code":          {code},
+			"code_verifier": {verifier},
+		})
+		assertOAuthError(t, resp, http.StatusBadRequest, "invalid_grant")
+	}
+}
+
 func TestToken_AuthCode_InactiveAccount(t *testing.T) {
 	a, ts := newTestServer(t)
 
@@ -494,6 +756,7 @@ func TestToken_AuthCode_InactiveAccount(t *testing.T) {
 
 	resp, err := http.PostForm(ts.URL+"/token", url.Values{
 		"grant_type":    {"authorization_code"},
+		"redirect_uri":  {testRedirectURI},
 		"client_id":     {testClientID},
 		"code":          {code},
 		"code_verifier": {verifier},
@@ -507,9 +770,7 @@ func TestToken_AuthCode_InactiveAccount(t *testing.T) {
 		}
 	}()
 
-	if resp.StatusCode != http.StatusForbidden {
-		t.Errorf("expected 403 for suspended account, got %d", resp.StatusCode)
-	}
+	assertOAuthError(t, resp, http.StatusBadRequest, "invalid_grant")
 }
 
 // ---------------------------------------------------------------------------
@@ -693,13 +954,20 @@ func TestToken_Refresh_HappyPath(t *testing.T) {
 		t.Error("refresh token was not rotated (old value returned)")
 	}
 
-	// Old token must be deleted (rotation).
+	// Old token must be consumed (rotation), the new one belongs to the same family.
 	stored, err := a.refreshStore.Get(context.Background(), tokenHash)
 	if err != nil {
 		t.Fatalf("lookup old refresh token hash: %v", err)
 	}
-	if stored != nil {
-		t.Error("old refresh token was not deleted after rotation")
+	if stored == nil || !stored.Consumed {
+		t.Fatal("old refresh token was not consumed after rotation")
+	}
+	rotated, err := a.refreshStore.Get(context.Background(), hashToken(tr.RefreshToken))
+	if err != nil || rotated == nil {
+		t.Fatalf("lookup new refresh token hash: %v", err)
+	}
+	if rotated.FamilyID == "" || rotated.FamilyID != stored.FamilyID {
+		t.Errorf("family: got %q, want %q", rotated.FamilyID, stored.FamilyID)
 	}
 }
 
@@ -720,9 +988,7 @@ func TestToken_Refresh_Unknown(t *testing.T) {
 		}
 	}()
 
-	if resp.StatusCode != http.StatusUnauthorized {
-		t.Errorf("expected 401, got %d", resp.StatusCode)
-	}
+	assertOAuthError(t, resp, http.StatusBadRequest, "invalid_grant")
 }
 
 func TestToken_Refresh_Expired(t *testing.T) {
@@ -756,7 +1022,3455 @@ func TestToken_Refresh_Expired(t *testing.T) {
 		}
 	}()
 
+	assertOAuthError(t, resp, http.StatusBadRequest, "invalid_grant")
+}
+
+// ---------------------------------------------------------------------------
+// UserInfo endpoint
+// ---------------------------------------------------------------------------
+
+// getUserInfo calls the UserInfo endpoint with the given bearer access token.
+func getUserInfo(t *testing.T, baseURL, accessToken string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, baseURL+"/userinfo", nil)
+	if err != nil {
+		t.Fatalf("create userinfo request: %v", err)
+	}
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /userinfo: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := resp.Body.Close(); err != nil {
+			t.Fatalf("close response body: %v", err)
+		}
+	})
+	return resp
+}
+
+func TestUserInfo_HappyPath(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	verifier, challenge := generatePKCE(t)
+	code := "authcode-userinfo"
+	insertAuthCode(t, a, code, testClientID, acc.ID, challenge, []string{"openid", "email"})
+
+	tr := doTokenExchange(t, ts.URL, testClientID, code, verifier)
+
+	resp := getUserInfo(t, ts.URL, tr.AccessToken)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	var claims map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		t.Fatalf("decode userinfo response: %v", err)
+	}
+	if sub, _ := claims["sub"].(string); sub != acc.ID {
+		t.Errorf("sub: got %q, want %q", sub, acc.ID)
+	}
+	if email, _ := claims["email"].(string); email != acc.Email {
+		t.Errorf("email: got %q, want %q", email, acc.Email)
+	}
+	if _, ok := claims["name"]; ok {
+		t.Error("name must be absent when profile scope was not granted")
+	}
+}
+
+func TestUserInfo_MissingToken(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	resp := getUserInfo(t, ts.URL, "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("WWW-Authenticate"); got != "Bearer" {
+		t.Errorf("WWW-Authenticate: got %q, want Bearer", got)
+	}
+}
+
+func TestUserInfo_InvalidToken(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	resp := getUserInfo(t, ts.URL, "not-a-jwt")
 	if resp.StatusCode != http.StatusUnauthorized {
 		t.Errorf("expected 401, got %d", resp.StatusCode)
 	}
+	if got := resp.Header.Get("WWW-Authenticate"); !strings.Contains(got, `error="invalid_token"`) {
+		t.Errorf("WWW-Authenticate: got %q, want invalid_token error", got)
+	}
+}
+
+func TestUserInfo_SuspendedAccount(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	verifier, challenge := generatePKCE(t)
+	code := "authcode-userinfo-suspended"
+	insertAuthCode(t, a, code, testClientID, acc.ID, challenge, []string{"openid", "email"})
+
+	tr := doTokenExchange(t, ts.URL, testClientID, code, verifier)
+
+	acc.Status = account.StatusSuspended
+	if err := a.accountStore.Put(context.Background(), *acc); err != nil {
+		t.Fatalf("suspend account: %v", err)
+	}
+
+	resp := getUserInfo(t, ts.URL, tr.AccessToken)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", resp.StatusCode)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Revocation endpoint
+// ---------------------------------------------------------------------------
+
+// insertRefreshToken pre-populates the refresh store with the hash of rawToken.
+func insertRefreshToken(t *testing.T, a *app, rawToken, clientID, accountID string) {
+	t.Helper()
+	if err := a.refreshStore.Put(context.Background(), refresh.Data{
+		TokenHash:     hashToken(rawToken),
+		ClientID:      clientID,
+		AccountID:     accountID,
+		GrantedScopes: []string{"openid", "offline_access"},
+		CreatedAt:     time.Now(),
+		ExpiresAt:     time.Now().Add(30 * 24 * time.Hour),
+	}); err != nil {
+		t.Fatalf("insert refresh token: %v", err)
+	}
+}
+
+// postForm posts the form to the given path and returns the response, closed on test cleanup.
+func postForm(t *testing.T, baseURL, path string, form url.Values) *http.Response {
+	t.Helper()
+	resp, err := http.PostForm(baseURL+path, form)
+	if err != nil {
+		t.Fatalf("POST %s: %v", path, err)
+	}
+	t.Cleanup(func() {
+		if err := resp.Body.Close(); err != nil {
+			t.Fatalf("close response body: %v", err)
+		}
+	})
+	return resp
+}
+
+func TestRevoke_RefreshToken(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	rawToken := "raw-refresh-token-revoke"
+	insertRefreshToken(t, a, rawToken, testClientID, acc.ID)
+
+	resp := postForm(t, ts.URL, "/revoke", url.Values{
+		"client_id":       {testClientID},
+		"token":           {rawToken},
+		"token_type_hint": {"refresh_token"},
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	stored, err := a.refreshStore.Get(context.Background(), hashToken(rawToken))
+	if err != nil {
+		t.Fatalf("lookup revoked refresh token: %v", err)
+	}
+	if stored != nil {
+		t.Error("refresh token was not deleted after revocation")
+	}
+}
+
+func TestRevoke_UnknownToken(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	resp := postForm(t, ts.URL, "/revoke", url.Values{
+		"client_id": {testClientID},
+		"token":     {"this-token-was-never-issued"},
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200, got %d", resp.StatusCode)
+	}
+}
+
+func TestRevoke_OtherClientToken(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	rawToken := "raw-refresh-token-other-client"
+	insertRefreshToken(t, a, rawToken, "another-client", acc.ID)
+
+	resp := postForm(t, ts.URL, "/revoke", url.Values{
+		"client_id": {testClientID},
+		"token":     {rawToken},
+	})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", resp.StatusCode)
+	}
+
+	stored, err := a.refreshStore.Get(context.Background(), hashToken(rawToken))
+	if err != nil {
+		t.Fatalf("lookup refresh token: %v", err)
+	}
+	if stored == nil {
+		t.Error("refresh token of another client must not be revoked")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Introspection endpoint
+// ---------------------------------------------------------------------------
+
+// postFormBasicAuth posts the form to the given path with HTTP Basic client authentication.
+func postFormBasicAuth(t *testing.T, baseURL, path, clientID, clientSecret string, form url.Values) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, baseURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatalf("create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST %s: %v", path, err)
+	}
+	t.Cleanup(func() {
+		if err := resp.Body.Close(); err != nil {
+			t.Fatalf("close response body: %v", err)
+		}
+	})
+	return resp
+}
+
+// introspect calls the introspection endpoint as the confidential test client and decodes the response.
+func introspect(t *testing.T, baseURL, token string) introspectionResponse {
+	t.Helper()
+	resp := postFormBasicAuth(t, baseURL, "/introspect", testConfidentialClientID, testClientSecret, url.Values{
+		"token": {token},
+	})
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	var ir introspectionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ir); err != nil {
+		t.Fatalf("decode introspection response: %v", err)
+	}
+	return ir
+}
+
+func TestIntrospect_AccessToken(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	verifier, challenge := generatePKCE(t)
+	code := "authcode-introspect"
+	insertAuthCode(t, a, code, testClientID, acc.ID, challenge, []string{"openid", "email"})
+
+	tr := doTokenExchange(t, ts.URL, testClientID, code, verifier)
+
+	ir := introspect(t, ts.URL, tr.AccessToken)
+	if !ir.Active {
+		t.Fatal("access token must be active")
+	}
+	if ir.Sub != acc.ID {
+		t.Errorf("sub: got %q, want %q", ir.Sub, acc.ID)
+	}
+	if ir.ClientID != testClientID {
+		t.Errorf("client_id: got %q, want %q", ir.ClientID, testClientID)
+	}
+	if ir.Scope != "openid email" {
+		t.Errorf("scope: got %q, want %q", ir.Scope, "openid email")
+	}
+	if len(ir.Aud) != 1 || ir.Aud[0] != testResourceIndicator {
+		t.Errorf("aud: got %v, want [%s]", ir.Aud, testResourceIndicator)
+	}
+
+	// Suspending the account deactivates the token
+	acc.Status = account.StatusSuspended
+	if err := a.accountStore.Put(context.Background(), *acc); err != nil {
+		t.Fatalf("suspend account: %v", err)
+	}
+	if ir := introspect(t, ts.URL, tr.AccessToken); ir.Active {
+		t.Error("access token of a suspended account must be inactive")
+	}
+}
+
+func TestIntrospect_RefreshToken(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	rawToken := "raw-refresh-token-introspect"
+	insertRefreshToken(t, a, rawToken, testClientID, acc.ID)
+
+	ir := introspect(t, ts.URL, rawToken)
+	if !ir.Active {
+		t.Fatal("refresh token must be active")
+	}
+	if ir.Sub != acc.ID {
+		t.Errorf("sub: got %q, want %q", ir.Sub, acc.ID)
+	}
+}
+
+func TestIntrospect_UnknownToken(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	if ir := introspect(t, ts.URL, "this-token-was-never-issued"); ir.Active {
+		t.Error("unknown token must be inactive")
+	}
+}
+
+func TestIntrospect_UnknownClient(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	resp := postForm(t, ts.URL, "/introspect", url.Values{
+		"client_id": {"unknown-client"},
+		"token":     {"some-token"},
+	})
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", resp.StatusCode)
+	}
+}
+
+func TestIntrospect_PublicClient(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	resp := postForm(t, ts.URL, "/introspect", url.Values{
+		"client_id": {testClientID},
+		"token":     {"some-token"},
+	})
+	assertOAuthError(t, resp, http.StatusUnauthorized, "invalid_client")
+}
+
+// ---------------------------------------------------------------------------
+// End session endpoint
+// ---------------------------------------------------------------------------
+
+// noRedirectClient is an HTTP client that returns redirect responses instead of following them.
+var noRedirectClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// getNoRedirect performs a GET request without following redirects, the response is closed on test cleanup.
+func getNoRedirect(t *testing.T, rawURL string) *http.Response {
+	t.Helper()
+	resp, err := noRedirectClient.Get(rawURL)
+	if err != nil {
+		t.Fatalf("GET %s: %v", rawURL, err)
+	}
+	t.Cleanup(func() {
+		if err := resp.Body.Close(); err != nil {
+			t.Fatalf("close response body: %v", err)
+		}
+	})
+	return resp
+}
+
+func TestLogout_RedirectWithState(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	rawToken := "raw-refresh-token-logout"
+	insertRefreshToken(t, a, rawToken, testClientID, acc.ID)
+	verifier, challenge := generatePKCE(t)
+	code := "authcode-logout"
+	insertAuthCode(t, a, code, testClientID, acc.ID, challenge, []string{"openid"})
+
+	tr := doTokenExchange(t, ts.URL, testClientID, code, verifier)
+
+	resp := getNoRedirect(t, ts.URL+"/logout?"+url.Values{
+		"id_token_hint":            {tr.IDToken},
+		"post_logout_redirect_uri": {testPostLogoutRedirectURI},
+		"state":                    {"logout-state"},
+	}.Encode())
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected 302, got %d", resp.StatusCode)
+	}
+	if got, want := resp.Header.Get("Location"), testPostLogoutRedirectURI+"?state=logout-state"; got != want {
+		t.Errorf("Location: got %q, want %q", got, want)
+	}
+
+	stored, err := a.refreshStore.Get(context.Background(), hashToken(rawToken))
+	if err != nil {
+		t.Fatalf("lookup refresh token: %v", err)
+	}
+	if stored != nil {
+		t.Error("refresh token was not revoked on logout")
+	}
+}
+
+func TestLogout_InvalidPostLogoutRedirectURI(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	resp := getNoRedirect(t, ts.URL+"/logout?"+url.Values{
+		"client_id":                {testClientID},
+		"post_logout_redirect_uri": {"https://evil.example.com/logged-out"},
+	}.Encode())
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestLogout_WithoutRedirect(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	resp := getNoRedirect(t, ts.URL+"/logout")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200, got %d", resp.StatusCode)
+	}
+}
+
+// sendLogout calls /logout with method, the form and the cookies, without following redirects.
+func sendLogout(t *testing.T, baseURL, method string, form url.Values, cookies ...*http.Cookie) *http.Response {
+	t.Helper()
+	var req *http.Request
+	var err error
+	if method == http.MethodPost {
+		req, err = http.NewRequest(method, baseURL+"/logout", strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		req, err = http.NewRequest(method, baseURL+"/logout?"+form.Encode(), nil)
+	}
+	if err != nil {
+		t.Fatalf("create logout request: %v", err)
+	}
+	for _, c := range cookies {
+		req.AddCookie(&http.Cookie{Name: c.Name, Value: c.Value})
+	}
+	resp, err := noRedirectClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s /logout: %v", method, err)
+	}
+	t.Cleanup(func() {
+		if err := resp.Body.Close(); err != nil {
+			t.Fatalf("close response body: %v", err)
+		}
+	})
+	return resp
+}
+
+// signIn authenticates acc through the authorize page and returns the session cookie.
+func signIn(t *testing.T, baseURL string, acc *account.Account) *http.Cookie {
+	t.Helper()
+	_, challenge := generatePKCE(t)
+	_, cookies := startAuthorization(t, baseURL, authorizeQuery(challenge, nil))
+	return sessionCookie(t, postLogin(t, baseURL, cookies, acc.Email, testPassword))
+}
+
+// hasSession reports whether the session cookie still signs in without the login page.
+func hasSession(t *testing.T, baseURL string, sessCookie *http.Cookie) bool {
+	t.Helper()
+	_, challenge := generatePKCE(t)
+	resp, _ := startAuthorization(t, baseURL, authorizeQuery(challenge, url.Values{"prompt": {"none"}}), sessCookie)
+	return redirectParams(t, resp).Get("code") != ""
+}
+
+func TestLogout_CrossSiteRequestNeedsConfirmation(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	setTestPassword(t, a, acc)
+	sessCookie := signIn(t, ts.URL, acc)
+	rawToken := "raw-refresh-token-cross-site-logout"
+	insertRefreshToken(t, a, rawToken, testClientID, acc.ID)
+
+	// A request without id_token_hint only shows the confirmation page
+	resp := sendLogout(t, ts.URL, http.MethodGet, url.Values{"client_id": {testClientID}}, sessCookie)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the confirmation page (200), got %d", resp.StatusCode)
+	}
+	if !hasSession(t, ts.URL, sessCookie) {
+		t.Error("the session was ended without confirmation")
+	}
+	if stored, _ := a.refreshStore.Get(context.Background(), hashToken(rawToken)); stored == nil {
+		t.Error("the refresh token was revoked without confirmation")
+	}
+
+	// A POST without the CSRF token of the confirmation page is not a confirmation either
+	sendLogout(t, ts.URL, http.MethodPost, url.Values{"client_id": {testClientID}, "csrf_token": {"forged"}}, sessCookie)
+	if !hasSession(t, ts.URL, sessCookie) {
+		t.Error("the session was ended with a forged CSRF token")
+	}
+
+	var csrfCookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == "csrf_token" {
+			csrfCookie = c
+		}
+	}
+	if csrfCookie == nil {
+		t.Fatal("the confirmation page sets no CSRF cookie")
+	}
+	form := url.Values{"client_id": {testClientID}, "csrf_token": {csrfCookie.Value}}
+	if resp := sendLogout(t, ts.URL, http.MethodPost, form, sessCookie, csrfCookie); resp.StatusCode != http.StatusOK {
+		t.Fatalf("confirmation: expected 200, got %d", resp.StatusCode)
+	}
+	if hasSession(t, ts.URL, sessCookie) {
+		t.Error("the session was not ended after confirmation")
+	}
+	if stored, _ := a.refreshStore.Get(context.Background(), hashToken(rawToken)); stored != nil {
+		t.Error("the refresh token was not revoked after confirmation")
+	}
+}
+
+func TestLogout_HintOfAnotherAccount(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	setTestPassword(t, a, acc)
+	sessCookie := signIn(t, ts.URL, acc)
+
+	other := account.Account{ID: "other-account-id", Email: "other@example.com", Status: account.StatusActive}
+	if err := a.accountStore.Put(context.Background(), other); err != nil {
+		t.Fatalf("insert other account: %v", err)
+	}
+	verifier, challenge := generatePKCE(t)
+	insertAuthCode(t, a, "authcode-other-logout", testClientID, other.ID, challenge, []string{"openid"})
+	tr := doTokenExchange(t, ts.URL, testClientID, "authcode-other-logout", verifier)
+
+	resp := sendLogout(t, ts.URL, http.MethodGet, url.Values{"id_token_hint": {tr.IDToken}}, sessCookie)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the confirmation page (200), got %d", resp.StatusCode)
+	}
+	if !hasSession(t, ts.URL, sessCookie) {
+		t.Error("an ID token of another account ended the session")
+	}
+}
+
+func TestLogout_AccessTokenHint(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	setTestPassword(t, a, acc)
+	sessCookie := signIn(t, ts.URL, acc)
+	verifier, challenge := generatePKCE(t)
+	insertAuthCode(t, a, "authcode-access-token-hint", testClientID, acc.ID, challenge, []string{"openid"})
+	tr := doTokenExchange(t, ts.URL, testClientID, "authcode-access-token-hint", verifier)
+
+	// The audience of the access token is the resource, which would be taken as the client
+	resp := sendLogout(t, ts.URL, http.MethodGet, url.Values{"id_token_hint": {tr.AccessToken}}, sessCookie)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", resp.StatusCode)
+	}
+	if !hasSession(t, ts.URL, sessCookie) {
+		t.Error("an access token used as id_token_hint ended the session")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Interactive authorization helpers
+// ---------------------------------------------------------------------------
+
+const testPassword = "correct horse battery staple"
+
+// setTestPassword stores a bcrypt hash of testPassword on the account.
+func setTestPassword(t *testing.T, a *app, acc *account.Account) {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("hash password: %v", err)
+	}
+	acc.PasswordHash = hash
+	if err := a.accountStore.Put(context.Background(), *acc); err != nil {
+		t.Fatalf("update test account: %v", err)
+	}
+}
+
+// authorizeQuery returns valid /authorize parameters for the test client, overridden by extra.
+func authorizeQuery(challenge string, extra url.Values) url.Values {
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {testClientID},
+		"redirect_uri":          {testRedirectURI},
+		"scope":                 {"openid email"},
+		"state":                 {"test-state"},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+	for k, v := range extra {
+		query[k] = v
+	}
+	return query
+}
+
+// startAuthorization calls GET /authorize with the given cookies and returns the response with the cookies it sets.
+// The __Host- cookies are Secure, so they are replayed manually over the plain HTTP test server.
+func startAuthorization(t *testing.T, baseURL string, query url.Values, cookies ...*http.Cookie) (*http.Response, []*http.Cookie) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, baseURL+"/authorize?"+query.Encode(), nil)
+	if err != nil {
+		t.Fatalf("create authorize request: %v", err)
+	}
+	for _, c := range cookies {
+		req.AddCookie(&http.Cookie{Name: c.Name, Value: c.Value})
+	}
+	resp, err := noRedirectClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /authorize: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := resp.Body.Close(); err != nil {
+			t.Fatalf("close response body: %v", err)
+		}
+	})
+	return resp, resp.Cookies()
+}
+
+// sessionCookie returns the SSO session cookie set by the response, failing the test if there is none.
+func sessionCookie(t *testing.T, resp *http.Response) *http.Cookie {
+	t.Helper()
+	for _, c := range resp.Cookies() {
+		if c.Name == "__Host-session" && c.Value != "" {
+			return c
+		}
+	}
+	t.Fatal("no session cookie was set")
+	return nil
+}
+
+// postLogin submits the login form of the authorize page with the cookies set by startAuthorization.
+func postLogin(t *testing.T, baseURL string, cookies []*http.Cookie, email, password string) *http.Response {
+	t.Helper()
+	form := url.Values{
+		"email":    {email},
+		"password": {password},
+	}
+	for _, c := range cookies {
+		if c.Name == "csrf_token" {
+			form.Set("csrf_token", c.Value)
+		}
+	}
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/authorize", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatalf("create login request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		req.AddCookie(&http.Cookie{Name: c.Name, Value: c.Value})
+	}
+	resp, err := noRedirectClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST /authorize: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := resp.Body.Close(); err != nil {
+			t.Fatalf("close response body: %v", err)
+		}
+	})
+	return resp
+}
+
+// redirectParams parses the query of the Location header of a redirect response.
+func redirectParams(t *testing.T, resp *http.Response) url.Values {
+	t.Helper()
+	if resp.StatusCode != http.StatusFound {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected 302, got %d: %s", resp.StatusCode, body)
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("parse Location header: %v", err)
+	}
+	return location.Query()
+}
+
+// ---------------------------------------------------------------------------
+// Nonce
+// ---------------------------------------------------------------------------
+
+func TestAuthorize_NonceIsCarriedToIDToken(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	setTestPassword(t, a, acc)
+	verifier, challenge := generatePKCE(t)
+
+	_, cookies := startAuthorization(t, ts.URL, authorizeQuery(challenge, url.Values{"nonce": {"test-nonce"}}))
+	params := redirectParams(t, postLogin(t, ts.URL, cookies, acc.Email, testPassword))
+	if got := params.Get("state"); got != "test-state" {
+		t.Errorf("state: got %q, want test-state", got)
+	}
+
+	tr := doTokenExchange(t, ts.URL, testClientID, params.Get("code"), verifier)
+
+	parser := jwt.NewParser()
+	var idClaims jwt.MapClaims
+	if _, _, err := parser.ParseUnverified(tr.IDToken, &idClaims); err != nil {
+		t.Fatalf("ParseUnverified ID token: %v", err)
+	}
+	if nonce, _ := idClaims["nonce"].(string); nonce != "test-nonce" {
+		t.Errorf("ID token nonce: got %q, want test-nonce", nonce)
+	}
+
+	var accessClaims jwt.MapClaims
+	if _, _, err := parser.ParseUnverified(tr.AccessToken, &accessClaims); err != nil {
+		t.Fatalf("ParseUnverified access token: %v", err)
+	}
+	if _, ok := accessClaims["nonce"]; ok {
+		t.Error("access token must not contain the nonce")
+	}
+}
+
+func TestToken_NoNonceWhenNotRequested(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	verifier, challenge := generatePKCE(t)
+	code := "authcode-no-nonce"
+	insertAuthCode(t, a, code, testClientID, acc.ID, challenge, []string{"openid"})
+
+	tr := doTokenExchange(t, ts.URL, testClientID, code, verifier)
+
+	var claims jwt.MapClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(tr.IDToken, &claims); err != nil {
+		t.Fatalf("ParseUnverified ID token: %v", err)
+	}
+	if _, ok := claims["nonce"]; ok {
+		t.Error("ID token must not contain a nonce when none was requested")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Authorize endpoint – OIDC request parameters
+// ---------------------------------------------------------------------------
+
+func TestAuthorize_PromptNone(t *testing.T) {
+	_, ts := newTestServer(t)
+	_, challenge := generatePKCE(t)
+
+	resp, _ := startAuthorization(t, ts.URL, authorizeQuery(challenge, url.Values{"prompt": {"none"}}))
+	params := redirectParams(t, resp)
+	if got := params.Get("error"); got != "login_required" {
+		t.Errorf("error: got %q, want login_required", got)
+	}
+	if got := params.Get("state"); got != "test-state" {
+		t.Errorf("state: got %q, want test-state", got)
+	}
+}
+
+func TestAuthorize_InvalidMaxAge(t *testing.T) {
+	_, ts := newTestServer(t)
+	_, challenge := generatePKCE(t)
+
+	resp, _ := startAuthorization(t, ts.URL, authorizeQuery(challenge, url.Values{"max_age": {"-5"}}))
+	if got := redirectParams(t, resp).Get("error"); got != "invalid_request" {
+		t.Errorf("error: got %q, want invalid_request", got)
+	}
+}
+
+func TestAuthorize_LoginHint(t *testing.T) {
+	_, ts := newTestServer(t)
+	_, challenge := generatePKCE(t)
+
+	resp, _ := startAuthorization(t, ts.URL, authorizeQuery(challenge, url.Values{
+		"login_hint": {"hint@example.com"},
+		"ui_locales": {"fr-FR en"},
+	}))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read authorize page: %v", err)
+	}
+	if !strings.Contains(string(body), `value="hint@example.com"`) {
+		t.Error("email field is not prefilled with login_hint")
+	}
+	if !strings.Contains(string(body), `lang="fr-FR"`) {
+		t.Error("page language does not follow ui_locales")
+	}
+}
+
+func TestToken_AuthTimeIsAuthenticationTime(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	verifier, challenge := generatePKCE(t)
+	code := "authcode-auth-time"
+	authTime := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+	if err := a.authStore.Put(context.Background(), auth.AuthData{
+		ClientID:            testClientID,
+		Code:                code,
+		CodeChallenge:       challenge,
+		CodeChallengeMethod: "S256",
+		RedirectURI:         testRedirectURI,
+		GrantedScopes:       []string{"openid"},
+		AccountID:           acc.ID,
+		AuthTime:            authTime,
+		ExpiresAt:           time.Now().Add(authorizationCodeTTL),
+	}); err != nil {
+		t.Fatalf("insert auth code: %v", err)
+	}
+
+	tr := doTokenExchange(t, ts.URL, testClientID, code, verifier)
+
+	var claims jwt.MapClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(tr.IDToken, &claims); err != nil {
+		t.Fatalf("ParseUnverified ID token: %v", err)
+	}
+	if got, _ := claims["auth_time"].(float64); int64(got) != authTime.Unix() {
+		t.Errorf("auth_time: got %d, want %d", int64(got), authTime.Unix())
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Single sign-on session
+// ---------------------------------------------------------------------------
+
+func TestSession_SkipsLoginPage(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	setTestPassword(t, a, acc)
+	_, challenge := generatePKCE(t)
+
+	_, cookies := startAuthorization(t, ts.URL, authorizeQuery(challenge, nil))
+	sessCookie := sessionCookie(t, postLogin(t, ts.URL, cookies, acc.Email, testPassword))
+
+	verifier, challenge := generatePKCE(t)
+	resp, _ := startAuthorization(t, ts.URL, authorizeQuery(challenge, url.Values{"prompt": {"none"}}), sessCookie)
+	params := redirectParams(t, resp)
+	if params.Get("code") == "" {
+		t.Fatalf("expected an authorization code, got error %q", params.Get("error"))
+	}
+
+	tr := doTokenExchange(t, ts.URL, testClientID, params.Get("code"), verifier)
+	var claims jwt.MapClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(tr.IDToken, &claims); err != nil {
+		t.Fatalf("ParseUnverified ID token: %v", err)
+	}
+	if sub, _ := claims["sub"].(string); sub != acc.ID {
+		t.Errorf("sub: got %q, want %q", sub, acc.ID)
+	}
+}
+
+func TestSession_ForcedLogin(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	setTestPassword(t, a, acc)
+	_, challenge := generatePKCE(t)
+
+	_, cookies := startAuthorization(t, ts.URL, authorizeQuery(challenge, nil))
+	sessCookie := sessionCookie(t, postLogin(t, ts.URL, cookies, acc.Email, testPassword))
+
+	for name, extra := range map[string]url.Values{
+		"prompt=login": {"prompt": {"login"}},
+		"max_age=0":    {"max_age": {"0"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			time.Sleep(10 * time.Millisecond) // max_age=0 requires an authentication strictly older than now
+			resp, _ := startAuthorization(t, ts.URL, authorizeQuery(challenge, extra), sessCookie)
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("expected the login page (200), got %d", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestSession_SuspendedAccount(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	setTestPassword(t, a, acc)
+	_, challenge := generatePKCE(t)
+
+	_, cookies := startAuthorization(t, ts.URL, authorizeQuery(challenge, nil))
+	sessCookie := sessionCookie(t, postLogin(t, ts.URL, cookies, acc.Email, testPassword))
+
+	acc.Status = account.StatusSuspended
+	if err := a.accountStore.Put(context.Background(), *acc); err != nil {
+		t.Fatalf("suspend account: %v", err)
+	}
+
+	resp, _ := startAuthorization(t, ts.URL, authorizeQuery(challenge, url.Values{"prompt": {"none"}}), sessCookie)
+	if got := redirectParams(t, resp).Get("error"); got != "login_required" {
+		t.Errorf("error: got %q, want login_required", got)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Response modes
+// ---------------------------------------------------------------------------
+
+// TestDiscovery_AdvertisesOnlySupportedFeatures ensures discovery does not advertise flows that /authorize rejects.
+func TestDiscovery_AdvertisesOnlySupportedFeatures(t *testing.T) {
+	a, _ := newTestServer(t)
+
+	if got := a.oidcConfig.ResponseTypesSupported; len(got) != 1 || got[0] != "code" {
+		t.Errorf("response_types_supported: got %v, want [code]", got)
+	}
+	for _, grantType := range a.oidcConfig.GrantTypesSupported {
+		if grantType == "implicit" {
+			t.Error("grant_types_supported must not advertise the implicit grant")
+		}
+	}
+}
+
+func TestAuthorize_ResponseModeFragment(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	setTestPassword(t, a, acc)
+	_, challenge := generatePKCE(t)
+
+	_, cookies := startAuthorization(t, ts.URL, authorizeQuery(challenge, url.Values{"response_mode": {"fragment"}}))
+	resp := postLogin(t, ts.URL, cookies, acc.Email, testPassword)
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected 302, got %d", resp.StatusCode)
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("parse Location header: %v", err)
+	}
+	if location.RawQuery != "" {
+		t.Errorf("query must be empty in fragment mode, got %q", location.RawQuery)
+	}
+	params, err := url.ParseQuery(location.Fragment)
+	if err != nil {
+		t.Fatalf("parse fragment: %v", err)
+	}
+	if params.Get("code") == "" {
+		t.Error("code is missing from the fragment")
+	}
+	if got := params.Get("state"); got != "test-state" {
+		t.Errorf("state: got %q, want test-state", got)
+	}
+}
+
+func TestAuthorize_ResponseModeFormPost(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	setTestPassword(t, a, acc)
+	_, challenge := generatePKCE(t)
+
+	_, cookies := startAuthorization(t, ts.URL, authorizeQuery(challenge, url.Values{"response_mode": {"form_post"}}))
+	resp := postLogin(t, ts.URL, cookies, acc.Email, testPassword)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read form_post page: %v", err)
+	}
+	page := string(body)
+	if !strings.Contains(page, `action="`+testRedirectURI+`"`) {
+		t.Error("form does not post to the redirect URI")
+	}
+	if !strings.Contains(page, `name="code"`) || !strings.Contains(page, `name="state" value="test-state"`) {
+		t.Error("form does not carry the code and state")
+	}
+}
+
+func TestAuthorize_ResponseModeFormPost_PrivateUseScheme(t *testing.T) {
+	const nativeRedirectURI = "com.example.app:/callback"
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/authorize", nil)
+
+	sendAuthorizationResponse(context.Background(), rec, req,
+		oAuthParams{RedirectURI: nativeRedirectURI, ResponseMode: "form_post"},
+		url.Values{"code": {"native-code"}})
+	if page := rec.Body.String(); !strings.Contains(page, `action="`+nativeRedirectURI+`"`) {
+		t.Errorf("form does not post to the redirect URI of the native app: %s", page)
+	}
+}
+
+func TestAuthorize_UnsupportedResponseMode(t *testing.T) {
+	_, ts := newTestServer(t)
+	_, challenge := generatePKCE(t)
+
+	resp, _ := startAuthorization(t, ts.URL, authorizeQuery(challenge, url.Values{"response_mode": {"web_message"}}))
+	if got := redirectParams(t, resp).Get("error"); got != "invalid_request" {
+		t.Errorf("error: got %q, want invalid_request", got)
+	}
+}
+
+func TestAuthorize_MissingCodeChallenge(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	query := authorizeQuery("", nil)
+	query.Del("code_challenge")
+	resp, _ := startAuthorization(t, ts.URL, query)
+	if got := redirectParams(t, resp).Get("error"); got != "invalid_request" {
+		t.Errorf("error: got %q, want invalid_request", got)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Confidential clients
+// ---------------------------------------------------------------------------
+
+func TestToken_ConfidentialClient_SecretBasicWithoutPKCE(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	code := "authcode-confidential-basic"
+	insertAuthCode(t, a, code, testConfidentialClientID, acc.ID, "", []string{"openid"})
+
+	resp := postFormBasicAuth(t, ts.URL, "/token", testConfidentialClientID, testClientSecret, url.Values{
+		"grant_type":   {"authorization_code"},
+		"redirect_uri": {testRedirectURI},
+		"code":         {code},
+	})
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestToken_ConfidentialClient_SecretPost(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	verifier, challenge := generatePKCE(t)
+	code := "authcode-confidential-post"
+	insertAuthCode(t, a, code, testConfidentialClientID, acc.ID, challenge, []string{"openid"})
+
+	resp := postForm(t, ts.URL, "/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"redirect_uri":  {testRedirectURI},
+		"client_id":     {testConfidentialClientID},
+		"client_secret": {testClientSecret},
+		"code":          {code},
+		"code_verifier": {verifier},
+	})
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestToken_ConfidentialClient_WrongSecret(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	code := "authcode-confidential-wrong-secret"
+	insertAuthCode(t, a, code, testConfidentialClientID, acc.ID, "", []string{"openid"})
+
+	resp := postFormBasicAuth(t, ts.URL, "/token", testConfidentialClientID, "wrong-secret", url.Values{
+		"grant_type":   {"authorization_code"},
+		"redirect_uri": {testRedirectURI},
+		"code":         {code},
+	})
+	assertOAuthError(t, resp, http.StatusUnauthorized, "invalid_client")
+	if resp.Header.Get("WWW-Authenticate") == "" {
+		t.Error("WWW-Authenticate header is missing after a failed Basic authentication")
+	}
+}
+
+func TestToken_ConfidentialClient_MissingSecret(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	code := "authcode-confidential-no-secret"
+	insertAuthCode(t, a, code, testConfidentialClientID, acc.ID, "", []string{"openid"})
+
+	resp := postForm(t, ts.URL, "/token", url.Values{
+		"grant_type":   {"authorization_code"},
+		"redirect_uri": {testRedirectURI},
+		"client_id":    {testConfidentialClientID},
+		"code":         {code},
+	})
+	assertOAuthError(t, resp, http.StatusUnauthorized, "invalid_client")
+}
+
+func TestInitClients_NoLegacyCredentialsInherited(t *testing.T) {
+	a, _ := newTestServer(t)
+	t.Setenv("NESTOR_CLIENT_ID", "legacy-client")
+	t.Setenv("NESTOR_CLIENT_TYPE", string(clientTypeConfidential))
+	t.Setenv("NESTOR_CLIENT_SECRET_HASH", "legacy-secret-hash")
+	t.Setenv("NESTOR_CLIENT_FIRST_PARTY", "Y")
+	t.Setenv("NESTOR_CLIENT_CREDENTIALS_SCOPES", "read")
+	t.Setenv("NESTOR_REDIRECT_URIS", testRedirectURI)
+	t.Setenv("NESTOR_CLIENT_IDS", "other-client")
+
+	if err := a.initClients(context.Background()); err != nil {
+		t.Fatalf("initClients: %v", err)
+	}
+	other, err := a.getClient(context.Background(), "other-client")
+	if err != nil || other == nil {
+		t.Fatalf("get client: %v", err)
+	}
+	if other.Type != clientTypePublic || len(other.SecretHash) != 0 || other.FirstParty || len(other.ClientCredentialsScopes) != 0 {
+		t.Errorf("the client inherited the credentials or the permissions of the legacy client: %+v", other)
+	}
+	if !slices.Equal(other.RedirectURIs, []string{testRedirectURI}) {
+		t.Errorf("redirect URIs: got %v, want the shared %v", other.RedirectURIs, []string{testRedirectURI})
+	}
+}
+
+func TestInitClients_RemovedClientIsRevoked(t *testing.T) {
+	a, _ := newTestServer(t)
+	t.Setenv("NESTOR_CLIENT_IDS", "env-client")
+	t.Setenv("NESTOR_REDIRECT_URIS", testRedirectURI)
+	ctx := context.Background()
+
+	if err := a.initClients(ctx); err != nil {
+		t.Fatalf("initClients: %v", err)
+	}
+	if data, err := a.clientStore.Get(ctx, "env-client"); err != nil || data != nil {
+		t.Fatalf("the environment client was stored: %+v, %v", data, err)
+	}
+	if c, err := a.getClient(ctx, "env-client"); err != nil || c == nil {
+		t.Fatalf("get client: %v, %v", c, err)
+	}
+
+	// An earlier version stored the environment clients, such a leftover is not a client
+	if err := a.clientStore.Put(ctx, clients.Data{ClientID: "stale-client", RedirectURIs: []string{testRedirectURI}}); err != nil {
+		t.Fatalf("put client: %v", err)
+	}
+	t.Setenv("NESTOR_CLIENT_IDS", "")
+	if err := a.initClients(ctx); err != nil {
+		t.Fatalf("initClients: %v", err)
+	}
+	for _, clientID := range []string{"env-client", "stale-client"} {
+		if c, err := a.getClient(ctx, clientID); err != nil || c != nil {
+			t.Errorf("client %s is still valid: %+v, %v", clientID, c, err)
+		}
+	}
+}
+
+func TestToken_PublicClient_PKCERequired(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	_, challenge := generatePKCE(t)
+	code := "authcode-public-no-verifier"
+	insertAuthCode(t, a, code, testClientID, acc.ID, challenge, []string{"openid"})
+
+	resp := postForm(t, ts.URL, "/token", url.Values{
+		"grant_type":   {"authorization_code"},
+		"redirect_uri": {testRedirectURI},
+		"client_id":    {testClientID},
+		"code":         {code},
+	})
+	assertOAuthError(t, resp, http.StatusBadRequest, "invalid_request")
+}
+
+// ---------------------------------------------------------------------------
+// private_key_jwt client authentication
+// ---------------------------------------------------------------------------
+
+const testKeyClientID = "test-key-client"
+
+// registerKeyClient registers a confidential client authenticating with an inline JWK Set.
+func registerKeyClient(t *testing.T, a *app) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate RSA key: %v", err)
+	}
+	jwk, err := jwkset.NewJWKFromKey(&key.PublicKey, jwkset.JWKOptions{
+		Metadata: jwkset.JWKMetadataOptions{KID: "client-key-1", ALG: jwkset.AlgRS256},
+	})
+	if err != nil {
+		t.Fatalf("create JWK: %v", err)
+	}
+	raw, err := json.Marshal(jwkset.JWKSMarshal{Keys: []jwkset.JWKMarshal{jwk.Marshal()}})
+	if err != nil {
+		t.Fatalf("marshal JWK Set: %v", err)
+	}
+	putTestClient(t, a, client{
+		ClientID:                 testKeyClientID,
+		Type:                     clientTypeConfidential,
+		JWKS:                     raw,
+		RedirectURIs:             []string{testRedirectURI},
+		DefaultResourceIndicator: testResourceIndicator,
+		FirstParty:               true,
+	})
+	return key
+}
+
+// clientAssertion signs a private_key_jwt client assertion for the token endpoint.
+func clientAssertion(t *testing.T, key *rsa.PrivateKey, baseURL, jti string) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss": testKeyClientID,
+		"sub": testKeyClientID,
+		"aud": baseURL + "/token",
+		"jti": jti,
+		"exp": time.Now().Add(time.Minute).Unix(),
+	})
+	token.Header["kid"] = "client-key-1"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("sign client assertion: %v", err)
+	}
+	return signed
+}
+
+func postWithAssertion(t *testing.T, baseURL, code, assertion string) *http.Response {
+	t.Helper()
+	return postForm(t, baseURL, "/token", url.Values{
+		"grant_type":            {"authorization_code"},
+		"redirect_uri":          {testRedirectURI},
+		"code":                  {code},
+		"client_assertion_type": {clientAssertionTypeJWTBearer},
+		"client_assertion":      {assertion},
+	})
+}
+
+func TestToken_PrivateKeyJWT_HappyPath(t *testing.T) {
+	a, ts := newTestServer(t)
+	key := registerKeyClient(t, a)
+	acc := insertTestAccount(t, a)
+	code := "authcode-private-key-jwt"
+	insertAuthCode(t, a, code, testKeyClientID, acc.ID, "", []string{"openid"})
+
+	resp := postWithAssertion(t, ts.URL, code, clientAssertion(t, key, ts.URL, "jti-1"))
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestToken_PrivateKeyJWT_ReusedJTI(t *testing.T) {
+	a, ts := newTestServer(t)
+	key := registerKeyClient(t, a)
+	acc := insertTestAccount(t, a)
+	insertAuthCode(t, a, "authcode-jti-first", testKeyClientID, acc.ID, "", []string{"openid"})
+	insertAuthCode(t, a, "authcode-jti-second", testKeyClientID, acc.ID, "", []string{"openid"})
+
+	assertion := clientAssertion(t, key, ts.URL, "jti-reused")
+	if resp := postWithAssertion(t, ts.URL, "authcode-jti-first", assertion); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first use: expected 200, got %d", resp.StatusCode)
+	}
+	resp := postWithAssertion(t, ts.URL, "authcode-jti-second", assertion)
+	assertOAuthError(t, resp, http.StatusUnauthorized, "invalid_client")
+}
+
+func TestToken_PrivateKeyJWT_WrongKey(t *testing.T) {
+	a, ts := newTestServer(t)
+	registerKeyClient(t, a)
+	acc := insertTestAccount(t, a)
+	code := "authcode-wrong-key"
+	insertAuthCode(t, a, code, testKeyClientID, acc.ID, "", []string{"openid"})
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate RSA key: %v", err)
+	}
+	resp := postWithAssertion(t, ts.URL, code, clientAssertion(t, otherKey, ts.URL, "jti-wrong-key"))
+	assertOAuthError(t, resp, http.StatusUnauthorized, "invalid_client")
+}
+
+func TestToken_PrivateKeyJWT_WrongAudience(t *testing.T) {
+	a, ts := newTestServer(t)
+	key := registerKeyClient(t, a)
+	acc := insertTestAccount(t, a)
+	code := "authcode-wrong-audience"
+	insertAuthCode(t, a, code, testKeyClientID, acc.ID, "", []string{"openid"})
+
+	resp := postWithAssertion(t, ts.URL, code, clientAssertion(t, key, "https://other.example.com", "jti-wrong-aud"))
+	assertOAuthError(t, resp, http.StatusUnauthorized, "invalid_client")
+}
+
+func TestToken_PrivateKeyJWT_LongLived(t *testing.T) {
+	a, ts := newTestServer(t)
+	key := registerKeyClient(t, a)
+	acc := insertTestAccount(t, a)
+	code := "authcode-long-lived-assertion"
+	insertAuthCode(t, a, code, testKeyClientID, acc.ID, "", []string{"openid"})
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss": testKeyClientID,
+		"sub": testKeyClientID,
+		"aud": ts.URL + "/token",
+		"jti": "jti-long-lived",
+		"exp": time.Now().Add(24 * time.Hour).Unix(),
+	})
+	token.Header["kid"] = "client-key-1"
+	assertion, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("sign client assertion: %v", err)
+	}
+	resp := postWithAssertion(t, ts.URL, code, assertion)
+	assertOAuthError(t, resp, http.StatusUnauthorized, "invalid_client")
+}
+
+func TestReplayStore_ConcurrentUse(t *testing.T) {
+	a, _ := newTestServer(t)
+	expiresAt := time.Now().Add(time.Minute)
+
+	const uses = 50
+	results := make(chan bool, uses)
+	var wg sync.WaitGroup
+	for range uses {
+		wg.Go(func() {
+			unused, err := a.replayStore.Use(context.Background(), "concurrent-jti", expiresAt)
+			if err != nil {
+				t.Errorf("use: %v", err)
+				return
+			}
+			results <- unused
+		})
+	}
+	wg.Wait()
+	close(results)
+
+	accepted := 0
+	for unused := range results {
+		if unused {
+			accepted++
+		}
+	}
+	if accepted != 1 {
+		t.Errorf("the jti was accepted %d times, want once", accepted)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// client_credentials grant
+// ---------------------------------------------------------------------------
+
+func clientCredentialsToken(t *testing.T, baseURL string, form url.Values) *http.Response {
+	t.Helper()
+	form.Set("grant_type", "client_credentials")
+	return postFormBasicAuth(t, baseURL, "/token", testConfidentialClientID, testClientSecret, form)
+}
+
+func TestClientKeySets_Bounded(t *testing.T) {
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"keys":[]}`)
+	}))
+	t.Cleanup(jwksServer.Close)
+	var keySets clientKeySets
+	t.Cleanup(func() {
+		for key := range keySets.byURI {
+			keySets.forget(key.uri)
+		}
+	})
+
+	for i := range maxClientKeySets + 1 {
+		if _, err := keySets.get(fmt.Sprintf("%s/jwks/%d", jwksServer.URL, i), false); err != nil {
+			t.Fatalf("get key set %d: %v", i, err)
+		}
+	}
+	if len(keySets.byURI) != maxClientKeySets {
+		t.Errorf("cached key sets: got %d, want %d", len(keySets.byURI), maxClientKeySets)
+	}
+	if _, exists := keySets.byURI[clientKeySetKey{uri: jwksServer.URL + "/jwks/0"}]; exists {
+		t.Error("the least recently used key set was not evicted")
+	}
+
+	// A client update or deletion stops the refresh of its key set
+	last := fmt.Sprintf("%s/jwks/%d", jwksServer.URL, maxClientKeySets)
+	keySets.forget(last)
+	if _, exists := keySets.byURI[clientKeySetKey{uri: last}]; exists {
+		t.Error("the forgotten key set is still cached")
+	}
+}
+
+func TestPublicHTTPClient_InternalAddress(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Error("the internal server was reached")
+	}))
+	t.Cleanup(internal.Close)
+
+	// The dialer checks the address a host name resolves to, not only IP literals
+	for _, uri := range []string{internal.URL, strings.Replace(internal.URL, "127.0.0.1", "localhost", 1)} {
+		resp, err := publicHTTPClient.Get(uri)
+		if err == nil {
+			_ = resp.Body.Close()
+			t.Errorf("GET %s: expected the connection to a loopback address to be refused", uri)
+		}
+	}
+}
+
+func TestToken_ClientCredentials_HappyPath(t *testing.T) {
+	a, ts := newTestServer(t)
+
+	resp := clientCredentialsToken(t, ts.URL, url.Values{"scope": {"read"}})
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		t.Fatalf("decode token response: %v", err)
+	}
+	if tr.IDToken != "" || tr.RefreshToken != "" {
+		t.Error("client_credentials must not issue an ID token nor a refresh token")
+	}
+	if tr.Scope != "read" {
+		t.Errorf("scope: got %q, want read", tr.Scope)
+	}
+
+	token, err := a.parseToken(context.Background(), tr.AccessToken)
+	if err != nil {
+		t.Fatalf("parse access token: %v", err)
+	}
+	sub, _ := token.Claims.GetSubject()
+	aud, _ := token.Claims.GetAudience()
+	if sub != testConfidentialClientID {
+		t.Errorf("sub: got %q, want %q", sub, testConfidentialClientID)
+	}
+	if len(aud) != 1 || aud[0] != testResourceIndicator {
+		t.Errorf("aud: got %v, want %q", aud, testResourceIndicator)
+	}
+
+	if ir := introspect(t, ts.URL, tr.AccessToken); !ir.Active || ir.ClientID != testConfidentialClientID {
+		t.Errorf("introspection: got %+v, want an active token of %q", ir, testConfidentialClientID)
+	}
+}
+
+func TestToken_ClientCredentials_DefaultScopesAndResource(t *testing.T) {
+	a, ts := newTestServer(t)
+
+	resp := clientCredentialsToken(t, ts.URL, url.Values{"resource": {testOtherResource}})
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		t.Fatalf("decode token response: %v", err)
+	}
+	if tr.Scope != "read write" {
+		t.Errorf("scope: got %q, want all allowed scopes", tr.Scope)
+	}
+	token, err := a.parseToken(context.Background(), tr.AccessToken)
+	if err != nil {
+		t.Fatalf("parse access token: %v", err)
+	}
+	if aud, _ := token.Claims.GetAudience(); len(aud) != 1 || aud[0] != testOtherResource {
+		t.Errorf("aud: got %v, want the requested resource", aud)
+	}
+}
+
+func TestToken_ClientCredentials_ScopeNotAllowed(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	resp := clientCredentialsToken(t, ts.URL, url.Values{"scope": {"read admin"}})
+	assertOAuthError(t, resp, http.StatusBadRequest, "invalid_scope")
+}
+
+func TestToken_ClientCredentials_PublicClient(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	resp := postForm(t, ts.URL, "/token", url.Values{
+		"grant_type": {"client_credentials"},
+		"client_id":  {testClientID},
+	})
+	assertOAuthError(t, resp, http.StatusBadRequest, "unauthorized_client")
+}
+
+// ---------------------------------------------------------------------------
+// Device authorization grant
+// ---------------------------------------------------------------------------
+
+func startDeviceAuthorization(t *testing.T, baseURL string) deviceAuthorizationResponse {
+	t.Helper()
+	resp := postForm(t, baseURL, "/device_authorization", url.Values{
+		"client_id": {testClientID},
+		"scope":     {"openid offline_access"},
+	})
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	var dar deviceAuthorizationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&dar); err != nil {
+		t.Fatalf("decode device authorization response: %v", err)
+	}
+	return dar
+}
+
+func pollDeviceToken(t *testing.T, baseURL, deviceCode string) *http.Response {
+	t.Helper()
+	return postForm(t, baseURL, "/token", url.Values{
+		"grant_type":  {deviceCodeGrantType},
+		"client_id":   {testClientID},
+		"device_code": {deviceCode},
+	})
+}
+
+// answerDevice opens the verification page for userCode and submits it with the given action, signing in with the test password.
+func answerDevice(t *testing.T, baseURL, userCode, email, action string) *http.Response {
+	t.Helper()
+	page := getNoRedirect(t, baseURL+"/device?"+url.Values{"user_code": {userCode}}.Encode())
+	if page.StatusCode != http.StatusOK {
+		t.Fatalf("GET /device: expected 200, got %d", page.StatusCode)
+	}
+	form := url.Values{
+		"user_code": {userCode},
+		"action":    {action},
+		"email":     {email},
+		"password":  {testPassword},
+	}
+	for _, c := range page.Cookies() {
+		if c.Name == "csrf_token" {
+			form.Set("csrf_token", c.Value)
+		}
+	}
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/device", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatalf("create device request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "csrf_token", Value: form.Get("csrf_token")})
+	resp, err := noRedirectClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST /device: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := resp.Body.Close(); err != nil {
+			t.Fatalf("close response body: %v", err)
+		}
+	})
+	return resp
+}
+
+// resetDevicePolling lets the next poll of the device code through the polling interval.
+func resetDevicePolling(t *testing.T, a *app, deviceCode string) {
+	t.Helper()
+	data, err := a.deviceStore.Get(context.Background(), hashToken(deviceCode))
+	if err != nil || data == nil {
+		t.Fatalf("get device authorization: %v", err)
+	}
+	data.LastPolledAt = time.Time{}
+	if err := a.deviceStore.Put(context.Background(), *data); err != nil {
+		t.Fatalf("put device authorization: %v", err)
+	}
+}
+
+func TestDevice_HappyPath(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	setTestPassword(t, a, acc)
+
+	dar := startDeviceAuthorization(t, ts.URL)
+	if dar.VerificationURI != ts.URL+"/device" || dar.Interval != devicePollingInterval {
+		t.Errorf("unexpected device authorization response: %+v", dar)
+	}
+
+	assertOAuthError(t, pollDeviceToken(t, ts.URL, dar.DeviceCode), http.StatusBadRequest, "authorization_pending")
+	assertOAuthError(t, pollDeviceToken(t, ts.URL, dar.DeviceCode), http.StatusBadRequest, "slow_down")
+
+	// The user code is accepted as typed by the end-user
+	resp := answerDevice(t, ts.URL, strings.ToLower(strings.ReplaceAll(dar.UserCode, "-", "")), acc.Email, "approve")
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("POST /device: expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	resetDevicePolling(t, a, dar.DeviceCode)
+	resp = pollDeviceToken(t, ts.URL, dar.DeviceCode)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("token: expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		t.Fatalf("decode token response: %v", err)
+	}
+	if tr.AccessToken == "" || tr.IDToken == "" || tr.RefreshToken == "" {
+		t.Errorf("expected access, ID and refresh tokens, got %+v", tr)
+	}
+
+	// The device code is single use
+	assertOAuthError(t, pollDeviceToken(t, ts.URL, dar.DeviceCode), http.StatusBadRequest, "invalid_grant")
+}
+
+func TestDevice_Denied(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+
+	dar := startDeviceAuthorization(t, ts.URL)
+	if resp := answerDevice(t, ts.URL, dar.UserCode, acc.Email, "deny"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /device: expected 200, got %d", resp.StatusCode)
+	}
+
+	assertOAuthError(t, pollDeviceToken(t, ts.URL, dar.DeviceCode), http.StatusBadRequest, "access_denied")
+}
+
+func TestDevice_WrongPassword(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+
+	dar := startDeviceAuthorization(t, ts.URL)
+	if resp := answerDevice(t, ts.URL, dar.UserCode, acc.Email, "approve"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("POST /device: expected 401, got %d", resp.StatusCode)
+	}
+
+	assertOAuthError(t, pollDeviceToken(t, ts.URL, dar.DeviceCode), http.StatusBadRequest, "authorization_pending")
+}
+
+func TestDevice_Expired(t *testing.T) {
+	a, ts := newTestServer(t)
+
+	dar := startDeviceAuthorization(t, ts.URL)
+	data, err := a.deviceStore.Get(context.Background(), hashToken(dar.DeviceCode))
+	if err != nil || data == nil {
+		t.Fatalf("get device authorization: %v", err)
+	}
+	data.ExpiresAt = time.Now().Add(-time.Second)
+	if err := a.deviceStore.Put(context.Background(), *data); err != nil {
+		t.Fatalf("put device authorization: %v", err)
+	}
+
+	assertOAuthError(t, pollDeviceToken(t, ts.URL, dar.DeviceCode), http.StatusBadRequest, "expired_token")
+}
+
+func TestDevice_ConcurrentRedemption(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	setTestPassword(t, a, acc)
+
+	dar := startDeviceAuthorization(t, ts.URL)
+	if resp := answerDevice(t, ts.URL, dar.UserCode, acc.Email, "approve"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /device: expected 200, got %d", resp.StatusCode)
+	}
+
+	const redemptions = 5
+	statuses := make(chan int, redemptions)
+	var wg sync.WaitGroup
+	for range redemptions {
+		wg.Go(func() {
+			resp, err := http.PostForm(ts.URL+"/token", url.Values{
+				"grant_type":  {deviceCodeGrantType},
+				"client_id":   {testClientID},
+				"device_code": {dar.DeviceCode},
+			})
+			if err != nil {
+				t.Errorf("POST /token: %v", err)
+				return
+			}
+			_ = resp.Body.Close()
+			statuses <- resp.StatusCode
+		})
+	}
+	wg.Wait()
+	close(statuses)
+
+	succeeded := 0
+	for status := range statuses {
+		if status == http.StatusOK {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("expected exactly one successful redemption, got %d", succeeded)
+	}
+}
+
+func TestDevice_PollKeepsApproval(t *testing.T) {
+	a, ts := newTestServer(t)
+	ctx := context.Background()
+
+	dar := startDeviceAuthorization(t, ts.URL)
+	deviceCodeHash := hashToken(dar.DeviceCode)
+	data, err := a.deviceStore.Get(ctx, deviceCodeHash)
+	if err != nil || data == nil {
+		t.Fatalf("get device authorization: %v", err)
+	}
+
+	// The end-user approves between the read and the write of a poll
+	approved := *data
+	approved.Status = device.StatusApproved
+	if err := a.deviceStore.Put(ctx, approved); err != nil {
+		t.Fatalf("put device authorization: %v", err)
+	}
+	if recorded, err := a.deviceStore.RecordPoll(ctx, deviceCodeHash, time.Now(), data.Interval); err != nil || recorded {
+		t.Errorf("record poll of an approved request: got %v, %v", recorded, err)
+	}
+	if data, err := a.deviceStore.Get(ctx, deviceCodeHash); err != nil || data == nil || data.Status != device.StatusApproved {
+		t.Errorf("the approval was overwritten: %+v, %v", data, err)
+	}
+}
+
+func TestDevice_UnknownScope(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	resp := postForm(t, ts.URL, "/device_authorization", url.Values{
+		"client_id": {testClientID},
+		"scope":     {"openid admin"},
+	})
+	assertOAuthError(t, resp, http.StatusBadRequest, "invalid_scope")
+}
+
+func TestDevice_GrantTypeNotAllowed(t *testing.T) {
+	a, ts := newTestServer(t)
+	updateTestClient(t, a, testClientID, func(c *client) {
+		c.GrantTypes = []string{"authorization_code"}
+	})
+
+	resp := postForm(t, ts.URL, "/device_authorization", url.Values{
+		"client_id": {testClientID},
+		"scope":     {"openid"},
+	})
+	assertOAuthError(t, resp, http.StatusBadRequest, "unauthorized_client")
+}
+
+// ---------------------------------------------------------------------------
+// Token exchange
+// ---------------------------------------------------------------------------
+
+const testDownstreamResource = "https://downstream.example.com"
+
+// userAccessToken returns an access token of the test client for a new test account.
+func userAccessToken(t *testing.T, a *app, baseURL string, scopes []string) string {
+	t.Helper()
+	acc := insertTestAccount(t, a)
+	verifier, challenge := generatePKCE(t)
+	code := "authcode-" + rand.Text()
+	insertAuthCode(t, a, code, testClientID, acc.ID, challenge, scopes)
+	return doTokenExchange(t, baseURL, testClientID, code, verifier).AccessToken
+}
+
+func exchangeToken(t *testing.T, baseURL string, form url.Values) *http.Response {
+	t.Helper()
+	form.Set("grant_type", tokenExchangeGrantType)
+	return postFormBasicAuth(t, baseURL, "/token", testConfidentialClientID, testClientSecret, form)
+}
+
+func TestTokenExchange_HappyPath(t *testing.T) {
+	a, ts := newTestServer(t)
+	subjectToken := userAccessToken(t, a, ts.URL, []string{"openid", "email"})
+
+	resp := exchangeToken(t, ts.URL, url.Values{
+		"subject_token":      {subjectToken},
+		"subject_token_type": {accessTokenType},
+		"audience":           {testDownstreamResource},
+		"scope":              {"email"},
+	})
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		t.Fatalf("decode token response: %v", err)
+	}
+	if tr.IssuedTokenType != accessTokenType || tr.IDToken != "" || tr.RefreshToken != "" {
+		t.Errorf("unexpected token exchange response: %+v", tr)
+	}
+
+	subject, err := a.parseToken(context.Background(), subjectToken)
+	if err != nil {
+		t.Fatalf("parse subject token: %v", err)
+	}
+	exchanged, err := a.parseToken(context.Background(), tr.AccessToken)
+	if err != nil {
+		t.Fatalf("parse exchanged token: %v", err)
+	}
+	claims := exchanged.Claims.(jwt.MapClaims)
+	wantSub, _ := subject.Claims.GetSubject()
+	if sub, _ := claims.GetSubject(); sub != wantSub {
+		t.Errorf("sub: got %q, want %q", sub, wantSub)
+	}
+	if aud, _ := claims.GetAudience(); len(aud) != 1 || aud[0] != testDownstreamResource {
+		t.Errorf("aud: got %v, want %q", aud, testDownstreamResource)
+	}
+	if claims["scope"] != "email" {
+		t.Errorf("scope: got %v, want email", claims["scope"])
+	}
+	act, _ := claims["act"].(map[string]any)
+	if act["sub"] != testConfidentialClientID {
+		t.Errorf("act: got %v, want the exchanging client as actor", claims["act"])
+	}
+}
+
+func TestTokenExchange_ActorToken(t *testing.T) {
+	a, ts := newTestServer(t)
+	subjectToken := userAccessToken(t, a, ts.URL, []string{"openid"})
+
+	actorToken := userAccessToken(t, a, ts.URL, []string{"openid"})
+	actor, err := a.parseToken(context.Background(), actorToken)
+	if err != nil {
+		t.Fatalf("parse actor token: %v", err)
+	}
+	actorSub, _ := actor.Claims.GetSubject()
+
+	resp := exchangeToken(t, ts.URL, url.Values{
+		"subject_token":      {subjectToken},
+		"subject_token_type": {accessTokenType},
+		"actor_token":        {actorToken},
+		"actor_token_type":   {accessTokenType},
+		"resource":           {testDownstreamResource},
+	})
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		t.Fatalf("decode token response: %v", err)
+	}
+	exchanged, err := a.parseToken(context.Background(), tr.AccessToken)
+	if err != nil {
+		t.Fatalf("parse exchanged token: %v", err)
+	}
+	act, _ := exchanged.Claims.(jwt.MapClaims)["act"].(map[string]any)
+	if act["sub"] != actorSub {
+		t.Errorf("act: got %v, want the subject of the actor token", act)
+	}
+}
+
+func TestTokenExchange_AudienceNotAllowed(t *testing.T) {
+	a, ts := newTestServer(t)
+	subjectToken := userAccessToken(t, a, ts.URL, []string{"openid"})
+
+	resp := exchangeToken(t, ts.URL, url.Values{
+		"subject_token":      {subjectToken},
+		"subject_token_type": {accessTokenType},
+		"audience":           {"https://not-allowed.example.com"},
+	})
+	assertOAuthError(t, resp, http.StatusBadRequest, "invalid_target")
+}
+
+func TestTokenExchange_ScopeEscalation(t *testing.T) {
+	a, ts := newTestServer(t)
+	subjectToken := userAccessToken(t, a, ts.URL, []string{"openid"})
+
+	resp := exchangeToken(t, ts.URL, url.Values{
+		"subject_token":      {subjectToken},
+		"subject_token_type": {accessTokenType},
+		"audience":           {testDownstreamResource},
+		"scope":              {"openid email"},
+	})
+	assertOAuthError(t, resp, http.StatusBadRequest, "invalid_scope")
+}
+
+func TestTokenExchange_InvalidSubjectToken(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	resp := exchangeToken(t, ts.URL, url.Values{
+		"subject_token":      {"not-a-jwt"},
+		"subject_token_type": {accessTokenType},
+		"audience":           {testDownstreamResource},
+	})
+	assertOAuthError(t, resp, http.StatusBadRequest, "invalid_request")
+}
+
+func TestTokenExchange_SubjectTokenForAnotherResource(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	subjectToken, err := a.createAccessToken(context.Background(), jwt.MapClaims{
+		"sub":       acc.ID,
+		"aud":       "https://elsewhere.example.com",
+		"client_id": testClientID,
+		"scope":     "openid",
+	})
+	if err != nil {
+		t.Fatalf("create subject token: %v", err)
+	}
+
+	resp := exchangeToken(t, ts.URL, url.Values{
+		"subject_token":      {subjectToken},
+		"subject_token_type": {accessTokenType},
+		"audience":           {testDownstreamResource},
+	})
+	assertOAuthError(t, resp, http.StatusBadRequest, "invalid_grant")
+}
+
+func TestTokenExchange_KeepsDPoPBinding(t *testing.T) {
+	a, ts := newTestServer(t)
+	key := newDPoPKey(t)
+	subjectToken := dpopTokens(t, a, ts.URL, key).AccessToken
+	subject, err := a.parseToken(context.Background(), subjectToken)
+	if err != nil {
+		t.Fatalf("parse subject token: %v", err)
+	}
+
+	resp := exchangeToken(t, ts.URL, url.Values{
+		"subject_token":      {subjectToken},
+		"subject_token_type": {accessTokenType},
+		"audience":           {testDownstreamResource},
+	})
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		t.Fatalf("decode token response: %v", err)
+	}
+	exchanged, err := a.parseToken(context.Background(), tr.AccessToken)
+	if err != nil {
+		t.Fatalf("parse exchanged token: %v", err)
+	}
+	if got, want := dpopKeyThumbprint(exchanged), dpopKeyThumbprint(subject); got == "" || got != want {
+		t.Errorf("cnf.jkt: got %q, want the key of the subject token %q", got, want)
+	}
+	if tr.TokenType != "DPoP" {
+		t.Errorf("token_type: got %q, want DPoP", tr.TokenType)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Pushed authorization requests
+// ---------------------------------------------------------------------------
+
+// pushAuthorization pushes the authorization request parameters and returns the request_uri.
+func pushAuthorization(t *testing.T, baseURL string, params url.Values) string {
+	t.Helper()
+	resp := postForm(t, baseURL, "/par", params)
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected 201, got %d: %s", resp.StatusCode, body)
+	}
+	var pushed pushedAuthorizationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&pushed); err != nil {
+		t.Fatalf("decode pushed authorization response: %v", err)
+	}
+	if !strings.HasPrefix(pushed.RequestURI, "urn:ietf:params:oauth:request_uri:") || pushed.ExpiresIn <= 0 {
+		t.Fatalf("unexpected pushed authorization response: %+v", pushed)
+	}
+	return pushed.RequestURI
+}
+
+func TestPAR_HappyPath(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	setTestPassword(t, a, acc)
+	_, challenge := generatePKCE(t)
+
+	requestURI := pushAuthorization(t, ts.URL, authorizeQuery(challenge, url.Values{"state": {"pushed-state"}}))
+
+	query := url.Values{"client_id": {testClientID}, "request_uri": {requestURI}}
+	resp, cookies := startAuthorization(t, ts.URL, query)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the login page, got %d", resp.StatusCode)
+	}
+	params := redirectParams(t, postLogin(t, ts.URL, cookies, acc.Email, testPassword))
+	if params.Get("code") == "" || params.Get("state") != "pushed-state" {
+		t.Errorf("expected a code and the pushed state, got %v", params)
+	}
+
+	// The request_uri can be used only once
+	resp, _ = startAuthorization(t, ts.URL, query)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("reused request_uri: expected 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestPAR_ConcurrentUse(t *testing.T) {
+	a, ts := newTestServer(t)
+	_, challenge := generatePKCE(t)
+
+	requestURI := pushAuthorization(t, ts.URL, authorizeQuery(challenge, nil))
+
+	const uses = 10
+	results := make(chan bool, uses)
+	var wg sync.WaitGroup
+	for range uses {
+		wg.Go(func() {
+			_, err := a.pushedParameters(context.Background(), testClientID, requestURI)
+			results <- err == nil
+		})
+	}
+	wg.Wait()
+	close(results)
+
+	succeeded := 0
+	for ok := range results {
+		if ok {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("expected the request_uri to be used exactly once, got %d", succeeded)
+	}
+}
+
+func TestPAR_OtherClient(t *testing.T) {
+	_, ts := newTestServer(t)
+	_, challenge := generatePKCE(t)
+
+	requestURI := pushAuthorization(t, ts.URL, authorizeQuery(challenge, nil))
+
+	resp, _ := startAuthorization(t, ts.URL, url.Values{"client_id": {testConfidentialClientID}, "request_uri": {requestURI}})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestPAR_InvalidRedirectURI(t *testing.T) {
+	_, ts := newTestServer(t)
+	_, challenge := generatePKCE(t)
+
+	resp := postForm(t, ts.URL, "/par", authorizeQuery(challenge, url.Values{"redirect_uri": {"https://evil.example.com/cb"}}))
+	assertOAuthError(t, resp, http.StatusBadRequest, "invalid_request")
+}
+
+func TestPAR_Required(t *testing.T) {
+	a, ts := newTestServer(t)
+	updateTestClient(t, a, testClientID, func(c *client) { c.RequirePAR = true })
+	_, challenge := generatePKCE(t)
+
+	resp, _ := startAuthorization(t, ts.URL, authorizeQuery(challenge, nil))
+	if got := redirectParams(t, resp).Get("error"); got != "invalid_request" {
+		t.Errorf("error: got %q, want invalid_request", got)
+	}
+
+	requestURI := pushAuthorization(t, ts.URL, authorizeQuery(challenge, nil))
+	resp, _ = startAuthorization(t, ts.URL, url.Values{"client_id": {testClientID}, "request_uri": {requestURI}})
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("pushed request: expected the login page, got %d", resp.StatusCode)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Signed request objects
+// ---------------------------------------------------------------------------
+
+// signRequestObject signs an authorization request of the key client with key.
+func signRequestObject(t *testing.T, key *rsa.PrivateKey, baseURL string, extra jwt.MapClaims) string {
+	t.Helper()
+	claims := jwt.MapClaims{
+		"iss":           testKeyClientID,
+		"aud":           baseURL,
+		"client_id":     testKeyClientID,
+		"response_type": "code",
+		"redirect_uri":  testRedirectURI,
+		"scope":         "openid email",
+		"state":         "signed-state",
+		"max_age":       3600,
+		"exp":           time.Now().Add(time.Minute).Unix(),
+		"jti":           rand.Text(),
+	}
+	maps.Copy(claims, extra)
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "client-key-1"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("sign request object: %v", err)
+	}
+	return signed
+}
+
+func TestRequestObject_HappyPath(t *testing.T) {
+	a, ts := newTestServer(t)
+	key := registerKeyClient(t, a)
+	acc := insertTestAccount(t, a)
+	setTestPassword(t, a, acc)
+
+	query := url.Values{
+		"client_id":     {testKeyClientID},
+		"response_type": {"code"},
+		"request":       {signRequestObject(t, key, ts.URL, nil)},
+	}
+	resp, cookies := startAuthorization(t, ts.URL, query)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected the login page, got %d: %s", resp.StatusCode, body)
+	}
+	params := redirectParams(t, postLogin(t, ts.URL, cookies, acc.Email, testPassword))
+	if params.Get("code") == "" || params.Get("state") != "signed-state" {
+		t.Errorf("expected a code and the signed state, got %v", params)
+	}
+}
+
+func TestRequestObject_ConflictingQueryParameter(t *testing.T) {
+	a, ts := newTestServer(t)
+	key := registerKeyClient(t, a)
+
+	query := url.Values{
+		"client_id": {testKeyClientID},
+		"state":     {"tampered-state"},
+		"request":   {signRequestObject(t, key, ts.URL, nil)},
+	}
+	resp, _ := startAuthorization(t, ts.URL, query)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestRequestObject_WrongKey(t *testing.T) {
+	a, ts := newTestServer(t)
+	registerKeyClient(t, a)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate RSA key: %v", err)
+	}
+
+	query := url.Values{
+		"client_id": {testKeyClientID},
+		"request":   {signRequestObject(t, otherKey, ts.URL, nil)},
+	}
+	resp, _ := startAuthorization(t, ts.URL, query)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestRequestObject_OtherClientID(t *testing.T) {
+	a, ts := newTestServer(t)
+	key := registerKeyClient(t, a)
+
+	query := url.Values{
+		"client_id": {testKeyClientID},
+		"request":   {signRequestObject(t, key, ts.URL, jwt.MapClaims{"client_id": testClientID})},
+	}
+	resp, _ := startAuthorization(t, ts.URL, query)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestRequestObject_ExpirationRequired(t *testing.T) {
+	a, ts := newTestServer(t)
+	key := registerKeyClient(t, a)
+
+	tests := []struct {
+		name  string
+		extra jwt.MapClaims
+	}{
+		{"without exp", jwt.MapClaims{"exp": nil}},
+		{"long-lived", jwt.MapClaims{"exp": time.Now().Add(24 * time.Hour).Unix()}},
+		{"without jti", jwt.MapClaims{"jti": nil}},
+		{"issued in the future", jwt.MapClaims{"iat": time.Now().Add(time.Hour).Unix()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := signRequestObject(t, key, ts.URL, tt.extra)
+			resp, _ := startAuthorization(t, ts.URL, url.Values{"client_id": {testKeyClientID}, "request": {request}})
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("expected 400, got %d", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestRequestObject_Replayed(t *testing.T) {
+	a, ts := newTestServer(t)
+	key := registerKeyClient(t, a)
+
+	query := url.Values{
+		"client_id": {testKeyClientID},
+		"request":   {signRequestObject(t, key, ts.URL, nil)},
+	}
+	if resp, _ := startAuthorization(t, ts.URL, query); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first use: expected the login page, got %d", resp.StatusCode)
+	}
+	if resp, _ := startAuthorization(t, ts.URL, query); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("replay: expected 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestRequestObject_MultipleResources(t *testing.T) {
+	a, ts := newTestServer(t)
+	key := registerKeyClient(t, a)
+	resources := []string{testResourceIndicator, "https://other.example.com"}
+
+	query, err := a.requestObjectParameters(context.Background(), url.Values{
+		"client_id": {testKeyClientID},
+		"request":   {signRequestObject(t, key, ts.URL, jwt.MapClaims{"resource": resources})},
+	})
+	if err != nil {
+		t.Fatalf("request object parameters: %v", err)
+	}
+	if !slices.Equal(query["resource"], resources) {
+		t.Errorf("resource: got %v, want %v", query["resource"], resources)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// DPoP
+// ---------------------------------------------------------------------------
+
+// newDPoPKey generates the key a client proves possession of.
+func newDPoPKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate ECDSA key: %v", err)
+	}
+	return key
+}
+
+// dpopProof signs a DPoP proof for a request to uri, accessToken is empty at the token endpoint.
+func dpopProof(t *testing.T, key *ecdsa.PrivateKey, method, uri, accessToken string) string {
+	t.Helper()
+	jwk, err := jwkset.NewJWKFromKey(&key.PublicKey, jwkset.JWKOptions{})
+	if err != nil {
+		t.Fatalf("create JWK: %v", err)
+	}
+	claims := jwt.MapClaims{
+		"htm": method,
+		"htu": uri,
+		"iat": time.Now().Unix(),
+		"jti": rand.Text(),
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		claims["ath"] = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["typ"] = dpopProofType
+	token.Header["jwk"] = jwk.Marshal()
+	proof, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("sign DPoP proof: %v", err)
+	}
+	return proof
+}
+
+// postTokenWithDPoP calls the token endpoint as the public test client, with the given DPoP proof.
+func postTokenWithDPoP(t *testing.T, baseURL, proof string, form url.Values) *http.Response {
+	t.Helper()
+	form.Set("client_id", testClientID)
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatalf("create token request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if proof != "" {
+		req.Header.Set("DPoP", proof)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST /token: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := resp.Body.Close(); err != nil {
+			t.Fatalf("close response body: %v", err)
+		}
+	})
+	return resp
+}
+
+// dpopTokens runs the authorization_code grant with a proof signed by key, and returns the bound tokens.
+func dpopTokens(t *testing.T, a *app, baseURL string, key *ecdsa.PrivateKey) tokenResponse {
+	t.Helper()
+	acc := insertTestAccount(t, a)
+	verifier, challenge := generatePKCE(t)
+	code := "authcode-dpop-" + rand.Text()
+	insertAuthCode(t, a, code, testClientID, acc.ID, challenge, []string{"openid", "offline_access"})
+
+	resp := postTokenWithDPoP(t, baseURL, dpopProof(t, key, http.MethodPost, baseURL+"/token", ""), url.Values{
+		"grant_type":    {"authorization_code"},
+		"redirect_uri":  {testRedirectURI},
+		"code":          {code},
+		"code_verifier": {verifier},
+	})
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		t.Fatalf("decode token response: %v", err)
+	}
+	return tr
+}
+
+// getUserInfoWithDPoP calls the UserInfo endpoint with the DPoP authorization scheme.
+func getUserInfoWithDPoP(t *testing.T, baseURL, accessToken, proof string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, baseURL+"/userinfo", nil)
+	if err != nil {
+		t.Fatalf("create userinfo request: %v", err)
+	}
+	req.Header.Set("Authorization", "DPoP "+accessToken)
+	if proof != "" {
+		req.Header.Set("DPoP", proof)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /userinfo: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := resp.Body.Close(); err != nil {
+			t.Fatalf("close response body: %v", err)
+		}
+	})
+	return resp
+}
+
+// TestJWKThumbprint checks the example of RFC 7638 Section 3.1.
+func TestJWKThumbprint(t *testing.T) {
+	got, err := jwkThumbprint(jwkset.JWKMarshal{
+		KTY: jwkset.KtyRSA,
+		N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:   "AQAB",
+		ALG: "RS256",
+		KID: "2011-04-29",
+	})
+	if err != nil {
+		t.Fatalf("compute thumbprint: %v", err)
+	}
+	if want := "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"; got != want {
+		t.Errorf("thumbprint: got %q, want %q", got, want)
+	}
+}
+
+func TestDPoP_BindsAccessToken(t *testing.T) {
+	a, ts := newTestServer(t)
+	key := newDPoPKey(t)
+
+	tr := dpopTokens(t, a, ts.URL, key)
+	if tr.TokenType != "DPoP" {
+		t.Errorf("token_type: got %q, want DPoP", tr.TokenType)
+	}
+	token, err := a.parseToken(context.Background(), tr.AccessToken)
+	if err != nil {
+		t.Fatalf("parse access token: %v", err)
+	}
+	jwk, err := jwkset.NewJWKFromKey(&key.PublicKey, jwkset.JWKOptions{})
+	if err != nil {
+		t.Fatalf("create JWK: %v", err)
+	}
+	want, err := jwkThumbprint(jwk.Marshal())
+	if err != nil {
+		t.Fatalf("compute thumbprint: %v", err)
+	}
+	if got := dpopKeyThumbprint(token); got != want {
+		t.Errorf("cnf.jkt: got %q, want %q", got, want)
+	}
+	if info := introspect(t, ts.URL, tr.AccessToken); info.TokenType != "DPoP" || info.Cnf == nil || info.Cnf.JKT != want {
+		t.Errorf("introspection: got token_type %q and cnf %v", info.TokenType, info.Cnf)
+	}
+
+	// The ID token is not an access token, it is never bound
+	idToken, err := a.parseToken(context.Background(), tr.IDToken)
+	if err != nil {
+		t.Fatalf("parse ID token: %v", err)
+	}
+	if jkt := dpopKeyThumbprint(idToken); jkt != "" {
+		t.Errorf("ID token must not be bound, got cnf.jkt %q", jkt)
+	}
+}
+
+func TestDPoP_InvalidProof(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	key := newDPoPKey(t)
+
+	cases := map[string]string{
+		"wrong method": dpopProof(t, key, http.MethodGet, ts.URL+"/token", ""),
+		"wrong URI":    dpopProof(t, key, http.MethodPost, ts.URL+"/userinfo", ""),
+		"not a JWT":    "not-a-jwt",
+	}
+	for name, proof := range cases {
+		t.Run(name, func(t *testing.T) {
+			verifier, challenge := generatePKCE(t)
+			code := "authcode-dpop-invalid-" + rand.Text()
+			insertAuthCode(t, a, code, testClientID, acc.ID, challenge, []string{"openid"})
+			resp := postTokenWithDPoP(t, ts.URL, proof, url.Values{
+				"grant_type":    {"authorization_code"},
+				"redirect_uri":  {testRedirectURI},
+				"code":          {code},
+				"code_verifier": {verifier},
+			})
+			assertOAuthError(t, resp, http.StatusBadRequest, "invalid_dpop_proof")
+		})
+	}
+}
+
+func TestDPoP_ReplayedProof(t *testing.T) {
+	a, ts := newTestServer(t)
+	key := newDPoPKey(t)
+
+	tr := dpopTokens(t, a, ts.URL, key)
+	proof := dpopProof(t, key, http.MethodPost, ts.URL+"/token", "")
+	form := func() url.Values {
+		return url.Values{"grant_type": {"refresh_token"}, "refresh_token": {tr.RefreshToken}}
+	}
+	resp := postTokenWithDPoP(t, ts.URL, proof, form())
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("first use: expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	resp = postTokenWithDPoP(t, ts.URL, proof, form())
+	assertOAuthError(t, resp, http.StatusBadRequest, "invalid_dpop_proof")
+}
+
+func TestDPoP_RefreshTokenBoundToKey(t *testing.T) {
+	a, ts := newTestServer(t)
+	key := newDPoPKey(t)
+
+	tr := dpopTokens(t, a, ts.URL, key)
+	form := func() url.Values {
+		return url.Values{"grant_type": {"refresh_token"}, "refresh_token": {tr.RefreshToken}}
+	}
+
+	resp := postTokenWithDPoP(t, ts.URL, "", form())
+	assertOAuthError(t, resp, http.StatusBadRequest, "invalid_dpop_proof")
+	resp = postTokenWithDPoP(t, ts.URL, dpopProof(t, newDPoPKey(t), http.MethodPost, ts.URL+"/token", ""), form())
+	assertOAuthError(t, resp, http.StatusBadRequest, "invalid_dpop_proof")
+
+	resp = postTokenWithDPoP(t, ts.URL, dpopProof(t, key, http.MethodPost, ts.URL+"/token", ""), form())
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	var refreshed tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&refreshed); err != nil {
+		t.Fatalf("decode token response: %v", err)
+	}
+	if refreshed.TokenType != "DPoP" {
+		t.Errorf("token_type: got %q, want DPoP", refreshed.TokenType)
+	}
+	stored, err := a.refreshStore.Get(context.Background(), hashToken(refreshed.RefreshToken))
+	if err != nil || stored == nil {
+		t.Fatalf("lookup rotated refresh token: %v", err)
+	}
+	if stored.JKT == "" {
+		t.Error("the rotated refresh token must stay bound to the DPoP key")
+	}
+}
+
+func TestDPoP_UserInfo(t *testing.T) {
+	a, ts := newTestServer(t)
+	key := newDPoPKey(t)
+	tr := dpopTokens(t, a, ts.URL, key)
+	userinfoURL := ts.URL + "/userinfo"
+
+	resp := getUserInfoWithDPoP(t, ts.URL, tr.AccessToken, dpopProof(t, key, http.MethodGet, userinfoURL, tr.AccessToken))
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	// A bound token is not a bearer token
+	if resp := getUserInfo(t, ts.URL, tr.AccessToken); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Bearer scheme: expected 401, got %d", resp.StatusCode)
+	}
+	if resp := getUserInfoWithDPoP(t, ts.URL, tr.AccessToken, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("missing proof: expected 401, got %d", resp.StatusCode)
+	}
+	resp = getUserInfoWithDPoP(t, ts.URL, tr.AccessToken, dpopProof(t, newDPoPKey(t), http.MethodGet, userinfoURL, tr.AccessToken))
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("other key: expected 401, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("WWW-Authenticate"); !strings.HasPrefix(got, "DPoP ") || !strings.Contains(got, `error="invalid_dpop_proof"`) {
+		t.Errorf("WWW-Authenticate: got %q, want a DPoP invalid_dpop_proof challenge", got)
+	}
+	resp = getUserInfoWithDPoP(t, ts.URL, tr.AccessToken, dpopProof(t, key, http.MethodGet, userinfoURL, "another-token"))
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong ath: expected 401, got %d", resp.StatusCode)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Resource indicators
+// ---------------------------------------------------------------------------
+
+// insertResourceAuthCode pre-populates the auth store with a code granting both test resources to the public client.
+func insertResourceAuthCode(t *testing.T, a *app, code, accountID, codeChallenge string) {
+	t.Helper()
+	if err := a.authStore.Put(context.Background(), auth.AuthData{
+		ClientID:            testClientID,
+		Code:                code,
+		CodeChallenge:       codeChallenge,
+		CodeChallengeMethod: "S256",
+		RedirectURI:         testRedirectURI,
+		GrantedScopes:       []string{"openid", "offline_access"},
+		Resources:           []string{testResourceIndicator, testOtherResource},
+		AccountID:           accountID,
+		AuthTime:            time.Now(),
+		ExpiresAt:           time.Now().Add(authorizationCodeTTL),
+	}); err != nil {
+		t.Fatalf("insert auth code: %v", err)
+	}
+}
+
+// accessTokenAudience decodes a successful token response and returns the audience of its access token.
+func accessTokenAudience(t *testing.T, a *app, resp *http.Response) (tokenResponse, []string) {
+	t.Helper()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		t.Fatalf("decode token response: %v", err)
+	}
+	token, err := a.parseToken(context.Background(), tr.AccessToken)
+	if err != nil {
+		t.Fatalf("parse access token: %v", err)
+	}
+	aud, err := token.Claims.GetAudience()
+	if err != nil {
+		t.Fatalf("read aud: %v", err)
+	}
+	return tr, aud
+}
+
+func TestAuthorize_ResourceNotAllowed(t *testing.T) {
+	_, ts := newTestServer(t)
+	_, challenge := generatePKCE(t)
+
+	resp, _ := startAuthorization(t, ts.URL, authorizeQuery(challenge, url.Values{"resource": {"https://unknown.example.com"}}))
+	if got := redirectParams(t, resp).Get("error"); got != "invalid_target" {
+		t.Errorf("error: got %q, want invalid_target", got)
+	}
+}
+
+func TestAuthorize_ResourcesAreGranted(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	setTestPassword(t, a, acc)
+	verifier, challenge := generatePKCE(t)
+
+	_, cookies := startAuthorization(t, ts.URL, authorizeQuery(challenge, url.Values{"resource": {testResourceIndicator, testOtherResource}}))
+	code := redirectParams(t, postLogin(t, ts.URL, cookies, acc.Email, testPassword)).Get("code")
+
+	tr := doTokenExchange(t, ts.URL, testClientID, code, verifier)
+	token, err := a.parseToken(context.Background(), tr.AccessToken)
+	if err != nil {
+		t.Fatalf("parse access token: %v", err)
+	}
+	if aud, _ := token.Claims.GetAudience(); !slices.Equal(aud, []string{testResourceIndicator, testOtherResource}) {
+		t.Errorf("aud: got %v, want both granted resources", aud)
+	}
+}
+
+func TestToken_Resource_NarrowsAudience(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	verifier, challenge := generatePKCE(t)
+	insertResourceAuthCode(t, a, "authcode-resource", acc.ID, challenge)
+
+	tr, aud := accessTokenAudience(t, a, postForm(t, ts.URL, "/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"redirect_uri":  {testRedirectURI},
+		"client_id":     {testClientID},
+		"code":          {"authcode-resource"},
+		"code_verifier": {verifier},
+		"resource":      {testOtherResource},
+	}))
+	if !slices.Equal(aud, []string{testOtherResource}) {
+		t.Errorf("aud: got %v, want %s", aud, testOtherResource)
+	}
+
+	// The refresh token keeps the whole grant, each refresh may ask for another granted resource
+	tr, aud = accessTokenAudience(t, a, postForm(t, ts.URL, "/token", url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {testClientID},
+		"refresh_token": {tr.RefreshToken},
+		"resource":      {testResourceIndicator},
+	}))
+	if !slices.Equal(aud, []string{testResourceIndicator}) {
+		t.Errorf("aud after refresh: got %v, want %s", aud, testResourceIndicator)
+	}
+
+	resp := postForm(t, ts.URL, "/token", url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {testClientID},
+		"refresh_token": {tr.RefreshToken},
+		"resource":      {testDownstreamResource},
+	})
+	assertOAuthError(t, resp, http.StatusBadRequest, "invalid_target")
+}
+
+func TestToken_Resource_NotGranted(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	verifier, challenge := generatePKCE(t)
+	code := "authcode-resource-not-granted"
+	insertAuthCode(t, a, code, testClientID, acc.ID, challenge, []string{"openid"})
+
+	// Without resources at /authorize, only the default resource indicator is granted
+	resp := postForm(t, ts.URL, "/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"redirect_uri":  {testRedirectURI},
+		"client_id":     {testClientID},
+		"code":          {code},
+		"code_verifier": {verifier},
+		"resource":      {testOtherResource},
+	})
+	assertOAuthError(t, resp, http.StatusBadRequest, "invalid_target")
+}
+
+func TestToken_ClientCredentials_ResourceNotAllowed(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	resp := clientCredentialsToken(t, ts.URL, url.Values{"resource": {"https://unknown.example.com"}})
+	assertOAuthError(t, resp, http.StatusBadRequest, "invalid_target")
+}
+
+// ---------------------------------------------------------------------------
+// JWT access tokens (RFC 9068)
+// ---------------------------------------------------------------------------
+
+// accessTokenFor runs the authorization_code grant for the public client and returns the parsed access token.
+func accessTokenFor(t *testing.T, a *app, baseURL string, scopes []string, extra url.Values) (tokenResponse, *jwt.Token) {
+	t.Helper()
+	acc := insertTestAccount(t, a)
+	verifier, challenge := generatePKCE(t)
+	code := "authcode-access-token-" + rand.Text()
+	if err := a.authStore.Put(context.Background(), auth.AuthData{
+		ClientID:            testClientID,
+		Code:                code,
+		CodeChallenge:       challenge,
+		CodeChallengeMethod: "S256",
+		RedirectURI:         testRedirectURI,
+		GrantedScopes:       scopes,
+		Resources:           []string{testResourceIndicator, testOtherResource},
+		AccountID:           acc.ID,
+		AuthTime:            time.Now(),
+		ExpiresAt:           time.Now().Add(authorizationCodeTTL),
+	}); err != nil {
+		t.Fatalf("insert auth code: %v", err)
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"redirect_uri":  {testRedirectURI},
+		"client_id":     {testClientID},
+		"code":          {code},
+		"code_verifier": {verifier},
+	}
+	maps.Copy(form, extra)
+	resp := postForm(t, baseURL, "/token", form)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		t.Fatalf("decode token response: %v", err)
+	}
+	token, err := a.parseToken(context.Background(), tr.AccessToken)
+	if err != nil {
+		t.Fatalf("parse access token: %v", err)
+	}
+	return tr, token
+}
+
+func TestAccessToken_Profile(t *testing.T) {
+	a, ts := newTestServer(t)
+
+	tr, token := accessTokenFor(t, a, ts.URL, []string{"openid", "email"}, url.Values{"resource": {testResourceIndicator}})
+	if typ, _ := token.Header["typ"].(string); typ != "at+jwt" {
+		t.Errorf("typ: got %q, want at+jwt", typ)
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	for _, claim := range []string{"iss", "exp", "aud", "sub", "client_id", "iat", "jti", "scope"} {
+		if _, ok := claims[claim]; !ok {
+			t.Errorf("access token missing claim %q", claim)
+		}
+	}
+	for _, claim := range []string{"email", "email_verified", "name", "picture", "roles", "auth_time"} {
+		if _, ok := claims[claim]; ok {
+			t.Errorf("access token must not carry the ID token claim %q", claim)
+		}
+	}
+	if scope, _ := claims["scope"].(string); scope != "openid email" {
+		t.Errorf("scope: got %q, want the granted scopes", scope)
+	}
+	if clientID, _ := claims["client_id"].(string); clientID != testClientID {
+		t.Errorf("client_id: got %q, want %q", clientID, testClientID)
+	}
+
+	// The ID token keeps the profile claims, but is not accepted as an access token
+	var idClaims jwt.MapClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(tr.IDToken, &idClaims); err != nil {
+		t.Fatalf("parse ID token: %v", err)
+	}
+	if _, ok := idClaims["email"]; !ok {
+		t.Error("ID token is missing the email claim")
+	}
+	if resp := getUserInfo(t, ts.URL, tr.IDToken); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("ID token at /userinfo: expected 401, got %d", resp.StatusCode)
+	}
+	if info := introspect(t, ts.URL, tr.IDToken); info.Active {
+		t.Error("an ID token must not be introspected as an active access token")
+	}
+}
+
+func TestAccessToken_UniqueJTI(t *testing.T) {
+	a, ts := newTestServer(t)
+
+	_, first := accessTokenFor(t, a, ts.URL, []string{"openid"}, nil)
+	_, second := accessTokenFor(t, a, ts.URL, []string{"openid"}, nil)
+	firstJTI, _ := first.Claims.(jwt.MapClaims)["jti"].(string)
+	secondJTI, _ := second.Claims.(jwt.MapClaims)["jti"].(string)
+	if firstJTI == "" || firstJTI == secondJTI {
+		t.Errorf("jti must be unique, got %q and %q", firstJTI, secondJTI)
+	}
+}
+
+func TestAccessToken_ResourceAttributes(t *testing.T) {
+	a, ts := newTestServer(t)
+	a.resourceAttributes = map[string][]string{
+		testResourceIndicator: {"email", "roles"},
+		testOtherResource:     {"roles"},
+	}
+
+	_, token := accessTokenFor(t, a, ts.URL, []string{"openid"}, url.Values{"resource": {testResourceIndicator}})
+	claims := token.Claims.(jwt.MapClaims)
+	if email, _ := claims["email"].(string); email != "test@example.com" {
+		t.Errorf("email: got %q, want the account email", email)
+	}
+	if _, ok := claims["roles"]; !ok {
+		t.Error("roles is missing")
+	}
+	if _, ok := claims["name"]; ok {
+		t.Error("name was not asked for by the resource")
+	}
+
+	// Only the attributes asked for by every audience are released
+	_, token = accessTokenFor(t, a, ts.URL, []string{"openid"}, nil)
+	claims = token.Claims.(jwt.MapClaims)
+	if _, ok := claims["email"]; ok {
+		t.Error("email must not be released to a resource that did not ask for it")
+	}
+	if _, ok := claims["roles"]; !ok {
+		t.Error("roles is missing")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Claims released by scope and the claims parameter
+// ---------------------------------------------------------------------------
+
+// idTokenClaims decodes the ID token of tr without verifying it.
+func idTokenClaims(t *testing.T, tr tokenResponse) jwt.MapClaims {
+	t.Helper()
+	var claims jwt.MapClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(tr.IDToken, &claims); err != nil {
+		t.Fatalf("ParseUnverified ID token: %v", err)
+	}
+	return claims
+}
+
+// userInfo calls the UserInfo endpoint with accessToken and decodes its claims.
+func userInfo(t *testing.T, baseURL, accessToken string) map[string]any {
+	t.Helper()
+	resp := getUserInfo(t, baseURL, accessToken)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	var claims map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		t.Fatalf("decode userinfo response: %v", err)
+	}
+	return claims
+}
+
+func TestClaims_ReleasedByScope(t *testing.T) {
+	a, ts := newTestServer(t)
+
+	tr, _ := accessTokenFor(t, a, ts.URL, []string{"openid"}, nil)
+	claims := idTokenClaims(t, tr)
+	for _, claim := range []string{"email", "email_verified", "name", "picture", "roles"} {
+		if _, ok := claims[claim]; ok {
+			t.Errorf("ID token must not contain %q without the matching scope", claim)
+		}
+	}
+
+	tr, _ = accessTokenFor(t, a, ts.URL, []string{"openid", "profile", "roles"}, nil)
+	claims = idTokenClaims(t, tr)
+	for _, claim := range []string{"name", "picture", "roles"} {
+		if _, ok := claims[claim]; !ok {
+			t.Errorf("ID token is missing %q", claim)
+		}
+	}
+	if _, ok := claims["email"]; ok {
+		t.Error("ID token must not contain email without the email scope")
+	}
+	info := userInfo(t, ts.URL, tr.AccessToken)
+	if name, _ := info["name"].(string); name != "Test User" {
+		t.Errorf("userinfo name: got %q, want Test User", name)
+	}
+	if _, ok := info["roles"]; !ok {
+		t.Error("userinfo is missing roles")
+	}
+	if _, ok := info["email"]; ok {
+		t.Error("userinfo must not contain email without the email scope")
+	}
+}
+
+func TestClaims_ClaimsParameter(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	setTestPassword(t, a, acc)
+	verifier, challenge := generatePKCE(t)
+
+	query := authorizeQuery(challenge, url.Values{
+		"scope":  {"openid"},
+		"claims": {`{"id_token": {"email": {"essential": true}, "unknown": null}, "userinfo": {"name": null}}`},
+	})
+	_, cookies := startAuthorization(t, ts.URL, query)
+	code := redirectParams(t, postLogin(t, ts.URL, cookies, acc.Email, testPassword)).Get("code")
+	tr := doTokenExchange(t, ts.URL, testClientID, code, verifier)
+
+	claims := idTokenClaims(t, tr)
+	if email, _ := claims["email"].(string); email != acc.Email {
+		t.Errorf("ID token email: got %q, want %q", email, acc.Email)
+	}
+	if _, ok := claims["name"]; ok {
+		t.Error("name was requested for the UserInfo endpoint only")
+	}
+	if _, ok := claims["unknown"]; ok {
+		t.Error("unknown claims must be ignored")
+	}
+
+	info := userInfo(t, ts.URL, tr.AccessToken)
+	if name, _ := info["name"].(string); name != acc.Name {
+		t.Errorf("userinfo name: got %q, want %q", name, acc.Name)
+	}
+	if _, ok := info["email"]; ok {
+		t.Error("email was requested for the ID token only")
+	}
+}
+
+func TestClaims_InvalidClaimsParameter(t *testing.T) {
+	_, ts := newTestServer(t)
+	_, challenge := generatePKCE(t)
+
+	resp, _ := startAuthorization(t, ts.URL, authorizeQuery(challenge, url.Values{"claims": {"not-json"}}))
+	if got := redirectParams(t, resp).Get("error"); got != "invalid_request" {
+		t.Errorf("error: got %q, want invalid_request", got)
+	}
+}
+
+func TestDiscovery_Claims(t *testing.T) {
+	a, _ := newTestServer(t)
+
+	if !a.oidcConfig.ClaimsParameterSupported {
+		t.Error("claims_parameter_supported must be true")
+	}
+	for _, scope := range []string{"profile", "email", "roles"} {
+		if !slices.Contains(a.oidcConfig.ScopesSupported, scope) {
+			t.Errorf("scopes_supported is missing %q", scope)
+		}
+	}
+}
+
+// usePairwiseSubjects switches the public test client to pairwise subject identifiers.
+func usePairwiseSubjects(t *testing.T, a *app) {
+	t.Helper()
+	updateTestClient(t, a, testClientID, func(c *client) { c.SubjectType = subjectTypePairwise })
+}
+
+func TestPairwise_SubjectIsConsistent(t *testing.T) {
+	a, ts := newTestServer(t)
+	usePairwiseSubjects(t, a)
+
+	tr, accessToken := accessTokenFor(t, a, ts.URL, []string{"openid", "profile"}, nil)
+	sub, _ := accessToken.Claims.GetSubject()
+	if sub == "" || sub == "test-account-id" {
+		t.Fatalf("access token sub must be pairwise, got %q", sub)
+	}
+	if got, _ := idTokenClaims(t, tr).GetSubject(); got != sub {
+		t.Errorf("ID token sub: got %q, want %q", got, sub)
+	}
+	info := userInfo(t, ts.URL, tr.AccessToken)
+	if got, _ := info["sub"].(string); got != sub {
+		t.Errorf("userinfo sub: got %q, want %q", got, sub)
+	}
+	if name, _ := info["name"].(string); name != "Test User" {
+		t.Errorf("userinfo name: got %q, want Test User", name)
+	}
+	if ir := introspect(t, ts.URL, tr.AccessToken); !ir.Active || ir.Sub != sub {
+		t.Errorf("introspection: got active=%v sub=%q, want an active token of %q", ir.Active, ir.Sub, sub)
+	}
+
+	// The same account gets the same subject again
+	_, again := accessTokenFor(t, a, ts.URL, []string{"openid"}, nil)
+	if got, _ := again.Claims.GetSubject(); got != sub {
+		t.Errorf("second access token sub: got %q, want %q", got, sub)
+	}
+}
+
+func TestPairwise_ConcurrentTokens(t *testing.T) {
+	a, _ := newTestServer(t)
+	usePairwiseSubjects(t, a)
+	c, err := a.getClient(context.Background(), testClientID)
+	if err != nil || c == nil {
+		t.Fatalf("get client: %v", err)
+	}
+
+	const tokens = 20
+	subjects := make(chan string, tokens)
+	var wg sync.WaitGroup
+	for range tokens {
+		wg.Go(func() {
+			sub, err := a.subjectFor(context.Background(), c, "test-account-id")
+			if err != nil {
+				t.Errorf("subject: %v", err)
+				return
+			}
+			subjects <- sub
+		})
+	}
+	wg.Wait()
+	close(subjects)
+
+	for sub := range subjects {
+		accountID, err := a.accountIDForSubject(context.Background(), sub)
+		if err != nil || accountID != "test-account-id" {
+			t.Errorf("account of %q: got %q, %v", sub, accountID, err)
+		}
+	}
+}
+
+func TestPairwise_SectorsDiffer(t *testing.T) {
+	a, _ := newTestServer(t)
+	ctx := context.Background()
+
+	public, err := a.getClient(ctx, testConfidentialClientID)
+	if err != nil || public == nil {
+		t.Fatalf("get client: %v", err)
+	}
+	sectorA := client{ClientID: "a", SubjectType: subjectTypePairwise, SectorIdentifier: "a.example.com"}
+	sectorB := client{ClientID: "b", SubjectType: subjectTypePairwise, RedirectURIs: []string{"https://b.example.com/callback"}}
+
+	subs := map[string]bool{}
+	for _, c := range []*client{public, &sectorA, &sectorB} {
+		sub, err := a.subjectFor(ctx, c, "test-account-id")
+		if err != nil {
+			t.Fatalf("subjectFor %s: %v", c.ClientID, err)
+		}
+		subs[sub] = true
+		accountID, err := a.accountIDForSubject(ctx, sub)
+		if err != nil || accountID != "test-account-id" {
+			t.Errorf("subject %q of %s maps to %q (%v), want test-account-id", sub, c.ClientID, accountID, err)
+		}
+	}
+	if !subs["test-account-id"] || len(subs) != 3 {
+		t.Errorf("expected the account ID and two distinct pairwise subjects, got %v", subs)
+	}
+
+	ambiguous := client{SubjectType: subjectTypePairwise, RedirectURIs: []string{"https://a.example.com/cb", "https://b.example.com/cb"}}
+	if _, err := ambiguous.sectorIdentifier(); err == nil {
+		t.Error("redirect URIs with several hosts require a sector identifier")
+	}
+}
+
+func TestPairwise_DeleteMyAccount(t *testing.T) {
+	a, ts := newTestServer(t)
+	usePairwiseSubjects(t, a)
+
+	tr, _ := accessTokenFor(t, a, ts.URL, []string{"openid"}, nil)
+	req := httptest.NewRequest(http.MethodDelete, "/accounts/me", nil)
+	req.Header.Set("Authorization", "Bearer "+tr.AccessToken)
+	rec := httptest.NewRecorder()
+	a.handleDeleteMyAccount(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+
+	acc, err := a.accountStore.GetById(context.Background(), "test-account-id")
+	if err != nil || acc != nil {
+		t.Errorf("account must be deleted, got %v (%v)", acc, err)
+	}
+}
+
+func TestDiscovery_SubjectTypes(t *testing.T) {
+	a, _ := newTestServer(t)
+
+	if !slices.Contains(a.oidcConfig.SubjectTypesSupported, "pairwise") {
+		t.Errorf("subject_types_supported: got %v, want pairwise", a.oidcConfig.SubjectTypesSupported)
+	}
+}
+
+const testInitialAccessToken = "test-initial-access-token"
+
+// sendRegistration sends a registration request with a JSON body, authenticated with the bearer token.
+func sendRegistration(t *testing.T, method, uri, token string, body any) *http.Response {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("marshal registration request: %v", err)
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, uri, reader)
+	if err != nil {
+		t.Fatalf("create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, uri, err)
+	}
+	t.Cleanup(func() {
+		if err := resp.Body.Close(); err != nil {
+			t.Fatalf("close response body: %v", err)
+		}
+	})
+	return resp
+}
+
+// registerClient registers a client with metadata and decodes the client information response.
+func registerClient(t *testing.T, a *app, baseURL string, metadata map[string]any) registrationResponse {
+	t.Helper()
+	a.initialAccessToken = testInitialAccessToken
+	resp := sendRegistration(t, http.MethodPost, baseURL+"/register", testInitialAccessToken, metadata)
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected 201, got %d: %s", resp.StatusCode, body)
+	}
+	var registered registrationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&registered); err != nil {
+		t.Fatalf("decode registration response: %v", err)
+	}
+	return registered
+}
+
+func TestRegister_InitialAccessTokenRequired(t *testing.T) {
+	a, ts := newTestServer(t)
+	metadata := map[string]any{"redirect_uris": []string{"https://app.example.com/callback"}}
+
+	// Registration is disabled until an initial access token is configured
+	if resp := sendRegistration(t, http.MethodPost, ts.URL+"/register", "", metadata); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 without an initial access token, got %d", resp.StatusCode)
+	}
+
+	a.initialAccessToken = testInitialAccessToken
+	resp := sendRegistration(t, http.MethodPost, ts.URL+"/register", "wrong-token", metadata)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("WWW-Authenticate"); !strings.Contains(got, "invalid_token") {
+		t.Errorf("WWW-Authenticate: got %q, want an invalid_token error", got)
+	}
+}
+
+func TestRegister_ConfidentialClient(t *testing.T) {
+	a, ts := newTestServer(t)
+
+	registered := registerClient(t, a, ts.URL, map[string]any{
+		"redirect_uris": []string{"https://app.example.com/callback"},
+		"client_name":   "Example App",
+	})
+	if registered.ClientID == "" || registered.ClientSecret == "" || registered.RegistrationAccessToken == "" {
+		t.Fatalf("expected a client_id, a client_secret and a registration access token, got %+v", registered)
+	}
+	if registered.TokenEndpointAuthMethod != "client_secret_basic" {
+		t.Errorf("token_endpoint_auth_method: got %q, want client_secret_basic", registered.TokenEndpointAuthMethod)
+	}
+	if registered.RegistrationClientURI != ts.URL+"/register/"+registered.ClientID {
+		t.Errorf("registration_client_uri: got %q", registered.RegistrationClientURI)
+	}
+
+	c, err := a.getClient(context.Background(), registered.ClientID)
+	if err != nil || c == nil {
+		t.Fatalf("registered client not found: %v", err)
+	}
+	if c.Type != clientTypeConfidential || c.Name != "Example App" {
+		t.Errorf("registered client: got type %q and name %q", c.Type, c.Name)
+	}
+
+	// The client authenticates, but only with the registered method, and only uses the registered grant types
+	resp := postFormBasicAuth(t, ts.URL, "/token", registered.ClientID, registered.ClientSecret, url.Values{"grant_type": {"client_credentials"}})
+	assertOAuthError(t, resp, http.StatusBadRequest, "unauthorized_client")
+	resp = postForm(t, ts.URL, "/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"redirect_uri":  {testRedirectURI},
+		"client_id":     {registered.ClientID},
+		"client_secret": {registered.ClientSecret},
+		"code":          {"unknown-code"},
+	})
+	assertOAuthError(t, resp, http.StatusUnauthorized, "invalid_client")
+}
+
+func TestRegister_InvalidMetadata(t *testing.T) {
+	a, ts := newTestServer(t)
+	a.initialAccessToken = testInitialAccessToken
+
+	tests := []struct {
+		name     string
+		metadata map[string]any
+		code     string
+	}{
+		{"missing redirect_uris", map[string]any{}, "invalid_redirect_uri"},
+		{"redirect URI with a fragment", map[string]any{"redirect_uris": []string{"https://app.example.com/cb#frag"}}, "invalid_redirect_uri"},
+		{"http redirect URI", map[string]any{"redirect_uris": []string{"http://app.example.com/cb"}}, "invalid_redirect_uri"},
+		{"javascript redirect URI", map[string]any{"redirect_uris": []string{"javascript:alert(1)"}}, "invalid_redirect_uri"},
+		{"unsupported grant type", map[string]any{"grant_types": []string{"password"}}, "invalid_client_metadata"},
+		{"client_credentials client", map[string]any{"grant_types": []string{"client_credentials"}}, "invalid_client_metadata"},
+		{"token exchange client", map[string]any{"grant_types": []string{tokenExchangeGrantType}}, "invalid_client_metadata"},
+		{"unsupported auth method", map[string]any{"redirect_uris": []string{"https://app.example.com/cb"}, "token_endpoint_auth_method": "tls_client_auth"}, "invalid_client_metadata"},
+		{"private_key_jwt without keys", map[string]any{"redirect_uris": []string{"https://app.example.com/cb"}, "token_endpoint_auth_method": "private_key_jwt"}, "invalid_client_metadata"},
+		{"implicit response type", map[string]any{"redirect_uris": []string{"https://app.example.com/cb"}, "response_types": []string{"token"}}, "invalid_client_metadata"},
+		{"jwks_uri on the loopback interface", map[string]any{"redirect_uris": []string{"https://app.example.com/cb"}, "token_endpoint_auth_method": "private_key_jwt", "jwks_uri": "https://127.0.0.1/jwks"}, "invalid_client_metadata"},
+		{"jwks_uri on a private network", map[string]any{"redirect_uris": []string{"https://app.example.com/cb"}, "token_endpoint_auth_method": "private_key_jwt", "jwks_uri": "https://10.0.0.1/jwks"}, "invalid_client_metadata"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := sendRegistration(t, http.MethodPost, ts.URL+"/register", testInitialAccessToken, tt.metadata)
+			assertOAuthError(t, resp, http.StatusBadRequest, tt.code)
+		})
+	}
+}
+
+func TestRegister_Management(t *testing.T) {
+	a, ts := newTestServer(t)
+
+	registered := registerClient(t, a, ts.URL, map[string]any{
+		"redirect_uris":              []string{"http://127.0.0.1:8080/callback"},
+		"token_endpoint_auth_method": "none",
+	})
+	if registered.ClientSecret != "" {
+		t.Error("a public client must not get a client secret")
+	}
+	uri := registered.RegistrationClientURI
+	token := registered.RegistrationAccessToken
+
+	resp := sendRegistration(t, http.MethodGet, uri, token, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("read: expected 200, got %d", resp.StatusCode)
+	}
+	if resp := sendRegistration(t, http.MethodGet, uri, "wrong-token", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("read with a wrong token: expected 401, got %d", resp.StatusCode)
+	}
+	// Clients configured from the environment cannot be managed
+	if resp := sendRegistration(t, http.MethodGet, ts.URL+"/register/"+testClientID, token, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("read of a configured client: expected 401, got %d", resp.StatusCode)
+	}
+
+	resp = sendRegistration(t, http.MethodPut, uri, token, map[string]any{
+		"client_id":                  registered.ClientID,
+		"redirect_uris":              []string{"https://app.example.com/callback"},
+		"token_endpoint_auth_method": "none",
+	})
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("update: expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	c, err := a.getClient(context.Background(), registered.ClientID)
+	if err != nil || c == nil || !slices.Equal(c.RedirectURIs, []string{"https://app.example.com/callback"}) {
+		t.Errorf("update: got client %+v (%v)", c, err)
+	}
+
+	resp = sendRegistration(t, http.MethodPut, uri, token, map[string]any{"client_id": "another-client"})
+	assertOAuthError(t, resp, http.StatusBadRequest, "invalid_request")
+
+	if resp := sendRegistration(t, http.MethodDelete, uri, token, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: expected 204, got %d", resp.StatusCode)
+	}
+	if resp := sendRegistration(t, http.MethodGet, uri, token, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("read after delete: expected 401, got %d", resp.StatusCode)
+	}
+}
+
+// refreshWith redeems rawToken at the token endpoint as the public test client.
+func refreshWith(t *testing.T, baseURL, rawToken string) *http.Response {
+	t.Helper()
+	return postForm(t, baseURL, "/token", url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {testClientID},
+		"refresh_token": {rawToken},
+	})
+}
+
+func TestToken_Refresh_ReuseRevokesFamily(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	rawToken := "raw-refresh-token-reuse"
+	insertRefreshToken(t, a, rawToken, testClientID, acc.ID)
+
+	resp := refreshWith(t, ts.URL, rawToken)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("first refresh: expected 200, got %d", resp.StatusCode)
+	}
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		t.Fatalf("decode token response: %v", err)
+	}
+	resp = refreshWith(t, ts.URL, tr.RefreshToken)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("second refresh: expected 200, got %d", resp.StatusCode)
+	}
+	var latest tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&latest); err != nil {
+		t.Fatalf("decode token response: %v", err)
+	}
+
+	// Replaying the first token revokes every token of the family, including the latest one
+	assertOAuthError(t, refreshWith(t, ts.URL, rawToken), http.StatusBadRequest, "invalid_grant")
+	for _, token := range []string{rawToken, tr.RefreshToken, latest.RefreshToken} {
+		if stored, _ := a.refreshStore.Get(context.Background(), hashToken(token)); stored != nil {
+			t.Errorf("refresh token of the family was not revoked: %+v", stored)
+		}
+	}
+	assertOAuthError(t, refreshWith(t, ts.URL, latest.RefreshToken), http.StatusBadRequest, "invalid_grant")
+}
+
+func TestToken_Refresh_ConcurrentRotation(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	rawToken := "raw-refresh-token-concurrent"
+	insertRefreshToken(t, a, rawToken, testClientID, acc.ID)
+
+	const rotations = 5
+	statuses := make(chan int, rotations)
+	var wg sync.WaitGroup
+	for range rotations {
+		wg.Go(func() {
+			resp, err := http.PostForm(ts.URL+"/token", url.Values{
+				"grant_type":    {"refresh_token"},
+				"client_id":     {testClientID},
+				"refresh_token": {rawToken},
+			})
+			if err != nil {
+				t.Errorf("POST /token: %v", err)
+				return
+			}
+			_ = resp.Body.Close()
+			statuses <- resp.StatusCode
+		})
+	}
+	wg.Wait()
+	close(statuses)
+
+	succeeded := 0
+	for status := range statuses {
+		if status == http.StatusOK {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("expected exactly one successful rotation, got %d", succeeded)
+	}
+}
+
+func TestIntrospect_ConsumedRefreshToken(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	rawToken := "raw-refresh-token-consumed"
+	insertRefreshToken(t, a, rawToken, testClientID, acc.ID)
+
+	if resp := refreshWith(t, ts.URL, rawToken); resp.StatusCode != http.StatusOK {
+		t.Fatalf("refresh: expected 200, got %d", resp.StatusCode)
+	}
+	if ir := introspect(t, ts.URL, rawToken); ir.Active {
+		t.Error("a consumed refresh token must be inactive")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Consent
+// ---------------------------------------------------------------------------
+
+const testThirdPartyClientID = "test-third-party-client"
+
+// putThirdPartyClient registers a public client that is not first-party, so the end-user is asked for consent.
+func putThirdPartyClient(t *testing.T, a *app) {
+	t.Helper()
+	putTestClient(t, a, client{
+		ClientID:                 testThirdPartyClientID,
+		Type:                     clientTypePublic,
+		Name:                     "Third Party App",
+		RedirectURIs:             []string{testRedirectURI},
+		DefaultResourceIndicator: testResourceIndicator,
+	})
+}
+
+// postConsent submits the consent page with the cookies set when it was shown.
+func postConsent(t *testing.T, baseURL string, cookies []*http.Cookie, action string) *http.Response {
+	t.Helper()
+	form := url.Values{"action": {action}}
+	for _, c := range cookies {
+		if c.Name == "csrf_token" {
+			form.Set("csrf_token", c.Value)
+		}
+	}
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/consent", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatalf("create consent request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		req.AddCookie(&http.Cookie{Name: c.Name, Value: c.Value})
+	}
+	resp, err := noRedirectClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST /consent: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := resp.Body.Close(); err != nil {
+			t.Fatalf("close response body: %v", err)
+		}
+	})
+	return resp
+}
+
+// consentPage signs in to the third-party client with scope and returns the consent page and its cookies.
+func consentPage(t *testing.T, a *app, baseURL, scope string) (*http.Response, []*http.Cookie) {
+	t.Helper()
+	acc := insertTestAccount(t, a)
+	setTestPassword(t, a, acc)
+	_, challenge := generatePKCE(t)
+
+	query := authorizeQuery(challenge, url.Values{"client_id": {testThirdPartyClientID}, "scope": {scope}})
+	_, cookies := startAuthorization(t, baseURL, query)
+	resp := postLogin(t, baseURL, cookies, acc.Email, testPassword)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the consent page (200), got %d", resp.StatusCode)
+	}
+	return resp, resp.Cookies()
+}
+
+func TestConsent_ApprovalIsRemembered(t *testing.T) {
+	a, ts := newTestServer(t)
+	putThirdPartyClient(t, a)
+
+	resp, cookies := consentPage(t, a, ts.URL, "openid email")
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "Third Party App") || !strings.Contains(string(body), html.EscapeString(scopeDescriptions["email"])) {
+		t.Errorf("consent page does not show the client and the requested scopes: %s", body)
+	}
+	params := redirectParams(t, postConsent(t, ts.URL, cookies, "approve"))
+	if params.Get("code") == "" || params.Get("state") != "test-state" {
+		t.Fatalf("expected a code and the state, got %v", params)
+	}
+
+	stored, err := a.consentStore.Get(context.Background(), "test-account-id", testThirdPartyClientID)
+	if err != nil || stored == nil {
+		t.Fatalf("consent was not stored: %v", err)
+	}
+	if !slices.Equal(stored.Scopes, []string{"openid", "email"}) {
+		t.Errorf("approved scopes: got %v, want [openid email]", stored.Scopes)
+	}
+
+	// The same scopes are granted silently on the next authorization
+	var sessCookie *http.Cookie
+	for _, c := range cookies {
+		if c.Name == "__Host-session" {
+			sessCookie = c
+		}
+	}
+	_, challenge := generatePKCE(t)
+	query := authorizeQuery(challenge, url.Values{"client_id": {testThirdPartyClientID}, "prompt": {"none"}})
+	resp, _ = startAuthorization(t, ts.URL, query, sessCookie)
+	if params := redirectParams(t, resp); params.Get("code") == "" {
+		t.Errorf("expected a code without consent, got error %q", params.Get("error"))
+	}
+}
+
+func TestConsent_NewScopesAreAsked(t *testing.T) {
+	a, ts := newTestServer(t)
+	putThirdPartyClient(t, a)
+	if err := a.consentStore.Put(context.Background(), consent.Data{
+		AccountID: "test-account-id",
+		ClientID:  testThirdPartyClientID,
+		Scopes:    []string{"openid", "email"},
+	}); err != nil {
+		t.Fatalf("insert consent: %v", err)
+	}
+
+	resp, cookies := consentPage(t, a, ts.URL, "openid email offline_access")
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), html.EscapeString(scopeDescriptions["offline_access"])) {
+		t.Error("consent page does not show the new scope")
+	}
+	if strings.Contains(string(body), html.EscapeString(scopeDescriptions["email"])) {
+		t.Error("consent page shows a scope that was already approved")
+	}
+	redirectParams(t, postConsent(t, ts.URL, cookies, "approve"))
+
+	stored, _ := a.consentStore.Get(context.Background(), "test-account-id", testThirdPartyClientID)
+	if stored == nil || !slices.Equal(stored.Scopes, []string{"openid", "email", "offline_access"}) {
+		t.Errorf("approved scopes: got %+v, want [openid email offline_access]", stored)
+	}
+}
+
+func TestConsent_RequestedClaims(t *testing.T) {
+	a, ts := newTestServer(t)
+	putThirdPartyClient(t, a)
+	acc := insertTestAccount(t, a)
+	setTestPassword(t, a, acc)
+	if err := a.consentStore.Put(context.Background(), consent.Data{
+		AccountID: acc.ID,
+		ClientID:  testThirdPartyClientID,
+		Scopes:    []string{"openid"},
+	}); err != nil {
+		t.Fatalf("insert consent: %v", err)
+	}
+
+	// The claims parameter asks for claims that the approved scopes do not release
+	_, challenge := generatePKCE(t)
+	query := authorizeQuery(challenge, url.Values{
+		"client_id": {testThirdPartyClientID},
+		"scope":     {"openid"},
+		"claims":    {`{"userinfo":{"email":null},"id_token":{"roles":null}}`},
+	})
+	_, cookies := startAuthorization(t, ts.URL, query)
+	resp := postLogin(t, ts.URL, cookies, acc.Email, testPassword)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the consent page (200), got %d", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	for _, claim := range []string{"email", "roles"} {
+		if !strings.Contains(string(body), html.EscapeString(claimDescriptions[claim])) {
+			t.Errorf("consent page does not show the requested claim %s", claim)
+		}
+	}
+	cookies = resp.Cookies()
+	redirectParams(t, postConsent(t, ts.URL, cookies, "approve"))
+
+	stored, _ := a.consentStore.Get(context.Background(), acc.ID, testThirdPartyClientID)
+	if stored == nil || !slices.Equal(stored.Claims, []string{"email", "roles"}) {
+		t.Errorf("approved claims: got %+v, want [email roles]", stored)
+	}
+
+	// The approved claims are released silently on the next authorization
+	var sessCookie *http.Cookie
+	for _, c := range cookies {
+		if c.Name == "__Host-session" {
+			sessCookie = c
+		}
+	}
+	query.Set("prompt", "none")
+	resp, _ = startAuthorization(t, ts.URL, query, sessCookie)
+	if params := redirectParams(t, resp); params.Get("code") == "" {
+		t.Errorf("expected a code without consent, got error %q", params.Get("error"))
+	}
+}
+
+func TestConsent_Denied(t *testing.T) {
+	a, ts := newTestServer(t)
+	putThirdPartyClient(t, a)
+
+	_, cookies := consentPage(t, a, ts.URL, "openid roles")
+	params := redirectParams(t, postConsent(t, ts.URL, cookies, "deny"))
+	if got := params.Get("error"); got != "access_denied" {
+		t.Errorf("error: got %q, want access_denied", got)
+	}
+	if stored, _ := a.consentStore.Get(context.Background(), "test-account-id", testThirdPartyClientID); stored != nil {
+		t.Errorf("a denied consent must not be stored: %+v", stored)
+	}
+}
+
+func TestConsent_WithoutSession(t *testing.T) {
+	a, ts := newTestServer(t)
+	putThirdPartyClient(t, a)
+
+	_, cookies := consentPage(t, a, ts.URL, "openid")
+	var withoutSession []*http.Cookie
+	for _, c := range cookies {
+		if c.Name != "__Host-session" {
+			withoutSession = append(withoutSession, c)
+		}
+	}
+	if resp := postConsent(t, ts.URL, withoutSession, "approve"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", resp.StatusCode)
+	}
+}
+
+func TestConsent_PromptNone(t *testing.T) {
+	a, ts := newTestServer(t)
+	putThirdPartyClient(t, a)
+	acc := insertTestAccount(t, a)
+	setTestPassword(t, a, acc)
+	_, challenge := generatePKCE(t)
+
+	_, cookies := startAuthorization(t, ts.URL, authorizeQuery(challenge, nil))
+	sessCookie := sessionCookie(t, postLogin(t, ts.URL, cookies, acc.Email, testPassword))
+
+	query := authorizeQuery(challenge, url.Values{"client_id": {testThirdPartyClientID}, "prompt": {"none"}})
+	resp, _ := startAuthorization(t, ts.URL, query, sessCookie)
+	if got := redirectParams(t, resp).Get("error"); got != "consent_required" {
+		t.Errorf("error: got %q, want consent_required", got)
+	}
+}
+
+func TestConsent_FirstPartyClient(t *testing.T) {
+	a, ts := newTestServer(t)
+	acc := insertTestAccount(t, a)
+	setTestPassword(t, a, acc)
+	_, challenge := generatePKCE(t)
+
+	_, cookies := startAuthorization(t, ts.URL, authorizeQuery(challenge, nil))
+	sessCookie := sessionCookie(t, postLogin(t, ts.URL, cookies, acc.Email, testPassword))
+
+	// prompt=consent shows the consent page even for a first-party client
+	resp, _ := startAuthorization(t, ts.URL, authorizeQuery(challenge, url.Values{"prompt": {"consent"}}), sessCookie)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("prompt=consent: expected the consent page (200), got %d", resp.StatusCode)
+	}
+	if stored, _ := a.consentStore.Get(context.Background(), acc.ID, testClientID); stored != nil {
+		t.Errorf("no consent is stored for a first-party client: %+v", stored)
+	}
 }
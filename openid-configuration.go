@@ -7,52 +7,79 @@ import (
 )
 
 type openIDConfiguration struct {
-	Issuer                           string   `json:"issuer"`
-	AuthorizationEndpoint            string   `json:"authorization_endpoint"`
-	TokenEndpoint                    string   `json:"token_endpoint"`
-	UserinfoEndpoint                 string   `json:"userinfo_endpoint"`
-	JwksURI                          string   `json:"jwks_uri"`
-	ScopesSupported                  []string `json:"scopes_supported"`
-	ResponseTypesSupported           []string `json:"response_types_supported"`
-	ResponseModesSupported           []string `json:"response_modes_supported"`
-	GrantTypesSupported              []string `json:"grant_types_supported"`
-	SubjectTypesSupported            []string `json:"subject_types_supported"`
-	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
-	ClaimsSupported                  []string `json:"claims_supported"`
+	Issuer                                     string   `json:"issuer"`
+	AuthorizationEndpoint                      string   `json:"authorization_endpoint"`
+	TokenEndpoint                              string   `json:"token_endpoint"`
+	UserinfoEndpoint                           string   `json:"userinfo_endpoint"`
+	RevocationEndpoint                         string   `json:"revocation_endpoint"`
+	IntrospectionEndpoint                      string   `json:"introspection_endpoint"`
+	EndSessionEndpoint                         string   `json:"end_session_endpoint"`
+	DeviceAuthorizationEndpoint                string   `json:"device_authorization_endpoint"`
+	PushedAuthorizationRequestEndpoint         string   `json:"pushed_authorization_request_endpoint"`
+	RegistrationEndpoint                       string   `json:"registration_endpoint,omitempty"` // Only when registration is enabled
+	JwksURI                                    string   `json:"jwks_uri"`
+	ScopesSupported                            []string `json:"scopes_supported"`
+	ResponseTypesSupported                     []string `json:"response_types_supported"`
+	ResponseModesSupported                     []string `json:"response_modes_supported"`
+	GrantTypesSupported                        []string `json:"grant_types_supported"`
+	SubjectTypesSupported                      []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported           []string `json:"id_token_signing_alg_values_supported"`
+	ClaimsSupported                            []string `json:"claims_supported"`
+	CodeChallengeMethodsSupported              []string `json:"code_challenge_methods_supported"`
+	TokenEndpointAuthMethodsSupported          []string `json:"token_endpoint_auth_methods_supported"`
+	TokenEndpointAuthSigningAlgValuesSupported []string `json:"token_endpoint_auth_signing_alg_values_supported"`
+	RequestParameterSupported                  bool     `json:"request_parameter_supported"`
+	RequestURIParameterSupported               bool     `json:"request_uri_parameter_supported"` // Only request URIs of pushed authorization requests
+	RequestObjectSigningAlgValuesSupported     []string `json:"request_object_signing_alg_values_supported"`
+	ClaimsParameterSupported                   bool     `json:"claims_parameter_supported"`
+	DPoPSigningAlgValuesSupported              []string `json:"dpop_signing_alg_values_supported"`
 }
 
 func (a *app) handleOpenIDConfiguration(w http.ResponseWriter, req *http.Request) {
+	// Clients cannot register without an initial access token, the endpoint is not advertised then
+	if a.initialAccessToken == "" {
+		config := *a.oidcConfig
+		config.RegistrationEndpoint = ""
+		server.RenderJSON(w, config)
+		return
+	}
 	server.RenderJSON(w, a.oidcConfig)
 }
 
 func newOpenIDConfiguration(issuer string, baseURL string) *openIDConfiguration {
 	return &openIDConfiguration{
-		Issuer:                issuer,
-		AuthorizationEndpoint: baseURL + "/authorize",
-		TokenEndpoint:         baseURL + "/token",
-		UserinfoEndpoint:      baseURL + "/userinfo",
-		JwksURI:               baseURL + "/.well-known/jwks.json",
+		Issuer:                             issuer,
+		AuthorizationEndpoint:              baseURL + "/authorize",
+		TokenEndpoint:                      baseURL + "/token",
+		UserinfoEndpoint:                   baseURL + "/userinfo",
+		RevocationEndpoint:                 baseURL + "/revoke",
+		IntrospectionEndpoint:              baseURL + "/introspect",
+		EndSessionEndpoint:                 baseURL + "/logout",
+		DeviceAuthorizationEndpoint:        baseURL + "/device_authorization",
+		PushedAuthorizationRequestEndpoint: baseURL + "/par",
+		RegistrationEndpoint:               baseURL + "/register",
+		JwksURI:                            baseURL + "/.well-known/jwks.json",
 		ScopesSupported: []string{
 			"openid",
+			"profile",
 			"email",
+			"roles",
 			"offline_access",
 		},
-		ResponseTypesSupported: []string{
-			"code",
-			"id_token",
-			"id_token token",
-		},
-		ResponseModesSupported: []string{
-			"query",
-			"fragment",
-		},
-		GrantTypesSupported: []string{
-			"authorization_code",
-			"refresh_token",
-			"implicit",
-		},
+		ResponseTypesSupported:                     supportedResponseTypes,
+		ResponseModesSupported:                     supportedResponseModes,
+		GrantTypesSupported:                        supportedGrantTypes,
+		CodeChallengeMethodsSupported:              supportedCodeChallengeMethods,
+		TokenEndpointAuthMethodsSupported:          supportedTokenEndpointAuthMethods,
+		TokenEndpointAuthSigningAlgValuesSupported: supportedClientSigningAlgs,
+		RequestParameterSupported:                  true,
+		RequestURIParameterSupported:               false,
+		RequestObjectSigningAlgValuesSupported:     supportedClientSigningAlgs,
+		ClaimsParameterSupported:                   true,
+		DPoPSigningAlgValuesSupported:              supportedClientSigningAlgs,
 		SubjectTypesSupported: []string{
-			"public", // TODO switch to "pairwise" for better privacy
+			string(subjectTypePublic),
+			string(subjectTypePairwise),
 		},
 		IDTokenSigningAlgValuesSupported: []string{
 			"RS256",
@@ -65,6 +92,7 @@ func newOpenIDConfiguration(issuer string, baseURL string) *openIDConfiguration
 			"iat",
 			"nbf",
 			"auth_time",
+			"nonce",
 			"email",
 			"email_verified",
 			"name",
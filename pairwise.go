@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/url"
+
+	"github.com/simonhege/nestor/subject"
+)
+
+// subjectType is the OIDC subject identifier type of a client (OIDC Core Section 8).
+type subjectType string
+
+const (
+	subjectTypePublic   subjectType = "public"   // The account ID, the same for every client
+	subjectTypePairwise subjectType = "pairwise" // Derived from the sector identifier, clients of different sectors cannot correlate accounts
+)
+
+// sectorIdentifier returns the sector identifier pairwise subjects of the client are derived from,
+// the configured one or else the host of its redirect URIs, which must then be unique (OIDC Core Section 8.1).
+func (c *client) sectorIdentifier() (string, error) {
+	if c.SectorIdentifier != "" {
+		return c.SectorIdentifier, nil
+	}
+	host := ""
+	for _, redirectURI := range c.RedirectURIs {
+		if redirectURI == "" {
+			continue
+		}
+		u, err := url.Parse(redirectURI)
+		if err != nil {
+			return "", fmt.Errorf("invalid redirect URI %q: %w", redirectURI, err)
+		}
+		if host != "" && u.Host != host {
+			return "", fmt.Errorf("redirect URIs have several hosts, a sector identifier is required")
+		}
+		host = u.Host
+	}
+	if host == "" {
+		return "", fmt.Errorf("no redirect URI host, a sector identifier is required")
+	}
+	return host, nil
+}
+
+// subjectFor returns the sub of the account in the tokens issued to client.
+// A pairwise subject is an HMAC of the sector identifier and the account ID, it is recorded to map it back to the account.
+func (a *app) subjectFor(ctx context.Context, client *client, accountID string) (string, error) {
+	if client == nil || client.SubjectType != subjectTypePairwise {
+		return accountID, nil
+	}
+	sector, err := client.sectorIdentifier()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, a.pairwiseSecret)
+	mac.Write([]byte(sector))
+	mac.Write([]byte{0})
+	mac.Write([]byte(accountID))
+	sub := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+	// The subject is derived again for each token, it only has to be stored the first time
+	stored, err := a.subjectStore.Get(ctx, sub)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to retrieve pairwise subject", "client_id", client.ClientID, "error", err)
+		return "", err
+	}
+	if stored != nil {
+		return sub, nil
+	}
+	if err := a.subjectStore.Put(ctx, subject.Data{Subject: sub, SectorIdentifier: sector, AccountID: accountID}); err != nil {
+		slog.ErrorContext(ctx, "Failed to persist pairwise subject", "client_id", client.ClientID, "error", err)
+		return "", err
+	}
+	return sub, nil
+}
+
+// accountIDForSubject returns the ID of the account identified by sub, a pairwise or a public subject.
+func (a *app) accountIDForSubject(ctx context.Context, sub string) (string, error) {
+	data, err := a.subjectStore.Get(ctx, sub)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to retrieve pairwise subject", "sub", sub, "error", err)
+		return "", err
+	}
+	if data == nil {
+		return sub, nil
+	}
+	return data.AccountID, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/simonhege/nestor/par"
+)
+
+const (
+	requestURIPrefix = "urn:ietf:params:oauth:request_uri:"
+	requestURITTL    = 90 * time.Second
+)
+
+type pushedAuthorizationResponse struct {
+	RequestURI string `json:"request_uri"`
+	ExpiresIn  int    `json:"expires_in"`
+}
+
+// handlePushedAuthorizationRequest implements the pushed authorization request endpoint (RFC 9126).
+// The client authenticates as at the token endpoint, and gets a request_uri to use at /authorize.
+func (a *app) handlePushedAuthorizationRequest(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	client, err := a.authenticateClient(req)
+	if err != nil {
+		var oauthErr *oauthError
+		if errors.As(err, &oauthErr) {
+			writeOAuthError(w, req, oauthErr)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	clientID := client.ClientID
+
+	if err := validatePushedParameters(client, req.PostForm); err != nil {
+		slog.WarnContext(ctx, "Invalid pushed authorization request", "client_id", clientID, "error", err)
+		writeOAuthError(w, req, err)
+		return
+	}
+
+	// Client credentials are not authorization request parameters
+	parameters := url.Values{}
+	for key, values := range req.PostForm {
+		if key != "client_secret" && key != "client_assertion" && key != "client_assertion_type" {
+			parameters[key] = values
+		}
+	}
+	parameters.Set("client_id", clientID)
+
+	tNow := time.Now()
+	data := par.Data{
+		RequestURI: requestURIPrefix + rand.Text(),
+		ClientID:   clientID,
+		Parameters: parameters,
+		CreatedAt:  tNow,
+		ExpiresAt:  tNow.Add(requestURITTL),
+	}
+	if err := a.parStore.Put(ctx, data); err != nil {
+		slog.ErrorContext(ctx, "Failed to save pushed authorization request", "client_id", clientID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(ctx, "Authorization request pushed", "client_id", clientID)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(pushedAuthorizationResponse{
+		RequestURI: data.RequestURI,
+		ExpiresIn:  int(requestURITTL.Seconds()),
+	})
+}
+
+// validatePushedParameters rejects the pushed requests that could not be redirected back to the client.
+// The other parameters are validated by /authorize, whose errors are sent to the redirect URI.
+func validatePushedParameters(client *client, parameters url.Values) *oauthError {
+	if parameters.Has("request_uri") {
+		return newOAuthError("invalid_request", "request_uri cannot be pushed")
+	}
+	if parameters.Has("request") {
+		return nil // The parameters are in the request object, which is verified by /authorize
+	}
+	if !slices.Contains(client.RedirectURIs, parameters.Get("redirect_uri")) {
+		return newOAuthError("invalid_request", "Invalid redirect_uri")
+	}
+	if !slices.Contains(supportedResponseTypes, parameters.Get("response_type")) {
+		return newOAuthError("unsupported_response_type", "Unsupported response_type")
+	}
+	return nil
+}
+
+// pushedParameters returns the parameters of a pushed authorization request, which can be used only once.
+func (a *app) pushedParameters(ctx context.Context, clientID, requestURI string) (url.Values, error) {
+	if !strings.HasPrefix(requestURI, requestURIPrefix) {
+		return nil, newOAuthError("invalid_request", "Unsupported request_uri")
+	}
+	data, err := a.parStore.Get(ctx, requestURI)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil || time.Now().After(data.ExpiresAt) {
+		return nil, newOAuthError("invalid_request", "Unknown or expired request_uri")
+	}
+	if data.ClientID != clientID {
+		return nil, newOAuthError("invalid_request", "The request_uri was pushed by another client")
+	}
+	// The request is consumed atomically, so that concurrent authorization requests cannot both use it
+	consumed, err := a.parStore.Consume(ctx, requestURI)
+	if err != nil {
+		return nil, err
+	}
+	if consumed == nil {
+		return nil, newOAuthError("invalid_request", "The request_uri was already used")
+	}
+	return consumed.Parameters, nil
+}
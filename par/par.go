@@ -0,0 +1,25 @@
+package par
+
+import (
+	"context"
+	"time"
+)
+
+// Data represents a pushed authorization request (RFC 9126), referenced by its request_uri at the authorization endpoint.
+type Data struct {
+	RequestURI string
+	ClientID   string
+	Parameters map[string][]string // Authorization request parameters, as they would appear in the query
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+}
+
+// Store defines pushed authorization request persistence operations.
+type Store interface {
+	Put(ctx context.Context, data Data) error
+	Get(ctx context.Context, requestURI string) (*Data, error)
+	Delete(ctx context.Context, requestURI string) error
+	// Consume atomically removes a pushed request and returns it, so that its request_uri is used only once.
+	// It returns nil when the request is unknown or already consumed.
+	Consume(ctx context.Context, requestURI string) (*Data, error)
+}
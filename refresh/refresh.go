@@ -7,12 +7,19 @@ import (
 
 // Data represents server-side persisted refresh token metadata.
 type Data struct {
-	TokenHash     string
-	ClientID      string
-	AccountID     string
-	GrantedScopes []string
-	CreatedAt     time.Time
-	ExpiresAt     time.Time
+	TokenHash      string
+	ClientID       string
+	AccountID      string
+	GrantedScopes  []string
+	Resources      []string // Resource indicators granted to the client, access tokens may be requested for a subset
+	UserInfoClaims []string // Claims requested with the claims parameter, released on refresh too
+	IDTokenClaims  []string
+	AuthTime       time.Time // Time of the end-user authentication the token was issued from
+	JKT            string    // Thumbprint of the DPoP key the token is bound to, if any
+	FamilyID       string    // Shared by the tokens rotated from the same original grant
+	Consumed       bool      // Set when the token is rotated, presenting it again revokes its family
+	CreatedAt      time.Time
+	ExpiresAt      time.Time
 }
 
 // Store defines refresh token persistence operations.
@@ -20,4 +27,9 @@ type Store interface {
 	Put(ctx context.Context, data Data) error
 	Get(ctx context.Context, tokenHash string) (*Data, error)
 	Delete(ctx context.Context, tokenHash string) error
+	DeleteByClientAndAccount(ctx context.Context, clientID, accountID string) error
+	GetByFamily(ctx context.Context, familyID string) ([]Data, error)
+	// Consume atomically marks the token as consumed, and records familyID when the token has no family yet.
+	// It returns the data as it was before, already consumed when the token is reused, or nil for an unknown token.
+	Consume(ctx context.Context, tokenHash, familyID string) (*Data, error)
 }
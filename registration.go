@@ -0,0 +1,400 @@
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// clientMetadata is the client metadata a client registers (RFC 7591 Section 2), unknown metadata is ignored.
+type clientMetadata struct {
+	RedirectURIs            []string        `json:"redirect_uris,omitempty"`
+	TokenEndpointAuthMethod string          `json:"token_endpoint_auth_method,omitempty"`
+	GrantTypes              []string        `json:"grant_types,omitempty"`
+	ResponseTypes           []string        `json:"response_types,omitempty"`
+	ClientName              string          `json:"client_name,omitempty"`
+	JWKS                    json.RawMessage `json:"jwks,omitempty"`
+	JWKSURI                 string          `json:"jwks_uri,omitempty"`
+	PostLogoutRedirectURIs  []string        `json:"post_logout_redirect_uris,omitempty"`
+	SubjectType             string          `json:"subject_type,omitempty"`
+}
+
+// registrationRequest is the body of a client registration or client update request (RFC 7592 Section 2.2).
+type registrationRequest struct {
+	ClientID     string `json:"client_id,omitempty"`
+	ClientSecret string `json:"client_secret,omitempty"`
+	clientMetadata
+}
+
+// registrationResponse is the client information response (RFC 7591 Section 3.2.1 and RFC 7592 Section 3).
+type registrationResponse struct {
+	ClientID                string `json:"client_id"`
+	ClientSecret            string `json:"client_secret,omitempty"` // Only when it is issued, Nestor only keeps its hash
+	ClientIDIssuedAt        int64  `json:"client_id_issued_at"`
+	ClientSecretExpiresAt   int64  `json:"client_secret_expires_at"`
+	RegistrationAccessToken string `json:"registration_access_token"`
+	RegistrationClientURI   string `json:"registration_client_uri"`
+	clientMetadata
+}
+
+// handleRegister implements the client registration endpoint (RFC 7591 Section 3).
+// Registration requires the initial access token configured with NESTOR_INITIAL_ACCESS_TOKEN.
+func (a *app) handleRegister(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	token := bearerToken(req)
+	if a.initialAccessToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.initialAccessToken)) != 1 {
+		slog.WarnContext(ctx, "Client registration without a valid initial access token")
+		writeBearerError(w, http.StatusUnauthorized, "invalid_token", "A valid initial access token is required")
+		return
+	}
+
+	var body registrationRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeOAuthError(w, req, newOAuthError("invalid_client_metadata", "The request body must be a JSON object"))
+		return
+	}
+
+	c := client{
+		ClientID: rand.Text(),
+		IssuedAt: time.Now(),
+	}
+	clientSecret, err := a.applyClientMetadata(&c, body.clientMetadata)
+	if err != nil {
+		var oauthErr *oauthError
+		if errors.As(err, &oauthErr) {
+			slog.WarnContext(ctx, "Invalid client metadata", "error", err)
+			writeOAuthError(w, req, oauthErr)
+			return
+		}
+		slog.ErrorContext(ctx, "Client registration failed", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	registrationAccessToken := rand.Text()
+	c.RegistrationTokenHash = hashToken(registrationAccessToken)
+
+	if err := a.putClient(ctx, c); err != nil {
+		slog.ErrorContext(ctx, "Failed to persist client", "client_id", c.ClientID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(ctx, "Client registered dynamically", "client_id", c.ClientID, "type", c.Type, "redirect_uris", c.RedirectURIs)
+	a.writeRegistrationResponse(w, http.StatusCreated, &c, clientSecret, registrationAccessToken)
+}
+
+// handleGetRegistration implements the client read request (RFC 7592 Section 2.1).
+func (a *app) handleGetRegistration(w http.ResponseWriter, req *http.Request) {
+	c, token, ok := a.registeredClient(w, req)
+	if !ok {
+		return
+	}
+	a.writeRegistrationResponse(w, http.StatusOK, c, "", token)
+}
+
+// handleUpdateRegistration implements the client update request (RFC 7592 Section 2.2),
+// the metadata of the request replaces the registered metadata.
+func (a *app) handleUpdateRegistration(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	c, token, ok := a.registeredClient(w, req)
+	if !ok {
+		return
+	}
+
+	var body registrationRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeOAuthError(w, req, newOAuthError("invalid_client_metadata", "The request body must be a JSON object"))
+		return
+	}
+	if body.ClientID != c.ClientID {
+		writeOAuthError(w, req, newOAuthError("invalid_request", "The client_id does not match the registered client"))
+		return
+	}
+	if body.ClientSecret != "" && bcrypt.CompareHashAndPassword(c.SecretHash, []byte(body.ClientSecret)) != nil {
+		writeOAuthError(w, req, newOAuthError("invalid_request", "The client_secret does not match the registered client"))
+		return
+	}
+
+	updated := *c
+	clientSecret, err := a.applyClientMetadata(&updated, body.clientMetadata)
+	if err != nil {
+		var oauthErr *oauthError
+		if errors.As(err, &oauthErr) {
+			slog.WarnContext(ctx, "Invalid client metadata", "client_id", c.ClientID, "error", err)
+			writeOAuthError(w, req, oauthErr)
+			return
+		}
+		slog.ErrorContext(ctx, "Client update failed", "client_id", c.ClientID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := a.putClient(ctx, updated); err != nil {
+		slog.ErrorContext(ctx, "Failed to persist client", "client_id", c.ClientID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// The previous keys of the client are not trusted anymore
+	if c.JWKSURI != "" {
+		a.clientKeySets.forget(c.JWKSURI)
+	}
+
+	slog.InfoContext(ctx, "Client registration updated", "client_id", c.ClientID)
+	a.writeRegistrationResponse(w, http.StatusOK, &updated, clientSecret, token)
+}
+
+// handleDeleteRegistration implements the client delete request (RFC 7592 Section 2.3).
+func (a *app) handleDeleteRegistration(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	c, _, ok := a.registeredClient(w, req)
+	if !ok {
+		return
+	}
+	if err := a.clientStore.Delete(ctx, c.ClientID); err != nil {
+		slog.ErrorContext(ctx, "Failed to delete client", "client_id", c.ClientID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if c.JWKSURI != "" {
+		a.clientKeySets.forget(c.JWKSURI)
+	}
+
+	slog.InfoContext(ctx, "Client registration deleted", "client_id", c.ClientID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// registeredClient returns the dynamically registered client of the request path and its registration access token.
+// It writes an invalid_token error when the client is unknown, or was not registered with the presented token.
+func (a *app) registeredClient(w http.ResponseWriter, req *http.Request) (*client, string, bool) {
+	ctx := req.Context()
+	clientID := req.PathValue("client_id")
+
+	c, err := a.getClient(ctx, clientID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get client", "client_id", clientID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, "", false
+	}
+	token := bearerToken(req)
+	// RFC 7592 Section 2: an unknown client is reported as an invalid token, not to disclose which clients exist
+	if c == nil || c.RegistrationTokenHash == "" || token == "" ||
+		subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(c.RegistrationTokenHash)) != 1 {
+		slog.WarnContext(ctx, "Invalid registration access token", "client_id", clientID)
+		writeBearerError(w, http.StatusUnauthorized, "invalid_token", "The registration access token is invalid")
+		return nil, "", false
+	}
+	return c, token, true
+}
+
+// applyClientMetadata validates metadata and applies it to c.
+// It returns the new client secret when the client gets one, the secret of a client that keeps using one is kept.
+func (a *app) applyClientMetadata(c *client, metadata clientMetadata) (string, error) {
+	grantTypes := metadata.GrantTypes
+	if len(grantTypes) == 0 {
+		grantTypes = []string{"authorization_code"}
+	}
+	for _, grantType := range grantTypes {
+		if !slices.Contains(supportedGrantTypes, grantType) {
+			return "", newOAuthError("invalid_client_metadata", "Unsupported grant type '"+grantType+"'")
+		}
+		// These grants need the resources and the token exchange audiences the operator configures for the client
+		if grantType == "client_credentials" || grantType == tokenExchangeGrantType {
+			return "", newOAuthError("invalid_client_metadata", "The grant type '"+grantType+"' is only available to the clients configured by the operator")
+		}
+	}
+	// RFC 7591 Section 2.1: the code response type goes with the authorization_code grant type
+	responseTypes := metadata.ResponseTypes
+	if len(responseTypes) == 0 && slices.Contains(grantTypes, "authorization_code") {
+		responseTypes = []string{"code"}
+	}
+	for _, responseType := range responseTypes {
+		if !slices.Contains(supportedResponseTypes, responseType) {
+			return "", newOAuthError("invalid_client_metadata", "Unsupported response type '"+responseType+"'")
+		}
+	}
+	if slices.Contains(responseTypes, "code") != slices.Contains(grantTypes, "authorization_code") {
+		return "", newOAuthError("invalid_client_metadata", "The code response type requires the authorization_code grant type, and the other way around")
+	}
+
+	authMethod := cmp.Or(metadata.TokenEndpointAuthMethod, "client_secret_basic")
+	if !slices.Contains(supportedTokenEndpointAuthMethods, authMethod) {
+		return "", newOAuthError("invalid_client_metadata", "Unsupported token endpoint authentication method '"+authMethod+"'")
+	}
+	if len(metadata.JWKS) > 0 && metadata.JWKSURI != "" {
+		return "", newOAuthError("invalid_client_metadata", "jwks and jwks_uri cannot be used together")
+	}
+	if authMethod == "private_key_jwt" && len(metadata.JWKS) == 0 && metadata.JWKSURI == "" {
+		return "", newOAuthError("invalid_client_metadata", "private_key_jwt requires jwks or jwks_uri")
+	}
+	if metadata.JWKSURI != "" {
+		// The server fetches the jwks_uri, it must not reach the internal network on behalf of the client
+		if u, err := url.Parse(metadata.JWKSURI); err != nil || u.Scheme != "https" || u.Host == "" || !isPublicHost(u.Hostname()) {
+			return "", newOAuthError("invalid_client_metadata", "jwks_uri must be an https URL of a public host")
+		}
+	}
+
+	if slices.Contains(grantTypes, "authorization_code") && len(metadata.RedirectURIs) == 0 {
+		return "", newOAuthError("invalid_redirect_uri", "redirect_uris is required for the authorization_code grant type")
+	}
+	for _, redirectURI := range metadata.RedirectURIs {
+		if !isValidRegisteredURI(redirectURI) {
+			return "", newOAuthError("invalid_redirect_uri", "Invalid redirect URI '"+redirectURI+"'")
+		}
+	}
+	for _, redirectURI := range metadata.PostLogoutRedirectURIs {
+		if !isValidRegisteredURI(redirectURI) {
+			return "", newOAuthError("invalid_client_metadata", "Invalid post logout redirect URI '"+redirectURI+"'")
+		}
+	}
+
+	c.Name = metadata.ClientName
+	c.TokenEndpointAuthMethod = authMethod
+	c.GrantTypes = grantTypes
+	c.RedirectURIs = metadata.RedirectURIs
+	c.PostLogoutRedirectURIs = metadata.PostLogoutRedirectURIs
+	c.JWKS = metadata.JWKS
+	c.JWKSURI = metadata.JWKSURI
+	c.SubjectType = subjectType(cmp.Or(metadata.SubjectType, string(subjectTypePublic)))
+	c.LoginPage = defaultLoginPage(cmp.Or(c.Name, c.ClientID))
+
+	var clientSecret string
+	switch authMethod {
+	case "none":
+		c.Type = clientTypePublic
+		c.SecretHash = nil
+	case "client_secret_basic", "client_secret_post":
+		c.Type = clientTypeConfidential
+		if len(c.SecretHash) == 0 {
+			clientSecret = rand.Text()
+			hash, err := bcrypt.GenerateFromPassword([]byte(clientSecret), bcrypt.DefaultCost)
+			if err != nil {
+				return "", err
+			}
+			c.SecretHash = hash
+		}
+	case "private_key_jwt":
+		c.Type = clientTypeConfidential
+		c.SecretHash = nil
+	}
+
+	if err := a.validateClient(c); err != nil {
+		return "", wrapOAuthError("invalid_client_metadata", err.Error(), err)
+	}
+	return clientSecret, nil
+}
+
+// isValidRegisteredURI reports whether uri may be registered as a redirect URI: an absolute URI without a fragment,
+// using https, http on the loopback interface, or a private-use scheme of a native app (RFC 8252 Section 7).
+func isValidRegisteredURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || u.Fragment != "" {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return u.Host != ""
+	case "http":
+		if u.Hostname() == "localhost" {
+			return true
+		}
+		ip := net.ParseIP(u.Hostname())
+		return ip != nil && ip.IsLoopback()
+	default:
+		// Private-use schemes are reverse domain names, which also excludes schemes such as javascript
+		return strings.Contains(u.Scheme, ".")
+	}
+}
+
+// isPublicHost reports whether host is neither localhost nor an IP address of the loopback interface or of a private network.
+// A host name may still resolve to such an address, publicHTTPClient checks the address it connects to.
+func isPublicHost(host string) bool {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || isPublicIP(ip)
+}
+
+// isPublicIP reports whether ip is neither an address of the loopback interface nor of a private or link-local network.
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified())
+}
+
+// publicHTTPClient fetches the resources registered by the clients, such as their jwks_uri.
+// It only connects to public addresses, whatever the host names resolve to, and does not follow redirects.
+var publicHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+					return fmt.Errorf("connection to the non-public address %s refused", address)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+	Timeout: 30 * time.Second,
+}
+
+func (a *app) writeRegistrationResponse(w http.ResponseWriter, status int, c *client, clientSecret, registrationAccessToken string) {
+	resp := registrationResponse{
+		ClientID:                c.ClientID,
+		ClientSecret:            clientSecret,
+		ClientIDIssuedAt:        c.IssuedAt.Unix(),
+		RegistrationAccessToken: registrationAccessToken,
+		RegistrationClientURI:   a.baseURL + "/register/" + c.ClientID,
+		clientMetadata: clientMetadata{
+			RedirectURIs:            c.RedirectURIs,
+			TokenEndpointAuthMethod: c.TokenEndpointAuthMethod,
+			GrantTypes:              c.GrantTypes,
+			ClientName:              c.Name,
+			JWKS:                    c.JWKS,
+			JWKSURI:                 c.JWKSURI,
+			PostLogoutRedirectURIs:  c.PostLogoutRedirectURIs,
+			SubjectType:             string(c.SubjectType),
+		},
+	}
+	if slices.Contains(c.GrantTypes, "authorization_code") {
+		resp.ResponseTypes = []string{"code"}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// bearerToken returns the token of the Bearer authorization header of req, if any.
+func bearerToken(req *http.Request) string {
+	scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return token
+}
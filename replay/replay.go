@@ -0,0 +1,12 @@
+package replay
+
+import (
+	"context"
+	"time"
+)
+
+// Store remembers single-use identifiers, such as the jti of a JWT, to detect replays.
+type Store interface {
+	// Use marks id as used until expiresAt. It returns false if id was already used and has not expired yet.
+	Use(ctx context.Context, id string, expiresAt time.Time) (bool, error)
+}
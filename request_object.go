@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWT claims of a request object that are not authorization request parameters.
+var requestObjectJWTClaims = []string{"iss", "aud", "exp", "iat", "nbf", "jti"}
+
+// maxRequestObjectLifetime bounds the expiration time of the request objects, and so the time their jti is remembered.
+const maxRequestObjectLifetime = time.Hour
+
+// requestObjectParameters verifies the request object of query, a JWT signed by the client (RFC 9101),
+// and returns the authorization request parameters it carries.
+// Query parameters are only accepted when the request object has the same value, e.g. the response_type and
+// scope that OpenID Connect requires in the query.
+func (a *app) requestObjectParameters(ctx context.Context, query url.Values) (url.Values, error) {
+	clientID := query.Get("client_id")
+	client, err := a.getClient(ctx, clientID)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		return nil, newOAuthError("invalid_request_object", "Unknown client")
+	}
+	if len(client.JWKS) == 0 && client.JWKSURI == "" {
+		return nil, newOAuthError("invalid_request_object", "The client has no registered keys")
+	}
+	kf, err := a.clientKeyfunc(client)
+	if err != nil {
+		return nil, err
+	}
+
+	audiences := []string{a.oidcConfig.AuthorizationEndpoint}
+	if a.oidcConfig.Issuer != "" {
+		audiences = append(audiences, a.oidcConfig.Issuer)
+	}
+	token, err := jwt.Parse(query.Get("request"), kf.KeyfuncCtx(ctx),
+		jwt.WithValidMethods(supportedClientSigningAlgs),
+		jwt.WithIssuer(clientID),
+		jwt.WithAudience(audiences...),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return nil, wrapOAuthError("invalid_request_object", "Invalid request object", err)
+	}
+
+	// A captured request object can only be replayed until it expires, and only once
+	claims := token.Claims.(jwt.MapClaims)
+	exp, _ := claims.GetExpirationTime()
+	if exp.After(time.Now().Add(maxRequestObjectLifetime)) {
+		return nil, newOAuthError("invalid_request_object", "The request object expires too late")
+	}
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return nil, newOAuthError("invalid_request_object", "The request object must have a jti")
+	}
+	unused, err := a.replayStore.Use(ctx, "request_object:"+clientID+":"+jti, exp.Time)
+	if err != nil {
+		return nil, err
+	}
+	if !unused {
+		return nil, newOAuthError("invalid_request_object", "The request object was already used")
+	}
+
+	params := url.Values{}
+	for name, value := range claims {
+		if slices.Contains(requestObjectJWTClaims, name) {
+			continue
+		}
+		// Parameters such as resource may be repeated in a query, they are arrays in a request object
+		if values, isArray := value.([]any); isArray {
+			for _, v := range values {
+				params.Add(name, requestObjectParameter(v))
+			}
+			continue
+		}
+		params.Set(name, requestObjectParameter(value))
+	}
+	if params.Has("client_id") && params.Get("client_id") != clientID {
+		return nil, newOAuthError("invalid_request_object", "client_id does not match the request object issuer")
+	}
+	params.Set("client_id", clientID)
+
+	for name, values := range query {
+		if name != "request" && !slices.Equal(values, params[name]) {
+			return nil, newOAuthError("invalid_request", "The query parameter '"+name+"' conflicts with the request object")
+		}
+	}
+	if params.Has("request") || params.Has("request_uri") {
+		return nil, newOAuthError("invalid_request_object", "Request objects cannot be nested")
+	}
+	return params, nil
+}
+
+// requestObjectParameter returns the value of a request object claim as a query parameter value.
+// JSON numbers, e.g. max_age, and JSON objects, e.g. claims, are not strings in a request object.
+func requestObjectParameter(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return string(raw)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/url"
+	"slices"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// allowsResource reports whether the client may get access tokens for resource,
+// its default resource indicator or one of the resources of its configuration.
+func (c *client) allowsResource(resource string) bool {
+	return (resource != "" && resource == c.DefaultResourceIndicator) || slices.Contains(c.Resources, resource)
+}
+
+// validateResources checks the resource parameters of a request (RFC 8707 Section 2) against the resources allowed to client.
+func validateResources(client *client, resources []string) *oauthError {
+	for _, resource := range resources {
+		u, err := url.Parse(resource)
+		if err != nil || !u.IsAbs() || u.Fragment != "" {
+			return newOAuthError("invalid_target", "The resource must be an absolute URI without a fragment")
+		}
+		if !client.allowsResource(resource) {
+			return newOAuthError("invalid_target", "The resource '"+resource+"' is not allowed for this client")
+		}
+	}
+	return nil
+}
+
+// tokenAudience returns the audience of an access token: the requested resources, which must have been granted,
+// or all the granted resources when none is requested.
+// The default resource indicator of the client stands for the resources of a grant that has none.
+func tokenAudience(client *client, granted, requested []string) (jwt.ClaimStrings, error) {
+	if len(granted) == 0 {
+		granted = []string{client.DefaultResourceIndicator}
+	}
+	if len(requested) == 0 {
+		return granted, nil
+	}
+	for _, resource := range requested {
+		if resource == "" || !slices.Contains(granted, resource) {
+			return nil, newOAuthError("invalid_target", "The resource '"+resource+"' was not granted")
+		}
+	}
+	return requested, nil
+}
+
+// audienceClaim returns the aud claim for audience, a string when there is a single audience (RFC 7519 Section 4.1.3).
+func audienceClaim(audience jwt.ClaimStrings) any {
+	if len(audience) == 1 {
+		return audience[0]
+	}
+	return []string(audience)
+}
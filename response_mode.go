@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Authorization request features actually implemented, the discovery document is built from them.
+var (
+	supportedResponseTypes        = []string{"code"}
+	supportedResponseModes        = []string{"query", "fragment", "form_post"}
+	supportedGrantTypes           = []string{"authorization_code", "refresh_token", "client_credentials", deviceCodeGrantType, tokenExchangeGrantType}
+	supportedCodeChallengeMethods = []string{"S256"}
+)
+
+// sendAuthorizationResponse returns the authorization response params to the client
+// using the requested response mode (OAuth 2.0 Multiple Response Type Encoding Practices
+// and OAuth 2.0 Form Post Response Mode). The query mode is the default for the code response type.
+func sendAuthorizationResponse(ctx context.Context, w http.ResponseWriter, req *http.Request, oauthParams oAuthParams, params url.Values) {
+	switch oauthParams.ResponseMode {
+	case "form_post":
+		slog.InfoContext(ctx, "posting authorization response to", "url", oauthParams.RedirectURI)
+		w.Header().Set("Cache-Control", "no-store")
+		// The redirect URI was validated against the registered ones, which may use the private-use scheme of a native app
+		// that html/template would replace with #ZgotmplZ
+		err := executeTemplate(w, "form_post.tmpl", map[string]any{
+			"RedirectURI": template.URL(oauthParams.RedirectURI),
+			"Params":      params,
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to render form_post template", "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+	case "fragment":
+		redirectURL := oauthParams.RedirectURI + "#" + params.Encode()
+		slog.InfoContext(ctx, "redirecting to", "url", oauthParams.RedirectURI)
+		http.Redirect(w, req, redirectURL, http.StatusFound)
+	default:
+		separator := "?"
+		if strings.Contains(oauthParams.RedirectURI, "?") {
+			separator = "&"
+		}
+		redirectURL := oauthParams.RedirectURI + separator + params.Encode()
+		slog.InfoContext(ctx, "redirecting to", "url", redirectURL)
+		http.Redirect(w, req, redirectURL, http.StatusFound)
+	}
+}
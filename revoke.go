@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+// handleRevoke implements OAuth 2.0 Token Revocation (RFC 7009).
+// Only refresh tokens are stateful, access tokens are self-contained JWTs and expire on their own.
+func (a *app) handleRevoke(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	client, err := a.authenticateClient(req)
+	if err != nil {
+		var oauthErr *oauthError
+		if errors.As(err, &oauthErr) {
+			writeOAuthError(w, req, oauthErr)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	clientID := client.ClientID
+
+	token := req.FormValue("token")
+	tokenTypeHint := req.FormValue("token_type_hint")
+	if token == "" {
+		slog.WarnContext(ctx, "Missing token in revocation request", "client_id", clientID)
+		writeOAuthError(w, req, newOAuthError("invalid_request", "token is required"))
+		return
+	}
+
+	// The hint only speeds up the lookup, an unknown token type is looked up as a refresh token anyway
+	tokenHash := hashToken(token)
+	data, err := a.refreshStore.Get(ctx, tokenHash)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to retrieve refresh token", "client_id", clientID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if data == nil {
+		// RFC 7009 Section 2.2: invalid tokens do not cause an error response
+		slog.InfoContext(ctx, "Token to revoke not found", "client_id", clientID, "token_type_hint", tokenTypeHint)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if data.ClientID != clientID {
+		slog.WarnContext(ctx, "Token revocation client mismatch", "client_id", clientID, "stored_client_id", data.ClientID)
+		writeOAuthError(w, req, newOAuthError("unauthorized_client", "The token was issued to another client"))
+		return
+	}
+
+	if err := a.refreshStore.Delete(ctx, tokenHash); err != nil {
+		slog.ErrorContext(ctx, "Failed to revoke refresh token", "client_id", clientID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(ctx, "Refresh token revoked", "client_id", clientID, "account_id", data.AccountID)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/simonhege/nestor/session"
+	"github.com/simonhege/nestor/signed"
+)
+
+const sessionTTL = 24 * time.Hour
+
+// startSession opens a single sign-on session for the account that has just authenticated.
+func (a *app) startSession(ctx context.Context, w http.ResponseWriter, accountID string) (session.Data, error) {
+	tNow := time.Now()
+	data := session.Data{
+		ID:        rand.Text(),
+		AccountID: accountID,
+		AuthTime:  tNow,
+		CreatedAt: tNow,
+		ExpiresAt: tNow.Add(sessionTTL),
+	}
+	if err := a.sessionStore.Put(ctx, data); err != nil {
+		return session.Data{}, err
+	}
+
+	// Lax, so that the session is also sent on the cross site navigation to /authorize
+	signed.SetCrossSiteCookieWithExpiry(ctx, w, "session", data.ID, data.ExpiresAt)
+	return data, nil
+}
+
+// currentSession returns the valid session of the request, or nil if there is none.
+func (a *app) currentSession(ctx context.Context, req *http.Request) (*session.Data, error) {
+	var sessionID string
+	if err := signed.ReadCookie(req, "session", &sessionID); err != nil {
+		return nil, nil // No session cookie, or a tampered one
+	}
+
+	data, err := a.sessionStore.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil || time.Now().After(data.ExpiresAt) {
+		return nil, nil
+	}
+	return data, nil
+}
+
+// endSession deletes the session of the request, if any, and its cookie.
+func (a *app) endSession(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+	signed.DeleteCrossSiteCookie(w, "session")
+
+	var sessionID string
+	if err := signed.ReadCookie(req, "session", &sessionID); err != nil {
+		return nil
+	}
+	slog.InfoContext(ctx, "Ending session", "session_id", sessionID)
+	return a.sessionStore.Delete(ctx, sessionID)
+}
@@ -0,0 +1,22 @@
+package session
+
+import (
+	"context"
+	"time"
+)
+
+// Data represents a server-side single sign-on session of an authenticated account.
+type Data struct {
+	ID        string
+	AccountID string
+	AuthTime  time.Time // Time of the end-user authentication that opened the session
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// Store defines session persistence operations.
+type Store interface {
+	Put(ctx context.Context, data Data) error
+	Get(ctx context.Context, id string) (*Data, error)
+	Delete(ctx context.Context, id string) error
+}
@@ -58,6 +58,11 @@ func DeleteCookie(w http.ResponseWriter, name string) {
 }
 
 func SetCrossSiteCookie(ctx context.Context, w http.ResponseWriter, name string, data any) {
+	SetCrossSiteCookieWithExpiry(ctx, w, name, data, time.Now().Add(15*time.Minute))
+}
+
+// SetCrossSiteCookieWithExpiry sets a cross site cookie that outlives the default 15 minutes.
+func SetCrossSiteCookieWithExpiry(ctx context.Context, w http.ResponseWriter, name string, data any, expires time.Time) {
 	encodedParams, err := Encode(data)
 	if err != nil {
 		slog.ErrorContext(ctx, "Failed to encode cookie", "error", err)
@@ -71,7 +76,7 @@ func SetCrossSiteCookie(ctx context.Context, w http.ResponseWriter, name string,
 		HttpOnly: true,                 // Not accessible via JavaScript
 		Secure:   true,                 // Only sent over HTTPS
 		SameSite: http.SameSiteLaxMode, // No CSRF protection
-		Expires:  time.Now().Add(15 * time.Minute),
+		Expires:  expires,
 	}
 	http.SetCookie(w, cookie)
 }
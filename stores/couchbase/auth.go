@@ -3,6 +3,7 @@ package couchbase
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/couchbase/gocb/v2"
 	"github.com/simonhege/nestor/auth"
@@ -23,9 +24,13 @@ func NewAuthStore(scope *gocb.Scope) (auth.Store, error) {
 	}, nil
 }
 
-// Put stores the given AuthData in the Couchbase collection.
+// Put stores the given AuthData in the Couchbase collection, the document expires with the code.
 func (a *authStore) Put(ctx context.Context, data auth.AuthData) error {
-	_, err := a.collection.Upsert(data.Code, data, nil)
+	var options gocb.UpsertOptions
+	if !data.ExpiresAt.IsZero() {
+		options.Expiry = time.Until(data.ExpiresAt)
+	}
+	_, err := a.collection.Upsert(data.Code, data, &options)
 	return err
 }
 
@@ -51,3 +56,42 @@ func (a *authStore) Delete(ctx context.Context, code string) error {
 	_, err := a.collection.Remove(code, nil)
 	return err
 }
+
+// Consume marks the AuthData associated with the given code as consumed in the Couchbase collection.
+// The document is replaced with its CAS, so only one of concurrent redemptions of the code consumes it.
+func (a *authStore) Consume(ctx context.Context, code, familyID string) (*auth.AuthData, error) {
+	for {
+		doc, err := a.collection.Get(code, nil)
+		if err != nil {
+			if errors.Is(err, gocb.ErrDocumentNotFound) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		var data auth.AuthData
+		if err := doc.Content(&data); err != nil {
+			return nil, err
+		}
+		if data.Consumed {
+			return &data, nil
+		}
+
+		consumed := data
+		consumed.Consumed = true
+		consumed.FamilyID = familyID
+		_, err = a.collection.Replace(code, consumed, &gocb.ReplaceOptions{
+			Cas:            doc.Cas(),
+			PreserveExpiry: true,
+		})
+		if errors.Is(err, gocb.ErrCasMismatch) {
+			continue // Redeemed concurrently, the next read sees the code consumed
+		}
+		if errors.Is(err, gocb.ErrDocumentNotFound) {
+			return nil, nil // Expired meanwhile
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &data, nil
+	}
+}
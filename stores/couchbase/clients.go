@@ -0,0 +1,53 @@
+package couchbase
+
+import (
+	"context"
+	"errors"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/simonhege/nestor/clients"
+)
+
+// clientStore is a Couchbase implementation of the clients.Store interface.
+type clientStore struct {
+	scope      *gocb.Scope
+	collection *gocb.Collection
+}
+
+// NewClientStore creates a new instance of clientStore with the given Couchbase scope.
+func NewClientStore(scope *gocb.Scope) (clients.Store, error) {
+	collection := scope.Collection("clients")
+	return &clientStore{
+		scope:      scope,
+		collection: collection,
+	}, nil
+}
+
+// Put stores the given clients.Data in the Couchbase collection.
+func (s *clientStore) Put(ctx context.Context, data clients.Data) error {
+	_, err := s.collection.Upsert(data.ClientID, data, nil)
+	return err
+}
+
+// Get retrieves the clients.Data associated with the given client ID from the Couchbase collection.
+func (s *clientStore) Get(ctx context.Context, clientID string) (*clients.Data, error) {
+	var data clients.Data
+	doc, err := s.collection.Get(clientID, nil)
+	if err != nil {
+		if errors.Is(err, gocb.ErrDocumentNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	err = doc.Content(&data)
+	if err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// Delete removes the clients.Data associated with the given client ID from the Couchbase collection.
+func (s *clientStore) Delete(ctx context.Context, clientID string) error {
+	_, err := s.collection.Remove(clientID, nil)
+	return err
+}
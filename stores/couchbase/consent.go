@@ -0,0 +1,68 @@
+package couchbase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/simonhege/nestor/consent"
+)
+
+// consentStore is a Couchbase implementation of the consent.Store interface.
+type consentStore struct {
+	scope      *gocb.Scope
+	collection *gocb.Collection
+}
+
+// NewConsentStore creates a new instance of consentStore with the given Couchbase scope.
+func NewConsentStore(scope *gocb.Scope) (consent.Store, error) {
+	collection := scope.Collection("consents")
+	return &consentStore{
+		scope:      scope,
+		collection: collection,
+	}, nil
+}
+
+// Put stores the given consent.Data in the Couchbase collection.
+func (s *consentStore) Put(ctx context.Context, data consent.Data) error {
+	_, err := s.collection.Upsert(consentKey(data.AccountID, data.ClientID), data, nil)
+	return err
+}
+
+// Get retrieves the consent.Data of the given account and client from the Couchbase collection.
+func (s *consentStore) Get(ctx context.Context, accountID, clientID string) (*consent.Data, error) {
+	var data consent.Data
+	doc, err := s.collection.Get(consentKey(accountID, clientID), nil)
+	if err != nil {
+		if errors.Is(err, gocb.ErrDocumentNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	err = doc.Content(&data)
+	if err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// DeleteByAccount removes all the consents of the given account.
+func (s *consentStore) DeleteByAccount(ctx context.Context, accountID string) error {
+	query := "DELETE FROM `" + s.collection.Name() + "` as c WHERE c.AccountID = $accountID"
+	parameters := map[string]interface{}{
+		"accountID": accountID,
+	}
+
+	rows, err := s.scope.Query(query, &gocb.QueryOptions{
+		NamedParameters: parameters,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete consents: %w", err)
+	}
+	return rows.Close()
+}
+
+func consentKey(accountID, clientID string) string {
+	return accountID + "::" + clientID
+}
@@ -0,0 +1,153 @@
+package couchbase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/simonhege/nestor/device"
+)
+
+// deviceStore is a Couchbase implementation of the device.Store interface.
+type deviceStore struct {
+	scope      *gocb.Scope
+	collection *gocb.Collection
+}
+
+// NewDeviceStore creates a new instance of deviceStore with the given Couchbase scope.
+func NewDeviceStore(scope *gocb.Scope) (device.Store, error) {
+	collection := scope.Collection("device_codes")
+	return &deviceStore{
+		scope:      scope,
+		collection: collection,
+	}, nil
+}
+
+// Put stores the given device.Data in the Couchbase collection, the document expires with the request.
+func (d *deviceStore) Put(ctx context.Context, data device.Data) error {
+	_, err := d.collection.Upsert(data.DeviceCodeHash, data, &gocb.UpsertOptions{
+		Expiry: time.Until(data.ExpiresAt),
+	})
+	return err
+}
+
+// Get retrieves the device.Data associated with the given device code hash from the Couchbase collection.
+func (d *deviceStore) Get(ctx context.Context, deviceCodeHash string) (*device.Data, error) {
+	var data device.Data
+	doc, err := d.collection.Get(deviceCodeHash, nil)
+	if err != nil {
+		if errors.Is(err, gocb.ErrDocumentNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	err = doc.Content(&data)
+	if err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// GetByUserCode retrieves the device.Data associated with the given user code from the Couchbase collection.
+func (d *deviceStore) GetByUserCode(ctx context.Context, userCode string) (*device.Data, error) {
+	query := "SELECT dc.* FROM `" + d.collection.Name() +
+		"` as dc WHERE dc.UserCode = $userCode"
+	parameters := map[string]interface{}{
+		"userCode": userCode,
+	}
+
+	rows, err := d.scope.Query(query, &gocb.QueryOptions{
+		NamedParameters: parameters,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query device codes by user code: %w", err)
+	}
+
+	var data device.Data
+	if err := rows.One(&data); err != nil {
+		if errors.Is(err, gocb.ErrNoResult) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to decode device code: %w", err)
+	}
+	return &data, nil
+}
+
+// Delete removes the device.Data associated with the given device code hash from the Couchbase collection.
+func (d *deviceStore) Delete(ctx context.Context, deviceCodeHash string) error {
+	_, err := d.collection.Remove(deviceCodeHash, nil)
+	if errors.Is(err, gocb.ErrDocumentNotFound) {
+		return nil
+	}
+	return err
+}
+
+// RecordPoll sets the last poll time and the polling interval of the pending device.Data in the Couchbase collection.
+// The document is replaced with its CAS, so that an approval or a denial written meanwhile is not overwritten.
+func (d *deviceStore) RecordPoll(ctx context.Context, deviceCodeHash string, polledAt time.Time, interval int) (bool, error) {
+	for {
+		doc, err := d.collection.Get(deviceCodeHash, nil)
+		if err != nil {
+			if errors.Is(err, gocb.ErrDocumentNotFound) {
+				return false, nil
+			}
+			return false, err
+		}
+		var data device.Data
+		if err := doc.Content(&data); err != nil {
+			return false, err
+		}
+		if data.Status != device.StatusPending {
+			return false, nil
+		}
+
+		data.LastPolledAt = polledAt
+		data.Interval = interval
+		_, err = d.collection.Replace(deviceCodeHash, data, &gocb.ReplaceOptions{Cas: doc.Cas(), PreserveExpiry: true})
+		if errors.Is(err, gocb.ErrCasMismatch) {
+			continue // Updated concurrently, the next read tells whether it is still pending
+		}
+		if errors.Is(err, gocb.ErrDocumentNotFound) {
+			return false, nil // Expired meanwhile
+		}
+		if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+}
+
+// Consume removes the approved device.Data associated with the given device code hash from the Couchbase collection.
+// The document is removed with its CAS, so only one of concurrent redemptions of the device code gets it.
+func (d *deviceStore) Consume(ctx context.Context, deviceCodeHash string) (*device.Data, error) {
+	for {
+		doc, err := d.collection.Get(deviceCodeHash, nil)
+		if err != nil {
+			if errors.Is(err, gocb.ErrDocumentNotFound) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		var data device.Data
+		if err := doc.Content(&data); err != nil {
+			return nil, err
+		}
+		if data.Status != device.StatusApproved {
+			return nil, nil
+		}
+
+		_, err = d.collection.Remove(deviceCodeHash, &gocb.RemoveOptions{Cas: doc.Cas()})
+		if errors.Is(err, gocb.ErrCasMismatch) {
+			continue // Updated concurrently, the next read tells whether it is still approved
+		}
+		if errors.Is(err, gocb.ErrDocumentNotFound) {
+			return nil, nil // Consumed or expired meanwhile
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &data, nil
+	}
+}
@@ -0,0 +1,89 @@
+package couchbase
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/simonhege/nestor/par"
+)
+
+// parStore is a Couchbase implementation of the par.Store interface.
+type parStore struct {
+	scope      *gocb.Scope
+	collection *gocb.Collection
+}
+
+// NewPARStore creates a new instance of parStore with the given Couchbase scope.
+func NewPARStore(scope *gocb.Scope) (par.Store, error) {
+	collection := scope.Collection("pushed_authorization_requests")
+	return &parStore{
+		scope:      scope,
+		collection: collection,
+	}, nil
+}
+
+// Put stores the given par.Data in the Couchbase collection, the document expires with the request URI.
+func (p *parStore) Put(ctx context.Context, data par.Data) error {
+	_, err := p.collection.Upsert(data.RequestURI, data, &gocb.UpsertOptions{
+		Expiry: time.Until(data.ExpiresAt),
+	})
+	return err
+}
+
+// Get retrieves the par.Data associated with the given request URI from the Couchbase collection.
+func (p *parStore) Get(ctx context.Context, requestURI string) (*par.Data, error) {
+	var data par.Data
+	doc, err := p.collection.Get(requestURI, nil)
+	if err != nil {
+		if errors.Is(err, gocb.ErrDocumentNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	err = doc.Content(&data)
+	if err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// Delete removes the par.Data associated with the given request URI from the Couchbase collection.
+func (p *parStore) Delete(ctx context.Context, requestURI string) error {
+	_, err := p.collection.Remove(requestURI, nil)
+	if errors.Is(err, gocb.ErrDocumentNotFound) {
+		return nil
+	}
+	return err
+}
+
+// Consume removes the par.Data associated with the given request URI from the Couchbase collection and returns it.
+// The document is removed with its CAS, so only one of concurrent uses of the request URI gets it.
+func (p *parStore) Consume(ctx context.Context, requestURI string) (*par.Data, error) {
+	for {
+		doc, err := p.collection.Get(requestURI, nil)
+		if err != nil {
+			if errors.Is(err, gocb.ErrDocumentNotFound) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		var data par.Data
+		if err := doc.Content(&data); err != nil {
+			return nil, err
+		}
+
+		_, err = p.collection.Remove(requestURI, &gocb.RemoveOptions{Cas: doc.Cas()})
+		if errors.Is(err, gocb.ErrCasMismatch) {
+			continue // Replaced concurrently, the next read gets the current request
+		}
+		if errors.Is(err, gocb.ErrDocumentNotFound) {
+			return nil, nil // Used or expired meanwhile
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &data, nil
+	}
+}
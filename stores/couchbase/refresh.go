@@ -3,6 +3,8 @@ package couchbase
 import (
 	"context"
 	"errors"
+	"fmt"
+	"time"
 
 	"github.com/couchbase/gocb/v2"
 	"github.com/simonhege/nestor/refresh"
@@ -23,9 +25,14 @@ func NewRefreshStore(scope *gocb.Scope) (refresh.Store, error) {
 	}, nil
 }
 
-// Put stores the given refresh.Data in the Couchbase collection.
+// Put stores the given refresh.Data in the Couchbase collection, the document expires with the token.
+// Consumed tokens are kept until then to detect their reuse.
 func (r *refreshStore) Put(ctx context.Context, data refresh.Data) error {
-	_, err := r.collection.Upsert(data.TokenHash, data, nil)
+	var options gocb.UpsertOptions
+	if !data.ExpiresAt.IsZero() {
+		options.Expiry = time.Until(data.ExpiresAt)
+	}
+	_, err := r.collection.Upsert(data.TokenHash, data, &options)
 	return err
 }
 
@@ -51,3 +58,91 @@ func (r *refreshStore) Delete(ctx context.Context, tokenHash string) error {
 	_, err := r.collection.Remove(tokenHash, nil)
 	return err
 }
+
+// DeleteByClientAndAccount removes all the refresh.Data issued to the given client for the given account.
+func (r *refreshStore) DeleteByClientAndAccount(ctx context.Context, clientID, accountID string) error {
+	query := "DELETE FROM `" + r.collection.Name() +
+		"` as rt WHERE rt.ClientID = $clientID AND rt.AccountID = $accountID"
+	parameters := map[string]interface{}{
+		"clientID":  clientID,
+		"accountID": accountID,
+	}
+
+	rows, err := r.scope.Query(query, &gocb.QueryOptions{
+		NamedParameters: parameters,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete refresh tokens: %w", err)
+	}
+	return rows.Close()
+}
+
+// GetByFamily retrieves all the refresh.Data of the given token family from the Couchbase collection.
+func (r *refreshStore) GetByFamily(ctx context.Context, familyID string) ([]refresh.Data, error) {
+	query := "SELECT rt.* FROM `" + r.collection.Name() +
+		"` as rt WHERE rt.FamilyID = $familyID"
+	parameters := map[string]interface{}{
+		"familyID": familyID,
+	}
+
+	rows, err := r.scope.Query(query, &gocb.QueryOptions{
+		NamedParameters: parameters,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query refresh tokens by family: %w", err)
+	}
+
+	var family []refresh.Data
+	for rows.Next() {
+		var data refresh.Data
+		if err := rows.Row(&data); err != nil {
+			return nil, fmt.Errorf("failed to decode refresh token: %w", err)
+		}
+		family = append(family, data)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query refresh tokens by family: %w", err)
+	}
+	return family, nil
+}
+
+// Consume marks the refresh.Data associated with the given token hash as consumed in the Couchbase collection.
+// The document is replaced with its CAS, so only one of concurrent rotations of the token consumes it.
+func (r *refreshStore) Consume(ctx context.Context, tokenHash, familyID string) (*refresh.Data, error) {
+	for {
+		doc, err := r.collection.Get(tokenHash, nil)
+		if err != nil {
+			if errors.Is(err, gocb.ErrDocumentNotFound) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		var data refresh.Data
+		if err := doc.Content(&data); err != nil {
+			return nil, err
+		}
+		if data.Consumed {
+			return &data, nil
+		}
+
+		consumed := data
+		consumed.Consumed = true
+		if consumed.FamilyID == "" {
+			consumed.FamilyID = familyID
+		}
+		_, err = r.collection.Replace(tokenHash, consumed, &gocb.ReplaceOptions{
+			Cas:            doc.Cas(),
+			PreserveExpiry: true,
+		})
+		if errors.Is(err, gocb.ErrCasMismatch) {
+			continue // Rotated concurrently, the next read sees the token consumed
+		}
+		if errors.Is(err, gocb.ErrDocumentNotFound) {
+			return nil, nil // Expired or revoked meanwhile
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &data, nil
+	}
+}
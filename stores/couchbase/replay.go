@@ -0,0 +1,44 @@
+package couchbase
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/simonhege/nestor/replay"
+)
+
+// replayStore is a Couchbase implementation of the replay.Store interface.
+type replayStore struct {
+	scope      *gocb.Scope
+	collection *gocb.Collection
+}
+
+type replayData struct {
+	ExpiresAt time.Time
+}
+
+// NewReplayStore creates a new instance of replayStore with the given Couchbase scope.
+func NewReplayStore(scope *gocb.Scope) (replay.Store, error) {
+	collection := scope.Collection("replay")
+	return &replayStore{
+		scope:      scope,
+		collection: collection,
+	}, nil
+}
+
+// Use inserts id in the Couchbase collection, the insert fails if the document already exists.
+// The document expires at expiresAt, after which the id may be used again.
+func (s *replayStore) Use(ctx context.Context, id string, expiresAt time.Time) (bool, error) {
+	_, err := s.collection.Insert(id, replayData{ExpiresAt: expiresAt}, &gocb.InsertOptions{
+		Expiry: time.Until(expiresAt),
+	})
+	if errors.Is(err, gocb.ErrDocumentExists) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,59 @@
+package couchbase
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/simonhege/nestor/session"
+)
+
+// sessionStore is a Couchbase implementation of the session.Store interface.
+type sessionStore struct {
+	scope      *gocb.Scope
+	collection *gocb.Collection
+}
+
+// NewSessionStore creates a new instance of sessionStore with the given Couchbase scope.
+func NewSessionStore(scope *gocb.Scope) (session.Store, error) {
+	collection := scope.Collection("sessions")
+	return &sessionStore{
+		scope:      scope,
+		collection: collection,
+	}, nil
+}
+
+// Put stores the given session.Data in the Couchbase collection, the document expires with the session.
+func (s *sessionStore) Put(ctx context.Context, data session.Data) error {
+	_, err := s.collection.Upsert(data.ID, data, &gocb.UpsertOptions{
+		Expiry: time.Until(data.ExpiresAt),
+	})
+	return err
+}
+
+// Get retrieves the session.Data associated with the given id from the Couchbase collection.
+func (s *sessionStore) Get(ctx context.Context, id string) (*session.Data, error) {
+	var data session.Data
+	doc, err := s.collection.Get(id, nil)
+	if err != nil {
+		if errors.Is(err, gocb.ErrDocumentNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	err = doc.Content(&data)
+	if err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// Delete removes the session.Data associated with the given id from the Couchbase collection.
+func (s *sessionStore) Delete(ctx context.Context, id string) error {
+	_, err := s.collection.Remove(id, nil)
+	if errors.Is(err, gocb.ErrDocumentNotFound) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,64 @@
+package couchbase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/simonhege/nestor/subject"
+)
+
+// subjectStore is a Couchbase implementation of the subject.Store interface.
+type subjectStore struct {
+	scope      *gocb.Scope
+	collection *gocb.Collection
+}
+
+// NewSubjectStore creates a new instance of subjectStore with the given Couchbase scope.
+func NewSubjectStore(scope *gocb.Scope) (subject.Store, error) {
+	collection := scope.Collection("subjects")
+	return &subjectStore{
+		scope:      scope,
+		collection: collection,
+	}, nil
+}
+
+// Put stores the given subject.Data in the Couchbase collection.
+func (s *subjectStore) Put(ctx context.Context, data subject.Data) error {
+	_, err := s.collection.Upsert(data.Subject, data, nil)
+	return err
+}
+
+// Get retrieves the subject.Data of the given pairwise subject identifier from the Couchbase collection.
+func (s *subjectStore) Get(ctx context.Context, sub string) (*subject.Data, error) {
+	var data subject.Data
+	doc, err := s.collection.Get(sub, nil)
+	if err != nil {
+		if errors.Is(err, gocb.ErrDocumentNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	err = doc.Content(&data)
+	if err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// DeleteByAccount removes all the pairwise subject identifiers of the given account.
+func (s *subjectStore) DeleteByAccount(ctx context.Context, accountID string) error {
+	query := "DELETE FROM `" + s.collection.Name() + "` as s WHERE s.AccountID = $accountID"
+	parameters := map[string]interface{}{
+		"accountID": accountID,
+	}
+
+	rows, err := s.scope.Query(query, &gocb.QueryOptions{
+		NamedParameters: parameters,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete subjects: %w", err)
+	}
+	return rows.Close()
+}
@@ -2,6 +2,8 @@ package memory
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	"github.com/simonhege/nestor/auth"
 )
@@ -9,16 +11,28 @@ import (
 // AuthStore is an in-memory implementation of the auth.Store interface.
 type AuthStore struct {
 	Data map[string]auth.AuthData
+
+	mu sync.Mutex
 }
 
-// Put stores the given AuthData in the in-memory store.
+// Put stores the given AuthData in the in-memory store, and removes the expired codes.
 func (s *AuthStore) Put(ctx context.Context, authData auth.AuthData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tNow := time.Now()
+	for code, data := range s.Data {
+		if !data.ExpiresAt.IsZero() && tNow.After(data.ExpiresAt) {
+			delete(s.Data, code)
+		}
+	}
 	s.Data[authData.Code] = authData
 	return nil
 }
 
 // Get retrieves the AuthData associated with the given code from the in-memory store.
 func (s *AuthStore) Get(ctx context.Context, code string) (*auth.AuthData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	authData, exists := s.Data[code]
 	if !exists {
 		return nil, nil
@@ -28,6 +42,25 @@ func (s *AuthStore) Get(ctx context.Context, code string) (*auth.AuthData, error
 
 // Delete removes the AuthData associated with the given code from the in-memory store.
 func (s *AuthStore) Delete(ctx context.Context, code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	delete(s.Data, code)
 	return nil
 }
+
+// Consume marks the AuthData associated with the given code as consumed in the in-memory store.
+func (s *AuthStore) Consume(ctx context.Context, code, familyID string) (*auth.AuthData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	authData, exists := s.Data[code]
+	if !exists {
+		return nil, nil
+	}
+	if !authData.Consumed {
+		consumed := authData
+		consumed.Consumed = true
+		consumed.FamilyID = familyID
+		s.Data[code] = consumed
+	}
+	return &authData, nil
+}
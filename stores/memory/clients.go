@@ -0,0 +1,33 @@
+package memory
+
+import (
+	"context"
+
+	"github.com/simonhege/nestor/clients"
+)
+
+// ClientStore is an in-memory implementation of the clients.Store interface.
+type ClientStore struct {
+	Data map[string]clients.Data
+}
+
+// Put stores the given clients.Data in the in-memory store.
+func (s *ClientStore) Put(ctx context.Context, data clients.Data) error {
+	s.Data[data.ClientID] = data
+	return nil
+}
+
+// Get retrieves the clients.Data associated with the given client ID from the in-memory store.
+func (s *ClientStore) Get(ctx context.Context, clientID string) (*clients.Data, error) {
+	data, exists := s.Data[clientID]
+	if !exists {
+		return nil, nil
+	}
+	return &data, nil
+}
+
+// Delete removes the clients.Data associated with the given client ID from the in-memory store.
+func (s *ClientStore) Delete(ctx context.Context, clientID string) error {
+	delete(s.Data, clientID)
+	return nil
+}
@@ -0,0 +1,41 @@
+package memory
+
+import (
+	"context"
+
+	"github.com/simonhege/nestor/consent"
+)
+
+// ConsentStore is an in-memory implementation of the consent.Store interface.
+type ConsentStore struct {
+	Data map[string]consent.Data
+}
+
+// Put stores the given consent.Data in the in-memory store.
+func (s *ConsentStore) Put(ctx context.Context, data consent.Data) error {
+	s.Data[consentKey(data.AccountID, data.ClientID)] = data
+	return nil
+}
+
+// Get retrieves the consent.Data of the given account and client from the in-memory store.
+func (s *ConsentStore) Get(ctx context.Context, accountID, clientID string) (*consent.Data, error) {
+	data, exists := s.Data[consentKey(accountID, clientID)]
+	if !exists {
+		return nil, nil
+	}
+	return &data, nil
+}
+
+// DeleteByAccount removes all the consents of the given account.
+func (s *ConsentStore) DeleteByAccount(ctx context.Context, accountID string) error {
+	for key, data := range s.Data {
+		if data.AccountID == accountID {
+			delete(s.Data, key)
+		}
+	}
+	return nil
+}
+
+func consentKey(accountID, clientID string) string {
+	return accountID + "::" + clientID
+}
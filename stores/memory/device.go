@@ -0,0 +1,81 @@
+package memory
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/simonhege/nestor/device"
+)
+
+// DeviceStore is an in-memory implementation of the device.Store interface.
+type DeviceStore struct {
+	Data map[string]device.Data
+
+	mu sync.Mutex
+}
+
+// Put stores the given device.Data in the in-memory store.
+func (s *DeviceStore) Put(ctx context.Context, data device.Data) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Data[data.DeviceCodeHash] = data
+	return nil
+}
+
+// Get retrieves the device.Data associated with the given device code hash from the in-memory store.
+func (s *DeviceStore) Get(ctx context.Context, deviceCodeHash string) (*device.Data, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, exists := s.Data[deviceCodeHash]
+	if !exists {
+		return nil, nil
+	}
+	return &data, nil
+}
+
+// GetByUserCode retrieves the device.Data associated with the given user code from the in-memory store.
+func (s *DeviceStore) GetByUserCode(ctx context.Context, userCode string) (*device.Data, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, data := range s.Data {
+		if data.UserCode == userCode {
+			return &data, nil
+		}
+	}
+	return nil, nil
+}
+
+// Delete removes the device.Data associated with the given device code hash from the in-memory store.
+func (s *DeviceStore) Delete(ctx context.Context, deviceCodeHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Data, deviceCodeHash)
+	return nil
+}
+
+// RecordPoll sets the last poll time and the polling interval of the pending device.Data in the in-memory store.
+func (s *DeviceStore) RecordPoll(ctx context.Context, deviceCodeHash string, polledAt time.Time, interval int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, exists := s.Data[deviceCodeHash]
+	if !exists || data.Status != device.StatusPending {
+		return false, nil
+	}
+	data.LastPolledAt = polledAt
+	data.Interval = interval
+	s.Data[deviceCodeHash] = data
+	return true, nil
+}
+
+// Consume removes the approved device.Data associated with the given device code hash from the in-memory store.
+func (s *DeviceStore) Consume(ctx context.Context, deviceCodeHash string) (*device.Data, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, exists := s.Data[deviceCodeHash]
+	if !exists || data.Status != device.StatusApproved {
+		return nil, nil
+	}
+	delete(s.Data, deviceCodeHash)
+	return &data, nil
+}
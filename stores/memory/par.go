@@ -0,0 +1,54 @@
+package memory
+
+import (
+	"context"
+	"sync"
+
+	"github.com/simonhege/nestor/par"
+)
+
+// PARStore is an in-memory implementation of the par.Store interface.
+type PARStore struct {
+	Data map[string]par.Data
+
+	mu sync.Mutex
+}
+
+// Put stores the given par.Data in the in-memory store.
+func (s *PARStore) Put(ctx context.Context, data par.Data) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Data[data.RequestURI] = data
+	return nil
+}
+
+// Get retrieves the par.Data associated with the given request URI from the in-memory store.
+func (s *PARStore) Get(ctx context.Context, requestURI string) (*par.Data, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, exists := s.Data[requestURI]
+	if !exists {
+		return nil, nil
+	}
+	return &data, nil
+}
+
+// Delete removes the par.Data associated with the given request URI from the in-memory store.
+func (s *PARStore) Delete(ctx context.Context, requestURI string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Data, requestURI)
+	return nil
+}
+
+// Consume removes the par.Data associated with the given request URI from the in-memory store and returns it.
+func (s *PARStore) Consume(ctx context.Context, requestURI string) (*par.Data, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, exists := s.Data[requestURI]
+	if !exists {
+		return nil, nil
+	}
+	delete(s.Data, requestURI)
+	return &data, nil
+}
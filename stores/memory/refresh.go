@@ -2,6 +2,8 @@ package memory
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	"github.com/simonhege/nestor/refresh"
 )
@@ -9,16 +11,28 @@ import (
 // RefreshStore is an in-memory implementation of the refresh.Store interface.
 type RefreshStore struct {
 	Data map[string]refresh.Data
+
+	mu sync.Mutex
 }
 
-// Put stores the given refresh.Data in the in-memory store.
+// Put stores the given refresh.Data in the in-memory store, and removes the expired tokens.
 func (s *RefreshStore) Put(ctx context.Context, data refresh.Data) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tNow := time.Now()
+	for tokenHash, stored := range s.Data {
+		if !stored.ExpiresAt.IsZero() && tNow.After(stored.ExpiresAt) {
+			delete(s.Data, tokenHash)
+		}
+	}
 	s.Data[data.TokenHash] = data
 	return nil
 }
 
 // Get retrieves the refresh.Data associated with the given token hash from the in-memory store.
 func (s *RefreshStore) Get(ctx context.Context, tokenHash string) (*refresh.Data, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	data, exists := s.Data[tokenHash]
 	if !exists {
 		return nil, nil
@@ -28,6 +42,52 @@ func (s *RefreshStore) Get(ctx context.Context, tokenHash string) (*refresh.Data
 
 // Delete removes the refresh.Data associated with the given token hash from the in-memory store.
 func (s *RefreshStore) Delete(ctx context.Context, tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	delete(s.Data, tokenHash)
 	return nil
 }
+
+// DeleteByClientAndAccount removes all the refresh.Data issued to the given client for the given account.
+func (s *RefreshStore) DeleteByClientAndAccount(ctx context.Context, clientID, accountID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for tokenHash, data := range s.Data {
+		if data.ClientID == clientID && data.AccountID == accountID {
+			delete(s.Data, tokenHash)
+		}
+	}
+	return nil
+}
+
+// GetByFamily retrieves all the refresh.Data of the given token family from the in-memory store.
+func (s *RefreshStore) GetByFamily(ctx context.Context, familyID string) ([]refresh.Data, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var family []refresh.Data
+	for _, data := range s.Data {
+		if data.FamilyID == familyID {
+			family = append(family, data)
+		}
+	}
+	return family, nil
+}
+
+// Consume marks the refresh.Data associated with the given token hash as consumed in the in-memory store.
+func (s *RefreshStore) Consume(ctx context.Context, tokenHash, familyID string) (*refresh.Data, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, exists := s.Data[tokenHash]
+	if !exists {
+		return nil, nil
+	}
+	if !data.Consumed {
+		consumed := data
+		consumed.Consumed = true
+		if consumed.FamilyID == "" {
+			consumed.FamilyID = familyID
+		}
+		s.Data[tokenHash] = consumed
+	}
+	return &data, nil
+}
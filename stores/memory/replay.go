@@ -0,0 +1,31 @@
+package memory
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ReplayStore is an in-memory implementation of the replay.Store interface.
+type ReplayStore struct {
+	Data map[string]time.Time
+
+	mu sync.Mutex
+}
+
+// Use marks id as used until expiresAt in the in-memory store, and removes the expired identifiers.
+func (s *ReplayStore) Use(ctx context.Context, id string, expiresAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tNow := time.Now()
+	for usedID, usedUntil := range s.Data {
+		if !tNow.Before(usedUntil) {
+			delete(s.Data, usedID)
+		}
+	}
+	if _, exists := s.Data[id]; exists {
+		return false, nil
+	}
+	s.Data[id] = expiresAt
+	return true, nil
+}
@@ -0,0 +1,33 @@
+package memory
+
+import (
+	"context"
+
+	"github.com/simonhege/nestor/session"
+)
+
+// SessionStore is an in-memory implementation of the session.Store interface.
+type SessionStore struct {
+	Data map[string]session.Data
+}
+
+// Put stores the given session.Data in the in-memory store.
+func (s *SessionStore) Put(ctx context.Context, data session.Data) error {
+	s.Data[data.ID] = data
+	return nil
+}
+
+// Get retrieves the session.Data associated with the given id from the in-memory store.
+func (s *SessionStore) Get(ctx context.Context, id string) (*session.Data, error) {
+	data, exists := s.Data[id]
+	if !exists {
+		return nil, nil
+	}
+	return &data, nil
+}
+
+// Delete removes the session.Data associated with the given id from the in-memory store.
+func (s *SessionStore) Delete(ctx context.Context, id string) error {
+	delete(s.Data, id)
+	return nil
+}
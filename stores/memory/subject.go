@@ -0,0 +1,46 @@
+package memory
+
+import (
+	"context"
+	"sync"
+
+	"github.com/simonhege/nestor/subject"
+)
+
+// SubjectStore is an in-memory implementation of the subject.Store interface.
+type SubjectStore struct {
+	Data map[string]subject.Data
+
+	mu sync.Mutex
+}
+
+// Put stores the given subject.Data in the in-memory store.
+func (s *SubjectStore) Put(ctx context.Context, data subject.Data) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Data[data.Subject] = data
+	return nil
+}
+
+// Get retrieves the subject.Data of the given pairwise subject identifier from the in-memory store.
+func (s *SubjectStore) Get(ctx context.Context, sub string) (*subject.Data, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, exists := s.Data[sub]
+	if !exists {
+		return nil, nil
+	}
+	return &data, nil
+}
+
+// DeleteByAccount removes all the pairwise subject identifiers of the given account.
+func (s *SubjectStore) DeleteByAccount(ctx context.Context, accountID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sub, data := range s.Data {
+		if data.AccountID == accountID {
+			delete(s.Data, sub)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+package subject
+
+import "context"
+
+// Data maps a pairwise subject identifier back to the account it was derived from.
+type Data struct {
+	Subject          string
+	SectorIdentifier string
+	AccountID        string
+}
+
+// Store defines pairwise subject identifier persistence operations.
+type Store interface {
+	Put(ctx context.Context, data Data) error
+	Get(ctx context.Context, subject string) (*Data, error)
+	DeleteByAccount(ctx context.Context, accountID string) error
+}
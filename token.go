@@ -1,6 +1,7 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
@@ -8,9 +9,10 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"net/http"
-	"net/http/httputil"
 	"slices"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -20,44 +22,75 @@ import (
 )
 
 const (
-	accessTokenTTL  = 1 * time.Hour
-	refreshTokenTTL = 30 * 24 * time.Hour
+	authorizationCodeTTL = 10 * time.Minute // Maximum recommended by RFC 6749 Section 4.1.2
+	accessTokenTTL       = 1 * time.Hour
+	refreshTokenTTL      = 30 * 24 * time.Hour
 )
 
 func (a *app) handleToken(w http.ResponseWriter, req *http.Request) {
 	ctx := req.Context()
-	// Dump the request for debugging purposes
-	b, _ := httputil.DumpRequest(req, true)
-	slog.DebugContext(ctx, "token request received", "request", string(b))
-
-	clientID := req.FormValue("client_id")
+	// The request holds client secrets and assertions, only its grant type is logged
 	grantType := req.FormValue("grant_type")
-	var (
-		resp tokenResponse
-		err  error
-	)
+	slog.DebugContext(ctx, "token request received", "grant_type", grantType)
+	var resp tokenResponse
+
+	client, err := a.authenticateClient(req)
+	if err != nil {
+		var oauthErr *oauthError
+		if errors.As(err, &oauthErr) {
+			writeOAuthError(w, req, oauthErr)
+			return
+		}
+		slog.ErrorContext(ctx, "Client authentication failed", "grant_type", grantType, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	clientID := client.ClientID
+
+	// A DPoP proof binds the issued tokens to the key of the client (RFC 9449)
+	var jkt string
+	if len(req.Header.Values("DPoP")) > 0 {
+		jkt, err = a.verifyDPoPProof(req, "")
+		if err != nil {
+			var oauthErr *oauthError
+			if errors.As(err, &oauthErr) {
+				writeOAuthError(w, req, oauthErr)
+				return
+			}
+			slog.ErrorContext(ctx, "DPoP proof verification failed", "client_id", clientID, "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if slices.Contains(supportedGrantTypes, grantType) && !client.allowsGrantType(grantType) {
+		slog.WarnContext(ctx, "Grant type not allowed for the client", "client_id", clientID, "grant_type", grantType)
+		writeOAuthError(w, req, newOAuthError("unauthorized_client", "The client is not allowed to use the grant_type '"+grantType+"'"))
+		return
+	}
 
 	switch grantType {
 	case "authorization_code":
-		resp, err = a.handleAuthorizationCodeGrant(ctx, clientID, req)
+		resp, err = a.handleAuthorizationCodeGrant(ctx, client, req, jkt)
 	case "refresh_token":
-		resp, err = a.handleRefreshTokenGrant(ctx, clientID, req)
+		resp, err = a.handleRefreshTokenGrant(ctx, client, req, jkt)
+	case "client_credentials":
+		resp, err = a.handleClientCredentialsGrant(ctx, client, req, jkt)
+	case deviceCodeGrantType:
+		resp, err = a.handleDeviceCodeGrant(ctx, client, req, jkt)
+	case tokenExchangeGrantType:
+		resp, err = a.handleTokenExchangeGrant(ctx, client, req, jkt)
+	case "":
+		slog.WarnContext(ctx, "Missing grant_type", "client_id", clientID)
+		err = newOAuthError("invalid_request", "grant_type is required")
 	default:
 		slog.WarnContext(ctx, "Unsupported grant_type", "client_id", clientID, "grant_type", grantType)
-		http.Error(w, "Bad request", http.StatusBadRequest)
-		return
+		err = newOAuthError("unsupported_grant_type", "Unsupported grant_type '"+grantType+"'")
 	}
 	if err != nil {
-		if errors.Is(err, errBadRequest) {
-			http.Error(w, "Bad request", http.StatusBadRequest)
-			return
-		}
-		if errors.Is(err, errUnauthorized) {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		if errors.Is(err, errForbidden) {
-			http.Error(w, "Forbidden", http.StatusForbidden)
+		var oauthErr *oauthError
+		if errors.As(err, &oauthErr) {
+			writeOAuthError(w, req, oauthErr)
 			return
 		}
 
@@ -66,65 +99,94 @@ func (a *app) handleToken(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	w.Header().Set("Cache-Control", "no-store")
 	server.RenderJSON(w, resp)
 }
 
-var (
-	errBadRequest   = errors.New("bad request")
-	errUnauthorized = errors.New("unauthorized")
-	errForbidden    = errors.New("forbidden")
-)
-
-func (a *app) handleAuthorizationCodeGrant(ctx context.Context, clientID string, req *http.Request) (tokenResponse, error) {
+func (a *app) handleAuthorizationCodeGrant(ctx context.Context, client *client, req *http.Request, jkt string) (tokenResponse, error) {
+	clientID := client.ClientID
 	code := req.FormValue("code")
 	codeVerifier := req.FormValue("code_verifier")
-	if code == "" || codeVerifier == "" {
-		slog.WarnContext(ctx, "Missing code or code_verifier", "client_id", clientID)
-		return tokenResponse{}, errBadRequest
+	if code == "" {
+		slog.WarnContext(ctx, "Missing code", "client_id", clientID)
+		return tokenResponse{}, newOAuthError("invalid_request", "code is required")
+	}
+	// PKCE is mandatory for public clients, confidential clients may rely on their credentials only
+	if codeVerifier == "" && !client.isConfidential() {
+		slog.WarnContext(ctx, "Missing code_verifier", "client_id", clientID)
+		return tokenResponse{}, newOAuthError("invalid_request", "code_verifier is required")
 	}
 
-	authData, err := a.authStore.Get(ctx, code)
+	// The code is consumed before anything else, so that only one of concurrent redemptions gets tokens
+	familyID := rand.Text()
+	authData, err := a.authStore.Consume(ctx, code, familyID)
 	if err != nil {
-		slog.ErrorContext(ctx, "Failed to retrieve authorization data", "client_id", clientID, "code", code, "error", err)
+		slog.ErrorContext(ctx, "Failed to consume authorization data", "client_id", clientID, "code", code, "error", err)
 		return tokenResponse{}, err
 	}
 	if authData == nil {
 		slog.WarnContext(ctx, "Authorization code not found", "client_id", clientID, "code", code)
-		return tokenResponse{}, errBadRequest
+		return tokenResponse{}, newOAuthError("invalid_grant", "Unknown authorization code")
+	}
+	// RFC 6749 Section 4.1.2: the tokens already issued from a reused code should be revoked
+	if authData.Consumed {
+		slog.WarnContext(ctx, "Security event: authorization code reuse detected, revoking the tokens issued from it", "client_id", clientID, "account_id", authData.AccountID, "family_id", authData.FamilyID)
+		if err := a.revokeRefreshTokenFamily(ctx, authData.FamilyID); err != nil {
+			return tokenResponse{}, err
+		}
+		return tokenResponse{}, newOAuthError("invalid_grant", "The authorization code was already used")
+	}
+	if time.Now().After(authData.ExpiresAt) {
+		slog.WarnContext(ctx, "Authorization code expired", "client_id", clientID)
+		return tokenResponse{}, newOAuthError("invalid_grant", "The authorization code expired")
 	}
 	if authData.ClientID != clientID {
 		slog.WarnContext(ctx, "Incorrect client id", "client_id", clientID, "authData.ClientID", authData.ClientID)
-		return tokenResponse{}, errBadRequest
-	}
-
-	codeChallengeResult, err := a.computeCodeChallenge(ctx, authData.CodeChallengeMethod, codeVerifier)
-	if err != nil {
-		slog.ErrorContext(ctx, "Failed to compute code challenge", "error", err)
-		return tokenResponse{}, err
+		return tokenResponse{}, newOAuthError("invalid_grant", "The authorization code was issued to another client")
 	}
-	if codeChallengeResult != authData.CodeChallenge {
-		slog.WarnContext(ctx, "Incorrect code challenge")
-		return tokenResponse{}, errBadRequest
+	// RFC 6749 Section 4.1.3: the redirect_uri must be identical to the one of the authorization request
+	if redirectURI := req.FormValue("redirect_uri"); redirectURI != authData.RedirectURI {
+		slog.WarnContext(ctx, "Redirect URI mismatch", "client_id", clientID, "redirect_uri", redirectURI)
+		return tokenResponse{}, newOAuthError("invalid_grant", "The redirect_uri does not match the authorization request")
 	}
 
-	resp, err := a.issueTokens(ctx, clientID, authData.AccountID, authData.GrantedScopes)
-	if err != nil {
-		return tokenResponse{}, err
+	if authData.CodeChallenge != "" || codeVerifier != "" {
+		codeChallengeResult, err := a.computeCodeChallenge(ctx, authData.CodeChallengeMethod, codeVerifier)
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to compute code challenge", "error", err)
+			return tokenResponse{}, wrapOAuthError("invalid_grant", "Unsupported code_challenge_method", err)
+		}
+		if codeVerifier == "" || codeChallengeResult != authData.CodeChallenge {
+			slog.WarnContext(ctx, "Incorrect code challenge")
+			return tokenResponse{}, newOAuthError("invalid_grant", "PKCE verification failed")
+		}
 	}
 
-	if err := a.authStore.Delete(ctx, code); err != nil {
-		slog.ErrorContext(ctx, "Failed to delete authorization data", "client_id", clientID, "code", code, "error", err)
+	resp, err := a.issueTokens(ctx, grant{
+		ClientID:      clientID,
+		AccountID:     authData.AccountID,
+		GrantedScopes: authData.GrantedScopes,
+		Nonce:         authData.Nonce,
+		AuthTime:      authData.AuthTime,
+		JKT:           jkt,
+		Resources:     authData.Resources,
+		Audience:      req.Form["resource"],
+		Claims:        requestedClaims{UserInfo: authData.UserInfoClaims, IDToken: authData.IDTokenClaims},
+		FamilyID:      familyID,
+	})
+	if err != nil {
 		return tokenResponse{}, err
 	}
 
 	return resp, nil
 }
 
-func (a *app) handleRefreshTokenGrant(ctx context.Context, clientID string, req *http.Request) (tokenResponse, error) {
+func (a *app) handleRefreshTokenGrant(ctx context.Context, client *client, req *http.Request, jkt string) (tokenResponse, error) {
+	clientID := client.ClientID
 	rawRefreshToken := req.FormValue("refresh_token")
 	if rawRefreshToken == "" {
 		slog.WarnContext(ctx, "Missing refresh token", "client_id", clientID)
-		return tokenResponse{}, errBadRequest
+		return tokenResponse{}, newOAuthError("invalid_request", "refresh_token is required")
 	}
 
 	tokenHash := hashToken(rawRefreshToken)
@@ -135,32 +197,115 @@ func (a *app) handleRefreshTokenGrant(ctx context.Context, clientID string, req
 	}
 	if storedRefreshData == nil {
 		slog.WarnContext(ctx, "Unknown refresh token", "client_id", clientID)
-		return tokenResponse{}, errUnauthorized
+		return tokenResponse{}, newOAuthError("invalid_grant", "Unknown refresh token")
 	}
 
 	if storedRefreshData.ClientID != clientID {
 		slog.WarnContext(ctx, "Refresh token client mismatch", "client_id", clientID, "stored_client_id", storedRefreshData.ClientID)
-		return tokenResponse{}, errBadRequest
+		return tokenResponse{}, newOAuthError("invalid_grant", "The refresh token was issued to another client")
+	}
+	// A rotated token presented again was stolen from the client or the attacker was first,
+	// the whole family is revoked so that neither can keep using it (RFC 9700 Section 4.14.2)
+	if storedRefreshData.Consumed {
+		slog.WarnContext(ctx, "Security event: refresh token reuse detected, revoking its family", "client_id", clientID, "account_id", storedRefreshData.AccountID, "family_id", storedRefreshData.FamilyID)
+		if err := a.revokeRefreshTokenFamily(ctx, storedRefreshData.FamilyID); err != nil {
+			return tokenResponse{}, err
+		}
+		return tokenResponse{}, newOAuthError("invalid_grant", "The refresh token was already used")
 	}
 	if time.Now().After(storedRefreshData.ExpiresAt) {
 		slog.WarnContext(ctx, "Refresh token expired", "client_id", clientID)
-		return tokenResponse{}, errUnauthorized
+		return tokenResponse{}, newOAuthError("invalid_grant", "The refresh token expired")
+	}
+	// RFC 9449 Section 5: a refresh token bound to a DPoP key requires a proof of possession of the same key
+	if storedRefreshData.JKT != "" && storedRefreshData.JKT != jkt {
+		slog.WarnContext(ctx, "Refresh token DPoP key mismatch", "client_id", clientID, "jkt", jkt)
+		return tokenResponse{}, newOAuthError("invalid_dpop_proof", "The refresh token is bound to another DPoP key")
+	}
+
+	// Tokens issued before auth_time was tracked fall back to the refresh token creation time
+	authTime := storedRefreshData.AuthTime
+	if authTime.IsZero() {
+		authTime = storedRefreshData.CreatedAt
 	}
 
-	resp, err := a.issueTokens(ctx, clientID, storedRefreshData.AccountID, storedRefreshData.GrantedScopes)
+	// The token is consumed atomically before the new tokens are issued, so that of concurrent requests with it
+	// only one rotates it and the others count as a reuse. Tokens issued before families were tracked start one.
+	familyID := cmp.Or(storedRefreshData.FamilyID, rand.Text())
+	consumed, err := a.refreshStore.Consume(ctx, tokenHash, familyID)
 	if err != nil {
+		slog.ErrorContext(ctx, "Failed to rotate refresh token (consume old)", "client_id", clientID, "error", err)
 		return tokenResponse{}, err
 	}
+	if consumed == nil {
+		slog.WarnContext(ctx, "Refresh token revoked during rotation", "client_id", clientID)
+		return tokenResponse{}, newOAuthError("invalid_grant", "Unknown refresh token")
+	}
+	if consumed.Consumed {
+		slog.WarnContext(ctx, "Security event: concurrent refresh token reuse detected, revoking its family", "client_id", clientID, "account_id", consumed.AccountID, "family_id", consumed.FamilyID)
+		if err := a.revokeRefreshTokenFamily(ctx, consumed.FamilyID); err != nil {
+			return tokenResponse{}, err
+		}
+		return tokenResponse{}, newOAuthError("invalid_grant", "The refresh token was already used")
+	}
 
-	if err := a.refreshStore.Delete(ctx, tokenHash); err != nil {
-		slog.ErrorContext(ctx, "Failed to rotate refresh token (delete old)", "client_id", clientID, "error", err)
+	// The nonce is bound to the original authentication request, it is not repeated on refresh.
+	// RFC 8707 Section 2.2: the resource parameter narrows the audience of the new access token only.
+	resp, err := a.issueTokens(ctx, grant{
+		ClientID:      clientID,
+		AccountID:     storedRefreshData.AccountID,
+		GrantedScopes: storedRefreshData.GrantedScopes,
+		AuthTime:      authTime,
+		JKT:           jkt,
+		Resources:     storedRefreshData.Resources,
+		Audience:      req.Form["resource"],
+		Claims:        requestedClaims{UserInfo: storedRefreshData.UserInfoClaims, IDToken: storedRefreshData.IDTokenClaims},
+		FamilyID:      familyID,
+	})
+	if err != nil {
 		return tokenResponse{}, err
 	}
 
 	return resp, nil
 }
 
-func (a *app) issueTokens(ctx context.Context, clientID, accountID string, grantedScopes []string) (tokenResponse, error) {
+// revokeRefreshTokenFamily deletes all the refresh tokens rotated from the same original grant.
+func (a *app) revokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	if familyID == "" {
+		return nil
+	}
+	family, err := a.refreshStore.GetByFamily(ctx, familyID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to retrieve refresh token family", "family_id", familyID, "error", err)
+		return err
+	}
+	for _, data := range family {
+		if err := a.refreshStore.Delete(ctx, data.TokenHash); err != nil {
+			slog.ErrorContext(ctx, "Failed to revoke refresh token", "family_id", familyID, "error", err)
+			return err
+		}
+	}
+	slog.InfoContext(ctx, "Refresh token family revoked", "family_id", familyID, "tokens", len(family))
+	return nil
+}
+
+// grant describes an authorization given by an account to a client, tokens are issued from it.
+type grant struct {
+	ClientID      string
+	AccountID     string
+	GrantedScopes []string
+	Nonce         string
+	AuthTime      time.Time       // Time of the end-user authentication
+	JKT           string          // Thumbprint of the DPoP key the tokens are bound to, if any
+	Resources     []string        // Resource indicators granted to the client
+	Audience      []string        // Resources requested for the access token, a subset of Resources
+	Claims        requestedClaims // Claims requested with the claims parameter, besides the claims of the granted scopes
+	FamilyID      string          // Family of the refresh token the grant is rotated from, a new family when empty
+}
+
+func (a *app) issueTokens(ctx context.Context, g grant) (tokenResponse, error) {
+	clientID, accountID, grantedScopes := g.ClientID, g.AccountID, g.GrantedScopes
+
 	acc, err := a.accountStore.GetById(ctx, accountID)
 	if err != nil {
 		slog.ErrorContext(ctx, "Failed to retrieve account", "account_id", accountID, "error", err)
@@ -168,11 +313,11 @@ func (a *app) issueTokens(ctx context.Context, clientID, accountID string, grant
 	}
 	if acc == nil {
 		slog.WarnContext(ctx, "Account not found", "account_id", accountID)
-		return tokenResponse{}, errUnauthorized
+		return tokenResponse{}, newOAuthError("invalid_grant", "The account no longer exists")
 	}
 	if acc.Status != account.StatusActive {
 		slog.WarnContext(ctx, "Account not active", "account_id", acc.ID, "status", acc.Status)
-		return tokenResponse{}, errForbidden
+		return tokenResponse{}, newOAuthError("invalid_grant", "The account is not active")
 	}
 
 	client, err := a.getClient(ctx, clientID)
@@ -182,16 +327,41 @@ func (a *app) issueTokens(ctx context.Context, clientID, accountID string, grant
 	}
 	if client == nil {
 		slog.WarnContext(ctx, "Client not found", "client_id", clientID)
-		return tokenResponse{}, errUnauthorized
+		return tokenResponse{}, newOAuthError("invalid_client", "Unknown client")
 	}
 
-	accessToken, err := a.createSignedToken(ctx, client.DefaultResourceIndicator, acc)
+	sub, err := a.subjectFor(ctx, client, acc.ID)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+
+	audience, err := tokenAudience(client, g.Resources, g.Audience)
+	if err != nil {
+		slog.WarnContext(ctx, "Resource not granted", "client_id", clientID, "resource", g.Audience)
+		return tokenResponse{}, err
+	}
+	accessTokenClaims := jwt.MapClaims{
+		"aud":       audienceClaim(audience),
+		"sub":       sub,
+		"client_id": clientID,
+		"scope":     strings.Join(grantedScopes, " "),
+	}
+	maps.Copy(accessTokenClaims, a.accountAttributeClaims(audience, acc))
+	if len(g.Claims.UserInfo) > 0 {
+		accessTokenClaims[userInfoClaimsClaim] = g.Claims.UserInfo
+	}
+	tokenType := bindToDPoPKey(accessTokenClaims, g.JKT)
+	accessToken, err := a.createAccessToken(ctx, accessTokenClaims)
 	if err != nil {
 		slog.ErrorContext(ctx, "Failed to create access token", "client_id", clientID, "error", err)
 		return tokenResponse{}, err
 	}
 
-	idToken, err := a.createSignedToken(ctx, clientID, acc)
+	idTokenClaims := releasedClaims(acc, grantedScopes, g.Claims.IDToken)
+	if g.Nonce != "" {
+		idTokenClaims["nonce"] = g.Nonce
+	}
+	idToken, err := a.createIDToken(ctx, clientID, sub, g.AuthTime, idTokenClaims)
 	if err != nil {
 		slog.ErrorContext(ctx, "Failed to create ID token", "client_id", clientID, "error", err)
 		return tokenResponse{}, err
@@ -199,7 +369,7 @@ func (a *app) issueTokens(ctx context.Context, clientID, accountID string, grant
 
 	resp := tokenResponse{
 		AccessToken: accessToken,
-		TokenType:   "Bearer",
+		TokenType:   tokenType,
 		ExpiresIn:   int(accessTokenTTL.Seconds()),
 		IDToken:     idToken,
 	}
@@ -208,12 +378,18 @@ func (a *app) issueTokens(ctx context.Context, clientID, accountID string, grant
 		rawRefreshToken := rand.Text()
 		tNow := time.Now()
 		refreshData := refresh.Data{
-			TokenHash:     hashToken(rawRefreshToken),
-			ClientID:      clientID,
-			AccountID:     acc.ID,
-			GrantedScopes: grantedScopes,
-			CreatedAt:     tNow,
-			ExpiresAt:     tNow.Add(refreshTokenTTL),
+			TokenHash:      hashToken(rawRefreshToken),
+			ClientID:       clientID,
+			AccountID:      acc.ID,
+			GrantedScopes:  grantedScopes,
+			Resources:      g.Resources,
+			UserInfoClaims: g.Claims.UserInfo,
+			IDTokenClaims:  g.Claims.IDToken,
+			AuthTime:       g.AuthTime,
+			JKT:            g.JKT,
+			FamilyID:       cmp.Or(g.FamilyID, rand.Text()),
+			CreatedAt:      tNow,
+			ExpiresAt:      tNow.Add(refreshTokenTTL),
 		}
 		if err := a.refreshStore.Put(ctx, refreshData); err != nil {
 			slog.ErrorContext(ctx, "Failed to persist refresh token", "client_id", clientID, "error", err)
@@ -240,15 +416,34 @@ func (a *app) computeCodeChallenge(context context.Context, method string, gener
 }
 
 type tokenResponse struct {
-	AccessToken  string `json:"access_token"`
-	TokenType    string `json:"token_type"`
-	ExpiresIn    int    `json:"expires_in"`
-	IDToken      string `json:"id_token,omitempty"`
-	RefreshToken string `json:"refresh_token,omitempty"`
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type,omitempty"` // Only for token exchange (RFC 8693 Section 2.2.1)
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int    `json:"expires_in"`
+	IDToken         string `json:"id_token,omitempty"`
+	RefreshToken    string `json:"refresh_token,omitempty"`
+	Scope           string `json:"scope,omitempty"`
 }
 
-func (a *app) createSignedToken(ctx context.Context, audience string, account *account.Account) (string, error) {
+// createIDToken signs an ID token for the account identified by sub to the client, authenticated at authTime,
+// extraClaims, e.g. the claims released for the granted scopes, are added to the standard claims.
+func (a *app) createIDToken(ctx context.Context, clientID, sub string, authTime time.Time, extraClaims jwt.MapClaims) (string, error) {
+	tNow := time.Now()
+	claims := jwt.MapClaims{
+		"iss":       a.oidcConfig.Issuer,
+		"aud":       clientID,
+		"iat":       tNow.Unix(),
+		"auth_time": authTime.Unix(),
+		"nbf":       tNow.Unix(),
+		"sub":       sub,
+		"exp":       tNow.Add(accessTokenTTL).Unix(),
+	}
+	maps.Copy(claims, extraClaims)
+	return a.signToken(ctx, "JWT", claims)
+}
 
+// signToken signs claims with the current signing key, typ is the media type of the token.
+func (a *app) signToken(ctx context.Context, typ string, claims jwt.MapClaims) (string, error) {
 	keys, err := a.jwks.KeyReadAll(ctx)
 	if err != nil {
 		return "", fmt.Errorf("failed to read JWKs: %w", err)
@@ -258,22 +453,9 @@ func (a *app) createSignedToken(ctx context.Context, audience string, account *a
 	}
 	k := keys[0]
 
-	tNow := time.Now()
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
-		"iss":            a.oidcConfig.Issuer,
-		"aud":            audience,
-		"iat":            tNow.Unix(),
-		"auth_time":      tNow.Unix(),
-		"nbf":            tNow.Unix(),
-		"sub":            account.ID,
-		"exp":            tNow.Add(accessTokenTTL).Unix(),
-		"email":          account.Email,
-		"email_verified": true,
-		"name":           account.Name,
-		"picture":        account.Picture,
-		"roles":          account.Roles,
-	})
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
 	token.Header["kid"] = k.Marshal().KID
+	token.Header["typ"] = typ
 
 	signedToken, err := token.SignedString(k.Key())
 	if err != nil {
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType        = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// handleTokenExchangeGrant exchanges an access token issued by Nestor for an access token
+// to another audience, on behalf of the same subject (RFC 8693).
+// The calling client, or the subject of the actor_token, is recorded as the actor in the act claim.
+// The subject token must have been issued for a resource of the calling client, and the DPoP binding is kept.
+func (a *app) handleTokenExchangeGrant(ctx context.Context, client *client, req *http.Request, jkt string) (tokenResponse, error) {
+	clientID := client.ClientID
+	if !client.isConfidential() {
+		slog.WarnContext(ctx, "Public client cannot exchange tokens", "client_id", clientID)
+		return tokenResponse{}, newOAuthError("unauthorized_client", "Token exchange requires a confidential client")
+	}
+	if requested := req.FormValue("requested_token_type"); requested != "" && requested != accessTokenType {
+		slog.WarnContext(ctx, "Unsupported requested_token_type", "client_id", clientID, "requested_token_type", requested)
+		return tokenResponse{}, newOAuthError("invalid_request", "Only access tokens can be requested")
+	}
+
+	// The audience and the resource both designate the target service, it must be allowed by the client policy
+	audience := req.FormValue("audience")
+	if resource := req.FormValue("resource"); resource != "" {
+		if audience != "" && audience != resource {
+			slog.WarnContext(ctx, "Conflicting audience and resource", "client_id", clientID, "audience", audience, "resource", resource)
+			return tokenResponse{}, newOAuthError("invalid_target", "audience and resource designate different targets")
+		}
+		audience = resource
+	}
+	if audience == "" {
+		slog.WarnContext(ctx, "Missing audience for token exchange", "client_id", clientID)
+		return tokenResponse{}, newOAuthError("invalid_target", "audience or resource is required")
+	}
+	if !slices.Contains(client.TokenExchangeAudiences, audience) {
+		slog.WarnContext(ctx, "Token exchange audience not allowed", "client_id", clientID, "audience", audience)
+		return tokenResponse{}, newOAuthError("invalid_target", "The client is not allowed to exchange tokens for this audience")
+	}
+
+	subject, err := a.exchangedToken(ctx, req.FormValue("subject_token"), req.FormValue("subject_token_type"))
+	if err != nil {
+		slog.WarnContext(ctx, "Invalid subject_token", "client_id", clientID, "error", err)
+		return tokenResponse{}, err
+	}
+	// The caller must be an audience of the subject token, a token intercepted elsewhere cannot be exchanged
+	subjectAudience, _ := subject.GetAudience()
+	if !slices.ContainsFunc(subjectAudience, client.allowsResource) {
+		slog.WarnContext(ctx, "Subject token audience not allowed", "client_id", clientID, "aud", subjectAudience)
+		return tokenResponse{}, newOAuthError("invalid_grant", "The subject_token was not issued for a resource of the client")
+	}
+	// RFC 9449: a token bound to a DPoP key cannot be exchanged for a bearer token or a token bound to another key
+	if subjectJKT := boundDPoPKey(subject); subjectJKT != "" {
+		if jkt != "" && jkt != subjectJKT {
+			slog.WarnContext(ctx, "Subject token DPoP key mismatch", "client_id", clientID, "jkt", jkt)
+			return tokenResponse{}, newOAuthError("invalid_dpop_proof", "The subject_token is bound to another DPoP key")
+		}
+		jkt = subjectJKT
+	}
+	sub, _ := subject.GetSubject()
+	active, err := a.isSubjectActive(ctx, sub)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	if !active {
+		slog.WarnContext(ctx, "Token exchange subject not active", "client_id", clientID, "sub", sub)
+		return tokenResponse{}, newOAuthError("invalid_grant", "The subject is not active")
+	}
+
+	// The exchanged token cannot be granted more scopes than the subject token
+	subjectScope, _ := subject["scope"].(string)
+	subjectScopes := strings.Fields(subjectScope)
+	scopes := subjectScopes
+	if scope := req.FormValue("scope"); scope != "" {
+		scopes = strings.Fields(scope)
+		for _, s := range scopes {
+			if !slices.Contains(subjectScopes, s) {
+				slog.WarnContext(ctx, "Scope not granted to the subject token", "client_id", clientID, "scope", s)
+				return tokenResponse{}, newOAuthError("invalid_scope", "The scope '"+s+"' was not granted to the subject_token")
+			}
+		}
+	}
+
+	// RFC 8693 Section 4.1: the current actor comes first, the previous actors of the subject token are nested
+	act := jwt.MapClaims{"sub": clientID}
+	if actorToken := req.FormValue("actor_token"); actorToken != "" {
+		actor, err := a.exchangedToken(ctx, actorToken, req.FormValue("actor_token_type"))
+		if err != nil {
+			slog.WarnContext(ctx, "Invalid actor_token", "client_id", clientID, "error", err)
+			return tokenResponse{}, err
+		}
+		act["sub"], _ = actor.GetSubject()
+	} else if req.FormValue("actor_token_type") != "" {
+		return tokenResponse{}, newOAuthError("invalid_request", "actor_token_type requires an actor_token")
+	}
+	if previous, ok := subject["act"]; ok {
+		act["act"] = previous
+	}
+
+	// The exchanged token does not outlive the subject token
+	exp := time.Now().Add(accessTokenTTL)
+	if subjectExp, err := subject.GetExpirationTime(); err == nil && subjectExp != nil && subjectExp.Before(exp) {
+		exp = subjectExp.Time
+	}
+	claims := jwt.MapClaims{
+		"aud":       audience,
+		"exp":       exp.Unix(),
+		"sub":       sub,
+		"client_id": clientID,
+		"scope":     strings.Join(scopes, " "),
+		"act":       act,
+	}
+
+	// Unless the subject is a client, the account is identified by its subject for the exchanging client
+	// and the downstream resource gets the account attributes it asked for
+	accountID, err := a.accountIDForSubject(ctx, sub)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	acc, err := a.accountStore.GetById(ctx, accountID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to retrieve account", "account_id", accountID, "error", err)
+		return tokenResponse{}, err
+	}
+	if acc != nil {
+		if claims["sub"], err = a.subjectFor(ctx, client, acc.ID); err != nil {
+			return tokenResponse{}, err
+		}
+		maps.Copy(claims, a.accountAttributeClaims(jwt.ClaimStrings{audience}, acc))
+	}
+	tokenType := bindToDPoPKey(claims, jkt)
+	accessToken, err := a.createAccessToken(ctx, claims)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to create access token", "client_id", clientID, "error", err)
+		return tokenResponse{}, err
+	}
+
+	slog.InfoContext(ctx, "Token exchanged", "client_id", clientID, "sub", sub, "aud", audience, "actor", act["sub"])
+	return tokenResponse{
+		AccessToken:     accessToken,
+		IssuedTokenType: accessTokenType,
+		TokenType:       tokenType,
+		ExpiresIn:       int(time.Until(exp).Seconds()),
+		Scope:           strings.Join(scopes, " "),
+	}, nil
+}
+
+// exchangedToken verifies a subject_token or an actor_token, which must be an access token issued by Nestor.
+// RFC 8693 Section 2.2.2: invalid tokens are reported with invalid_request.
+func (a *app) exchangedToken(ctx context.Context, token, tokenType string) (jwt.MapClaims, error) {
+	if token == "" {
+		return nil, newOAuthError("invalid_request", "subject_token is required")
+	}
+	if tokenType != accessTokenType {
+		return nil, newOAuthError("invalid_request", "Unsupported token type '"+tokenType+"'")
+	}
+	jwtToken, err := a.parseToken(ctx, token)
+	if err != nil {
+		return nil, wrapOAuthError("invalid_request", "The token is invalid", err)
+	}
+	claims, ok := jwtToken.Claims.(jwt.MapClaims)
+	if !ok || !isAccessToken(jwtToken) {
+		return nil, newOAuthError("invalid_request", "The token is invalid")
+	}
+	return claims, nil
+}
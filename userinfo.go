@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/simonhege/nestor/account"
+	"github.com/simonhege/server"
+)
+
+// handleUserInfo implements the OpenID Connect UserInfo endpoint (OIDC Core Section 5.3).
+func (a *app) handleUserInfo(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Header.Get("Authorization") == "" {
+		// RFC 6750 Section 3.1: no error code when the request lacks any authentication information
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	token, err := a.getTokenFromRequest(req)
+	if err != nil {
+		var oauthErr *oauthError
+		if errors.As(err, &oauthErr) && oauthErr.Code == "invalid_dpop_proof" {
+			writeDPoPError(w, oauthErr.Description)
+			return
+		}
+		description := "The access token is invalid"
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			description = "The access token expired"
+		}
+		writeBearerError(w, http.StatusUnauthorized, "invalid_token", description)
+		return
+	}
+
+	sub, err := token.Claims.GetSubject()
+	if err != nil || sub == "" {
+		writeBearerError(w, http.StatusUnauthorized, "invalid_token", "The access token has no subject")
+		return
+	}
+
+	scopes := tokenScopes(token)
+	if !slices.Contains(scopes, "openid") {
+		slog.WarnContext(ctx, "UserInfo request without openid scope", "sub", sub)
+		writeBearerError(w, http.StatusForbidden, "insufficient_scope", "The access token was not granted the openid scope")
+		return
+	}
+
+	accountID, err := a.accountIDForSubject(ctx, sub)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	acc, err := a.accountStore.GetById(ctx, accountID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to retrieve account", "account_id", accountID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if acc == nil {
+		slog.WarnContext(ctx, "Account not found", "account_id", accountID)
+		writeBearerError(w, http.StatusUnauthorized, "invalid_token", "The access token subject is unknown")
+		return
+	}
+	if acc.Status != account.StatusActive {
+		slog.WarnContext(ctx, "Account not active", "account_id", acc.ID, "status", acc.Status)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	claims := releasedClaims(acc, scopes, tokenUserInfoClaims(token))
+	// The sub of the access token, which is pairwise for some clients (OIDC Core Section 5.3.2)
+	claims["sub"] = sub
+	server.RenderJSON(w, claims)
+}
+
+// tokenScopes returns the space separated scopes carried by the "scope" claim of token.
+func tokenScopes(token *jwt.Token) []string {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil
+	}
+	scope, _ := claims["scope"].(string)
+	return strings.Fields(scope)
+}
+
+// writeBearerError writes an RFC 6750 Section 3 error response.
+func writeBearerError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error=%q, error_description=%q`, code, description))
+	http.Error(w, http.StatusText(status), status)
+}